@@ -0,0 +1,269 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+)
+
+const (
+	headerSize = 80
+
+	// versionAuxPoW marks a merge-mined block, whose header is followed
+	// by the proof of work from the parent chain.
+	versionAuxPoW = 1 << 8
+
+	opReturn = 0x6a
+)
+
+// hash32 is a block hash, txid or scripthash in internal byte order,
+// the reverse of how it is displayed.
+type hash32 [32]byte
+
+func (h hash32) String() string {
+	var rev [32]byte
+	for i := range h {
+		rev[i] = h[31-i]
+	}
+	return hex.EncodeToString(rev[:])
+}
+
+// parseHash reads a hash in display (reversed hex) order.
+func parseHash(s string) (hash32, error) {
+	var h hash32
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != 32 {
+		return h, fmt.Errorf("invalid hash %q", s)
+	}
+	for i := range h {
+		h[i] = b[31-i]
+	}
+	return h, nil
+}
+
+func decodeHex(s string) ([]byte, error) {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid hex: %v", err)
+	}
+	return b, nil
+}
+
+func doubleSHA256(b []byte) hash32 {
+	first := sha256.Sum256(b)
+	return sha256.Sum256(first[:])
+}
+
+// scriptHash is the Electrum protocol's key for an output script.
+func scriptHash(script []byte) hash32 {
+	return sha256.Sum256(script)
+}
+
+type txInput struct {
+	prev outpoint
+}
+
+type txOutput struct {
+	value  int64
+	script []byte
+}
+
+type transaction struct {
+	txid    hash32
+	raw     []byte
+	inputs  []txInput
+	outputs []txOutput
+}
+
+func (tx *transaction) isCoinbase() bool {
+	return len(tx.inputs) == 1 && tx.inputs[0].prev.Tx == hash32{} && tx.inputs[0].prev.N == 0xffffffff
+}
+
+type block struct {
+	hash   hash32
+	prev   hash32
+	header []byte
+	txs    []*transaction
+}
+
+// reader walks Dogecoin's wire serialization.
+type reader struct {
+	b   []byte
+	pos int
+	err error
+}
+
+var errShortData = errors.New("unexpected end of data")
+
+func (r *reader) bytes(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 || r.pos+n > len(r.b) {
+		r.err = errShortData
+		return nil
+	}
+	b := r.b[r.pos : r.pos+n]
+	r.pos += n
+	return b
+}
+
+func (r *reader) uint32() uint32 {
+	b := r.bytes(4)
+	if b == nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint32(b)
+}
+
+func (r *reader) int64() int64 {
+	b := r.bytes(8)
+	if b == nil {
+		return 0
+	}
+	return int64(binary.LittleEndian.Uint64(b))
+}
+
+func (r *reader) hash() hash32 {
+	var h hash32
+	copy(h[:], r.bytes(32))
+	return h
+}
+
+func (r *reader) varint() uint64 {
+	b := r.bytes(1)
+	if b == nil {
+		return 0
+	}
+	switch b[0] {
+	case 0xfd:
+		if v := r.bytes(2); v != nil {
+			return uint64(binary.LittleEndian.Uint16(v))
+		}
+	case 0xfe:
+		return uint64(r.uint32())
+	case 0xff:
+		if v := r.bytes(8); v != nil {
+			return binary.LittleEndian.Uint64(v)
+		}
+	default:
+		return uint64(b[0])
+	}
+	return 0
+}
+
+// count reads a varint length, refusing values that could not possibly
+// fit in what is left of the data.
+func (r *reader) count() int {
+	n := r.varint()
+	if n > uint64(len(r.b)-r.pos) {
+		if r.err == nil {
+			r.err = errShortData
+		}
+		return 0
+	}
+	return int(n)
+}
+
+func (r *reader) transaction() *transaction {
+	start := r.pos
+	tx := &transaction{}
+	r.uint32() // version
+	for i, n := 0, r.count(); i < n && r.err == nil; i++ {
+		in := txInput{prev: outpoint{Tx: r.hash(), N: r.uint32()}}
+		r.bytes(r.count()) // scriptSig
+		r.uint32()         // sequence
+		tx.inputs = append(tx.inputs, in)
+	}
+	for i, n := 0, r.count(); i < n && r.err == nil; i++ {
+		out := txOutput{value: r.int64()}
+		out.script = r.bytes(r.count())
+		tx.outputs = append(tx.outputs, out)
+	}
+	r.uint32() // lock time
+	if r.err != nil {
+		return nil
+	}
+	tx.raw = r.b[start:r.pos]
+	tx.txid = doubleSHA256(tx.raw)
+	return tx
+}
+
+// auxPoW skips over the merge-mining proof that follows the header of
+// an AuxPoW block: the parent chain's coinbase and its merkle branch,
+// the chain merkle branch and the parent block header.
+func (r *reader) auxPoW() {
+	r.transaction()
+	r.hash()
+	r.bytes(32 * r.count())
+	r.uint32()
+	r.bytes(32 * r.count())
+	r.uint32()
+	r.bytes(headerSize)
+}
+
+func parseBlock(raw []byte) (*block, error) {
+	r := &reader{b: raw}
+	header := r.bytes(headerSize)
+	if r.err != nil {
+		return nil, r.err
+	}
+	b := &block{
+		hash:   doubleSHA256(header),
+		header: header,
+	}
+	copy(b.prev[:], header[4:36])
+	if binary.LittleEndian.Uint32(header[0:4])&versionAuxPoW != 0 {
+		r.auxPoW()
+	}
+	for i, n := 0, r.count(); i < n && r.err == nil; i++ {
+		b.txs = append(b.txs, r.transaction())
+	}
+	if r.err != nil {
+		return nil, fmt.Errorf("parsing block %s: %v", b.hash, r.err)
+	}
+	return b, nil
+}
+
+func parseTransaction(raw []byte) (*transaction, error) {
+	r := &reader{b: raw}
+	tx := r.transaction()
+	if r.err != nil {
+		return nil, r.err
+	}
+	if r.pos != len(raw) {
+		return nil, errors.New("trailing data after transaction")
+	}
+	return tx, nil
+}
+
+// unspendable reports whether an output can never be spent, so it is
+// left out of the UTXO set.
+func unspendable(script []byte) bool {
+	return len(script) > 0 && script[0] == opReturn
+}
+
+// merkleBranch returns the hashes needed to prove that txids[pos] is in
+// the block, bottom up.
+func merkleBranch(txids []hash32, pos int) []hash32 {
+	var branch []hash32
+	level := append([]hash32(nil), txids...)
+	for len(level) > 1 {
+		if len(level)%2 == 1 {
+			level = append(level, level[len(level)-1])
+		}
+		branch = append(branch, level[pos^1])
+		next := make([]hash32, len(level)/2)
+		for i := range next {
+			var pair [64]byte
+			copy(pair[:32], level[2*i][:])
+			copy(pair[32:], level[2*i+1][:])
+			next[i] = doubleSHA256(pair[:])
+		}
+		level = next
+		pos /= 2
+	}
+	return branch
+}
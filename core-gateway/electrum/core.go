@@ -0,0 +1,309 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// coreClient is shared by every call to Core so connections are kept
+// alive and reused.
+var coreClient = &http.Client{
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout:   10 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:        16,
+		MaxIdleConnsPerHost: 16,
+		IdleConnTimeout:     90 * time.Second,
+	},
+}
+
+// coreCredentialsFile is where rpc-proxy keeps the login Core issued to
+// this pup. Both share it, since Core ties a credential to the pup's IP.
+const coreCredentialsFile = "core-credentials.json"
+
+// staticCoreAuth is the login every pup shared before Core issued them
+// per pup, used until rpc-proxy has enrolled.
+var staticCoreAuth = "Basic " + base64.StdEncoding.EncodeToString(
+	[]byte("dogebox_core_pup_temporary_static_username:dogebox_core_pup_temporary_static_password"),
+)
+
+var coreLogin struct {
+	mu       sync.Mutex
+	auth     string
+	modified time.Time
+}
+
+// coreAuth returns the Authorization header for calls to Core, reading
+// the credential file again whenever rpc-proxy enrolls or rotates.
+func coreAuth() string {
+	coreLogin.mu.Lock()
+	defer coreLogin.mu.Unlock()
+
+	path := filepath.Join(storageDirectory, coreCredentialsFile)
+	info, err := os.Stat(path)
+	if err != nil {
+		return staticCoreAuth
+	}
+	if coreLogin.auth != "" && info.ModTime().Equal(coreLogin.modified) {
+		return coreLogin.auth
+	}
+	var cred struct {
+		Provider string `json:"provider"`
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}
+	data, err := os.ReadFile(path)
+	if err == nil {
+		err = json.Unmarshal(data, &cred)
+	}
+	if err != nil || cred.Provider != rpcUpstream || cred.Username == "" {
+		return staticCoreAuth
+	}
+	coreLogin.auth = "Basic " + base64.StdEncoding.EncodeToString([]byte(cred.Username+":"+cred.Password))
+	coreLogin.modified = info.ModTime()
+	return coreLogin.auth
+}
+
+const (
+	coreTimeout     = 60 * time.Second
+	maxCoreResponse = 256 << 20
+)
+
+type coreRequest struct {
+	JSONRPC string        `json:"jsonrpc"`
+	ID      int           `json:"id"`
+	Method  string        `json:"method"`
+	Params  []interface{} `json:"params"`
+}
+
+type coreError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *coreError) Error() string {
+	return fmt.Sprintf("RPC error %d: %s", e.Code, e.Message)
+}
+
+type coreResponse struct {
+	Result json.RawMessage `json:"result"`
+	Error  *coreError      `json:"error"`
+	ID     int             `json:"id"`
+}
+
+// coreCall makes a single RPC call to Core. Errors reported by Core come
+// back as *coreError.
+func coreCall(method string, params ...interface{}) (json.RawMessage, error) {
+	if params == nil {
+		params = []interface{}{}
+	}
+	var resp coreResponse
+	if err := corePost(coreRequest{JSONRPC: "1.0", Method: method, Params: params}, &resp); err != nil {
+		return nil, err
+	}
+	if resp.Error != nil {
+		return nil, resp.Error
+	}
+	return resp.Result, nil
+}
+
+// coreBatch sends calls to Core as one JSON-RPC batch and returns their
+// results in the same order. Any error fails the whole batch.
+func coreBatch(calls []coreRequest) ([]json.RawMessage, error) {
+	if len(calls) == 0 {
+		return nil, nil
+	}
+	for i := range calls {
+		calls[i].JSONRPC = "1.0"
+		calls[i].ID = i
+	}
+	var replies []coreResponse
+	if err := corePost(calls, &replies); err != nil {
+		return nil, err
+	}
+	if len(replies) != len(calls) {
+		return nil, fmt.Errorf("batch response has %d entries, expected %d", len(replies), len(calls))
+	}
+	results := make([]json.RawMessage, len(calls))
+	for _, reply := range replies {
+		if reply.ID < 0 || reply.ID >= len(calls) {
+			return nil, fmt.Errorf("batch response has unexpected id %d", reply.ID)
+		}
+		if reply.Error != nil {
+			return nil, reply.Error
+		}
+		results[reply.ID] = reply.Result
+	}
+	return results, nil
+}
+
+func corePost(request interface{}, reply interface{}) error {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), coreTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "POST", rpcUpstream, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", coreAuth())
+
+	resp, err := coreClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxCoreResponse)).Decode(reply); err != nil {
+		return fmt.Errorf("unexpected response from Core (status %d): %v", resp.StatusCode, err)
+	}
+	return nil
+}
+
+// Typed wrappers for the calls the indexer and server make.
+
+func getBlockCount() (int32, error) {
+	result, err := coreCall("getblockcount")
+	if err != nil {
+		return 0, err
+	}
+	var count int32
+	err = json.Unmarshal(result, &count)
+	return count, err
+}
+
+func getBlockHash(height int32) (hash32, error) {
+	result, err := coreCall("getblockhash", height)
+	if err != nil {
+		return hash32{}, err
+	}
+	var s string
+	if err := json.Unmarshal(result, &s); err != nil {
+		return hash32{}, err
+	}
+	return parseHash(s)
+}
+
+// getRawBlock fetches a block in its serialized form, AuxPoW included.
+func getRawBlock(hash hash32) ([]byte, error) {
+	return hexResult(coreCall("getblock", hash.String(), false))
+}
+
+// getBlockTxids lists a block's transaction ids in block order.
+func getBlockTxids(height int32) ([]hash32, error) {
+	hash, err := getBlockHash(height)
+	if err != nil {
+		return nil, err
+	}
+	result, err := coreCall("getblock", hash.String(), true)
+	if err != nil {
+		return nil, err
+	}
+	var block struct {
+		Tx []string `json:"tx"`
+	}
+	if err := json.Unmarshal(result, &block); err != nil {
+		return nil, err
+	}
+	txids := make([]hash32, len(block.Tx))
+	for i, s := range block.Tx {
+		if txids[i], err = parseHash(s); err != nil {
+			return nil, err
+		}
+	}
+	return txids, nil
+}
+
+// getHeaders fetches the 80 byte headers for count blocks from start,
+// with two batched calls to Core.
+func getHeaders(start, count int32) ([]byte, error) {
+	calls := make([]coreRequest, count)
+	for i := range calls {
+		calls[i] = coreRequest{Method: "getblockhash", Params: []interface{}{start + int32(i)}}
+	}
+	hashes, err := coreBatch(calls)
+	if err != nil {
+		return nil, err
+	}
+	for i, hash := range hashes {
+		var s string
+		if err := json.Unmarshal(hash, &s); err != nil {
+			return nil, err
+		}
+		calls[i] = coreRequest{Method: "getblockheader", Params: []interface{}{s, false}}
+	}
+	headers, err := coreBatch(calls)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]byte, 0, int(count)*headerSize)
+	for _, header := range headers {
+		raw, err := hexResult(header, nil)
+		if err != nil {
+			return nil, err
+		}
+		if len(raw) < headerSize {
+			return nil, errors.New("short block header from Core")
+		}
+		// Merge-mined headers may come with their AuxPoW attached;
+		// Electrum clients only want the 80 byte header.
+		out = append(out, raw[:headerSize]...)
+	}
+	return out, nil
+}
+
+func getRawMempool() ([]hash32, error) {
+	result, err := coreCall("getrawmempool")
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	if err := json.Unmarshal(result, &ids); err != nil {
+		return nil, err
+	}
+	txids := make([]hash32, 0, len(ids))
+	for _, s := range ids {
+		txid, err := parseHash(s)
+		if err != nil {
+			return nil, err
+		}
+		txids = append(txids, txid)
+	}
+	return txids, nil
+}
+
+// getRawTransaction only finds mempool transactions unless Core runs
+// with -txindex.
+func getRawTransaction(txid hash32) ([]byte, error) {
+	return hexResult(coreCall("getrawtransaction", txid.String(), false))
+}
+
+func hexResult(result json.RawMessage, err error) ([]byte, error) {
+	if err != nil {
+		return nil, err
+	}
+	var s string
+	if err := json.Unmarshal(result, &s); err != nil {
+		return nil, err
+	}
+	return decodeHex(s)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// tipFollower subscribes to Core's hashblock notifications so the index
+// syncs as soon as a block arrives rather than at the next poll.
+type tipFollower struct {
+	upstream string
+	index    *chainIndex
+
+	mu   sync.Mutex
+	conn net.Conn
+	done chan struct{}
+}
+
+func newTipFollower(upstream string, index *chainIndex) *tipFollower {
+	return &tipFollower{upstream: upstream, index: index, done: make(chan struct{})}
+}
+
+// run keeps the subscription alive, reconnecting with backoff, until
+// the follower is closed.
+func (f *tipFollower) run() {
+	backoff := time.Second
+	for {
+		started := time.Now()
+		err := f.subscribe()
+		select {
+		case <-f.done:
+			return
+		default:
+		}
+		if time.Since(started) > time.Minute {
+			backoff = time.Second
+		}
+		log.Printf("ZMQ upstream %s disconnected: %v (retrying in %s)", f.upstream, err, backoff)
+		select {
+		case <-f.done:
+			return
+		case <-time.After(backoff):
+		}
+		if backoff < time.Minute {
+			backoff *= 2
+		}
+	}
+}
+
+func (f *tipFollower) subscribe() error {
+	conn, err := net.DialTimeout("tcp", f.upstream, 10*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	f.mu.Lock()
+	select {
+	case <-f.done:
+		f.mu.Unlock()
+		return errors.New("follower closed")
+	default:
+	}
+	f.conn = conn
+	f.mu.Unlock()
+
+	c, _, err := zmtpHandshake(conn, "SUB", false)
+	if err != nil {
+		return err
+	}
+	if err := c.subscribe("hashblock"); err != nil {
+		return err
+	}
+	log.Printf("Following new blocks from %s", f.upstream)
+
+	for {
+		parts, err := c.readMessage()
+		if err != nil {
+			return err
+		}
+		if len(parts) >= 2 && string(parts[0]) == "hashblock" {
+			f.index.refreshSoon()
+		}
+	}
+}
+
+func (f *tipFollower) close() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	select {
+	case <-f.done:
+		return
+	default:
+	}
+	close(f.done)
+	if f.conn != nil {
+		f.conn.Close()
+	}
+}
@@ -0,0 +1,613 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	indexVersion  = 1
+	indexFileName = "index.gob"
+
+	// reorgLimit is how many blocks of undo data are kept. A reorg any
+	// deeper than this makes the index start again from scratch.
+	reorgLimit = 100
+
+	saveInterval = 5 * time.Minute
+	pollInterval = 10 * time.Second
+
+	// Subscribers are notified at least this often while catching up.
+	notifyBlocks = 100
+
+	// maxIndexBlocks caps how far behind Core's tip a new index may
+	// start, about ten weeks of Dogecoin blocks. The index lives in
+	// memory, and the whole chain would not fit on a Dogebox.
+	maxIndexBlocks = 100000
+)
+
+var errStartTooOld = errors.New("start height too far behind the tip")
+
+type outpoint struct {
+	Tx hash32
+	N  uint32
+}
+
+type utxo struct {
+	Script hash32
+	Value  int64
+	Height int32
+}
+
+type histItem struct {
+	Tx     hash32
+	Height int32
+}
+
+type spentOutput struct {
+	Out  outpoint
+	UTXO utxo
+}
+
+// blockUndo is everything needed to take a block back off the index.
+type blockUndo struct {
+	Height  int32
+	Hash    hash32
+	Prev    hash32
+	Header  []byte
+	Txs     []hash32
+	Created []outpoint
+	Spent   []spentOutput
+	Touched []hash32
+}
+
+// indexState is the part of the index saved to /storage. Fields are
+// exported for gob.
+type indexState struct {
+	Version   int
+	Start     int32
+	Height    int32
+	Tip       hash32
+	Header    []byte
+	History   map[hash32][]histItem
+	UTXOs     map[outpoint]utxo
+	Unspent   map[hash32][]outpoint
+	TxHeights map[hash32]int32
+	Undo      []blockUndo
+}
+
+// chainIndex maps scripthashes to their transaction history and unspent
+// outputs, built from blocks fetched from Core starting at Start. The
+// whole index lives in memory and is saved to a single file every few
+// minutes and on shutdown, so a restart resumes where it left off.
+type chainIndex struct {
+	mu sync.RWMutex
+	indexState
+	pool mempool
+
+	path       string
+	lastSave   time.Time
+	coreHeight atomic.Int32
+	synced     atomic.Bool
+
+	// onChange is told which scripthashes changed (nil meaning all of
+	// them) and whether there is a new tip.
+	onChange func(touched map[hash32]bool, newTip bool)
+
+	wake    chan struct{}
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+func openIndex(dir string, start int32) (*chainIndex, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	x := &chainIndex{
+		path:     filepath.Join(dir, indexFileName),
+		lastSave: time.Now(),
+		onChange: func(map[hash32]bool, bool) {},
+		wake:     make(chan struct{}, 1),
+		done:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+	x.pool.reset()
+
+	f, err := os.Open(x.path)
+	if os.IsNotExist(err) {
+		x.reset(start)
+		return x, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	if err := gob.NewDecoder(f).Decode(&x.indexState); err != nil {
+		log.Printf("Index: %s is unreadable, starting again: %v", x.path, err)
+		x.reset(start)
+		return x, nil
+	}
+	if x.Version != indexVersion {
+		log.Printf("Index: %s is from an older version, starting again", x.path)
+		x.reset(start)
+		return x, nil
+	}
+	if x.Start != start {
+		log.Printf("Index: start height changed from %d to %d, starting again", x.Start, start)
+		x.reset(start)
+	}
+	return x, nil
+}
+
+func (x *chainIndex) reset(start int32) {
+	if start < 0 {
+		start = 0
+	}
+	x.indexState = indexState{
+		Version:   indexVersion,
+		Start:     start,
+		Height:    start - 1,
+		History:   map[hash32][]histItem{},
+		UTXOs:     map[outpoint]utxo{},
+		Unspent:   map[hash32][]outpoint{},
+		TxHeights: map[hash32]int32{},
+	}
+}
+
+// save writes the index to a temporary file and renames it into place,
+// so a crash part way through leaves the previous copy intact.
+func (x *chainIndex) save() error {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+
+	tmp := x.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if err := gob.NewEncoder(f).Encode(&x.indexState); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, x.path); err != nil {
+		return err
+	}
+	x.lastSave = time.Now()
+	log.Printf("Index: saved at height %d", x.Height)
+	return nil
+}
+
+// refreshSoon wakes the sync loop, for example on a ZMQ hashblock or
+// after a broadcast.
+func (x *chainIndex) refreshSoon() {
+	select {
+	case x.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run keeps the index in step with Core until close is called, syncing
+// whenever a block is announced and polling in case an announcement is
+// missed. The mempool is only followed once the index has caught up.
+func (x *chainIndex) run() {
+	defer close(x.stopped)
+	warnedStart := false
+	for {
+		if err := x.sync(); errors.Is(err, errStartTooOld) {
+			if !warnedStart {
+				log.Printf("Index: not indexing: %v", err)
+				warnedStart = true
+			}
+		} else if err != nil {
+			log.Printf("Index: sync failed: %v", err)
+		}
+		if x.synced.Load() {
+			if err := x.refreshMempool(); err != nil {
+				log.Printf("Index: mempool refresh failed: %v", err)
+			}
+		}
+		select {
+		case <-x.wake:
+		case <-time.After(pollInterval):
+		case <-x.done:
+			return
+		}
+	}
+}
+
+// close stops the sync loop and saves the index.
+func (x *chainIndex) close() {
+	close(x.done)
+	<-x.stopped
+	if err := x.save(); err != nil {
+		log.Printf("Index: save failed: %v", err)
+	}
+}
+
+func (x *chainIndex) stopping() bool {
+	select {
+	case <-x.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// sync applies blocks from Core until the index reaches Core's tip,
+// undoing blocks first whenever Core has switched to another chain.
+func (x *chainIndex) sync() error {
+	touched := map[hash32]bool{}
+	newTip := false
+	blocks := 0
+	flush := func() {
+		if len(touched) > 0 || newTip {
+			x.onChange(touched, newTip)
+		}
+		touched, newTip, blocks = map[hash32]bool{}, false, 0
+	}
+	defer flush()
+
+	for !x.stopping() {
+		count, err := getBlockCount()
+		if err != nil {
+			return err
+		}
+		x.coreHeight.Store(count)
+
+		x.mu.RLock()
+		start, height, tip := x.Start, x.Height, x.Tip
+		x.mu.RUnlock()
+
+		if height >= count {
+			if height < start {
+				// Core has not reached the start height yet
+				x.synced.Store(true)
+				return nil
+			}
+			if height == count {
+				hash, err := getBlockHash(height)
+				if err != nil {
+					return err
+				}
+				if hash == tip {
+					x.synced.Store(true)
+					if time.Since(x.lastSave) > saveInterval {
+						return x.save()
+					}
+					return nil
+				}
+			}
+			if !x.undoTip(touched) {
+				touched = nil
+			}
+			newTip = true
+			continue
+		}
+
+		if height < start && count-start > maxIndexBlocks {
+			return fmt.Errorf("%w: height %d is %d blocks behind Core's tip; set Index From Height to %d or later",
+				errStartTooOld, start, count-start, count-maxIndexBlocks)
+		}
+
+		x.synced.Store(false)
+		hash, err := getBlockHash(height + 1)
+		if err != nil {
+			return err
+		}
+		raw, err := getRawBlock(hash)
+		if err != nil {
+			return err
+		}
+		b, err := parseBlock(raw)
+		if err != nil {
+			return err
+		}
+		if b.hash != hash {
+			return fmt.Errorf("block at height %d hashes to %s, expected %s", height+1, b.hash, hash)
+		}
+		if height >= start && b.prev != tip {
+			if !x.undoTip(touched) {
+				touched = nil
+			}
+			newTip = true
+			continue
+		}
+
+		x.apply(height+1, b, touched)
+		newTip = true
+		blocks++
+		if (height+1)%1000 == 0 {
+			log.Printf("Index: height %d of %d", height+1, count)
+		}
+		if touched == nil || blocks >= notifyBlocks {
+			flush()
+		}
+		if time.Since(x.lastSave) > saveInterval {
+			if err := x.save(); err != nil {
+				log.Printf("Index: save failed: %v", err)
+			}
+		}
+	}
+	return nil
+}
+
+// apply adds block b at height to the index, recording the scripthashes
+// it touches.
+func (x *chainIndex) apply(height int32, b *block, touched map[hash32]bool) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	u := blockUndo{Height: height, Hash: b.hash, Prev: x.Tip, Header: x.Header}
+	for _, tx := range b.txs {
+		scripts := map[hash32]bool{}
+		if !tx.isCoinbase() {
+			for _, in := range tx.inputs {
+				spent, ok := x.UTXOs[in.prev]
+				if !ok {
+					// Created before the start height. The wallet's
+					// balance never included it, so there is nothing
+					// to take off; server.banner and server.features
+					// tell clients where the index starts.
+					continue
+				}
+				x.spend(in.prev, spent)
+				u.Spent = append(u.Spent, spentOutput{Out: in.prev, UTXO: spent})
+				scripts[spent.Script] = true
+			}
+		}
+		for n, out := range tx.outputs {
+			if unspendable(out.script) {
+				continue
+			}
+			op := outpoint{Tx: tx.txid, N: uint32(n)}
+			sh := scriptHash(out.script)
+			x.UTXOs[op] = utxo{Script: sh, Value: out.value, Height: height}
+			x.Unspent[sh] = append(x.Unspent[sh], op)
+			u.Created = append(u.Created, op)
+			scripts[sh] = true
+		}
+		for sh := range scripts {
+			x.History[sh] = append(x.History[sh], histItem{Tx: tx.txid, Height: height})
+			u.Touched = append(u.Touched, sh)
+			if touched != nil {
+				touched[sh] = true
+			}
+		}
+		x.TxHeights[tx.txid] = height
+		u.Txs = append(u.Txs, tx.txid)
+
+		for _, sh := range x.pool.remove(tx.txid) {
+			if touched != nil {
+				touched[sh] = true
+			}
+		}
+	}
+
+	x.Height = height
+	x.Tip = b.hash
+	x.Header = append([]byte(nil), b.header...)
+	x.Undo = append(x.Undo, u)
+	if len(x.Undo) > reorgLimit {
+		x.Undo = append([]blockUndo(nil), x.Undo[len(x.Undo)-reorgLimit:]...)
+	}
+}
+
+// undoTip takes the tip block back off the index. Without undo data for
+// it, the reorg is deeper than reorgLimit and the whole index is reset;
+// undoTip then returns false.
+func (x *chainIndex) undoTip(touched map[hash32]bool) bool {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	if len(x.Undo) == 0 || x.Undo[len(x.Undo)-1].Height != x.Height {
+		log.Printf("Index: reorg at height %d is deeper than the undo data, indexing again from %d", x.Height, x.Start)
+		x.reset(x.Start)
+		x.pool.reset()
+		return false
+	}
+	u := x.Undo[len(x.Undo)-1]
+	x.Undo = x.Undo[:len(x.Undo)-1]
+	log.Printf("Index: undoing block %s at height %d", u.Hash, u.Height)
+
+	for _, sh := range u.Touched {
+		items := x.History[sh]
+		for len(items) > 0 && items[len(items)-1].Height == u.Height {
+			items = items[:len(items)-1]
+		}
+		if len(items) == 0 {
+			delete(x.History, sh)
+		} else {
+			x.History[sh] = items
+		}
+		if touched != nil {
+			touched[sh] = true
+		}
+	}
+	for i := len(u.Created) - 1; i >= 0; i-- {
+		if out, ok := x.UTXOs[u.Created[i]]; ok {
+			x.spend(u.Created[i], out)
+		}
+	}
+	for i := len(u.Spent) - 1; i >= 0; i-- {
+		s := u.Spent[i]
+		x.UTXOs[s.Out] = s.UTXO
+		x.Unspent[s.UTXO.Script] = append(x.Unspent[s.UTXO.Script], s.Out)
+	}
+	for _, txid := range u.Txs {
+		delete(x.TxHeights, txid)
+	}
+
+	x.Height = u.Height - 1
+	x.Tip = u.Prev
+	x.Header = u.Header
+	return true
+}
+
+// spend removes op from the UTXO set; callers must hold x.mu.
+func (x *chainIndex) spend(op outpoint, out utxo) {
+	delete(x.UTXOs, op)
+	ops := x.Unspent[out.Script]
+	for i, o := range ops {
+		if o == op {
+			ops[i] = ops[len(ops)-1]
+			ops = ops[:len(ops)-1]
+			break
+		}
+	}
+	if len(ops) == 0 {
+		delete(x.Unspent, out.Script)
+	} else {
+		x.Unspent[out.Script] = ops
+	}
+}
+
+// Queries used by the Electrum methods.
+
+type historyEntry struct {
+	TxHash string `json:"tx_hash"`
+	Height int32  `json:"height"`
+	Fee    *int64 `json:"fee,omitempty"`
+}
+
+type unspentEntry struct {
+	TxHash string `json:"tx_hash"`
+	TxPos  uint32 `json:"tx_pos"`
+	Height int32  `json:"height"`
+	Value  int64  `json:"value"`
+}
+
+// startHeight is the first block indexed. Coins received before it, and
+// the transactions spending them, are missing from every result.
+func (x *chainIndex) startHeight() int32 {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	return x.Start
+}
+
+func (x *chainIndex) tip() (int32, []byte) {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	return x.Height, x.Header
+}
+
+func (x *chainIndex) txHeight(txid hash32) (int32, bool) {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	height, ok := x.TxHeights[txid]
+	return height, ok
+}
+
+// history lists sh's confirmed transactions in block order, followed by
+// its mempool transactions.
+func (x *chainIndex) history(sh hash32) []historyEntry {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+
+	entries := []historyEntry{}
+	for _, item := range x.History[sh] {
+		entries = append(entries, historyEntry{TxHash: item.Tx.String(), Height: item.Height})
+	}
+	return append(entries, x.pool.history(sh)...)
+}
+
+func (x *chainIndex) mempoolHistory(sh hash32) []historyEntry {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	return append([]historyEntry{}, x.pool.history(sh)...)
+}
+
+// status is the Electrum status of a scripthash: the SHA-256 of its
+// history as "tx_hash:height:" strings, or nil with no history.
+func (x *chainIndex) status(sh hash32) *string {
+	entries := x.history(sh)
+	if len(entries) == 0 {
+		return nil
+	}
+	h := sha256.New()
+	for _, e := range entries {
+		fmt.Fprintf(h, "%s:%d:", e.TxHash, e.Height)
+	}
+	status := hex.EncodeToString(h.Sum(nil))
+	return &status
+}
+
+// balance returns sh's confirmed balance and the net change from the
+// mempool.
+func (x *chainIndex) balance(sh hash32) (confirmed, unconfirmed int64) {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+
+	for _, op := range x.Unspent[sh] {
+		confirmed += x.UTXOs[op].Value
+	}
+	for txid := range x.pool.byScript[sh] {
+		entry := x.pool.txs[txid]
+		for _, out := range entry.outputs {
+			if out.Script == sh {
+				unconfirmed += out.Value
+			}
+		}
+		for _, in := range entry.inputs {
+			if in.known && in.UTXO.Script == sh {
+				unconfirmed -= in.UTXO.Value
+			}
+		}
+	}
+	return confirmed, unconfirmed
+}
+
+// listUnspent returns sh's outputs that are not spent by a confirmed or
+// mempool transaction, confirmed ones first.
+func (x *chainIndex) listUnspent(sh hash32) []unspentEntry {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+
+	entries := []unspentEntry{}
+	for _, op := range x.Unspent[sh] {
+		if x.pool.spent[op] {
+			continue
+		}
+		out := x.UTXOs[op]
+		entries = append(entries, unspentEntry{TxHash: op.Tx.String(), TxPos: op.N, Height: out.Height, Value: out.Value})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Height != entries[j].Height {
+			return entries[i].Height < entries[j].Height
+		}
+		if entries[i].TxHash != entries[j].TxHash {
+			return entries[i].TxHash < entries[j].TxHash
+		}
+		return entries[i].TxPos < entries[j].TxPos
+	})
+
+	var pending []unspentEntry
+	for txid := range x.pool.byScript[sh] {
+		for _, out := range x.pool.txs[txid].outputs {
+			if out.Script == sh && !x.pool.spent[out.Out] {
+				pending = append(pending, unspentEntry{TxHash: txid.String(), TxPos: out.Out.N, Value: out.Value})
+			}
+		}
+	}
+	sort.Slice(pending, func(i, j int) bool {
+		if pending[i].TxHash != pending[j].TxHash {
+			return pending[i].TxHash < pending[j].TxHash
+		}
+		return pending[i].TxPos < pending[j].TxPos
+	})
+	return append(entries, pending...)
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+var storageDirectory string
+
+var (
+	pupIP       string
+	rpcUpstream string
+	zmqUpstream string
+)
+
+const (
+	tcpPort = "50001"
+	sslPort = "50002"
+
+	// statusListenAddr is only reachable from inside the pup; rpc-proxy
+	// reads it to include the index's progress in the pup's metrics.
+	statusListenAddr = "127.0.0.1:22598"
+)
+
+func main() {
+	pupIP = os.Getenv("DBX_PUP_IP")
+	rpcUpstream = "http://" + os.Getenv("DBX_IFACE_CORE_RPC_HOST") + ":" + os.Getenv("DBX_IFACE_CORE_RPC_PORT")
+	zmqUpstream = os.Getenv("DBX_IFACE_CORE_ZMQ_HOST") + ":" + os.Getenv("DBX_IFACE_CORE_ZMQ_PORT")
+
+	log.Printf("Electrum server starting...")
+	if enabled, _ := strconv.ParseBool(os.Getenv("ELECTRUM_ENABLED")); !enabled {
+		log.Printf("Electrum server is disabled in the pup config")
+		waitForSignal()
+		return
+	}
+	log.Printf("  RPC Upstream: %s", rpcUpstream)
+	log.Printf("  ZMQ Upstream: %s", zmqUpstream)
+
+	index, err := openIndex(filepath.Join(storageDirectory, "electrum"), int32(envFloat("ELECTRUM_START_HEIGHT", 0)))
+	if err != nil {
+		log.Fatalf("Failed to open index: %v", err)
+	}
+	log.Printf("  Index: from height %d, indexed to %d", index.Start, index.Height)
+
+	tlsConfig, fingerprint, err := loadTLSConfig(os.Getenv("RPC_TLS_CERT"), os.Getenv("RPC_TLS_KEY"))
+	if err != nil {
+		log.Fatalf("Failed to set up TLS: %v", err)
+	}
+	log.Printf("  TLS Fingerprint (SHA-256): %s", fingerprint)
+
+	srv := newServer(index, int(envFloat("ELECTRUM_MAX_SESSIONS", 64)))
+	follower := newTipFollower(zmqUpstream, index)
+	go index.run()
+	go follower.run()
+	go startStatusServer(srv)
+
+	if err := srv.listen(pupIP+":"+tcpPort, nil); err != nil {
+		log.Fatalf("Failed to listen on %s: %v", tcpPort, err)
+	}
+	if err := srv.listen(pupIP+":"+sslPort, tlsConfig); err != nil {
+		log.Fatalf("Failed to listen on %s: %v", sslPort, err)
+	}
+	log.Printf("Electrum server listening on %s:%s (TCP) and %s:%s (SSL)", pupIP, tcpPort, pupIP, sslPort)
+
+	sig := waitForSignal()
+	log.Printf("Received %s, shutting down", sig)
+	follower.close()
+	srv.close(envSeconds("SHUTDOWN_TIMEOUT", 20))
+	index.close()
+	log.Printf("Shutdown complete")
+}
+
+func waitForSignal() os.Signal {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	return <-signals
+}
+
+func startStatusServer(srv *server) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		height, _ := srv.index.tip()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"height":      height,
+			"core_height": srv.index.coreHeight.Load(),
+			"synced":      srv.index.synced.Load(),
+			"sessions":    srv.sessionCount(),
+			"requests":    srv.requests.Load(),
+		})
+	})
+
+	log.Printf("Status endpoint listening on %s", statusListenAddr)
+	if err := http.ListenAndServe(statusListenAddr, mux); err != nil {
+		log.Printf("Status endpoint failed: %v", err)
+	}
+}
+
+// envFloat reads a numeric pup config value, falling back to def when it
+// is unset or malformed.
+func envFloat(name string, def float64) float64 {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		log.Printf("Ignoring invalid %s=%q: %v", name, value, err)
+		return def
+	}
+	return f
+}
+
+// envSeconds reads a duration given in seconds in the pup config.
+func envSeconds(name string, def float64) time.Duration {
+	return time.Duration(envFloat(name, def) * float64(time.Second))
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"sort"
+)
+
+// maxMempoolFetch bounds how many new mempool transactions are fetched
+// from Core per refresh, so a flood of them cannot stall the sync loop.
+const maxMempoolFetch = 5000
+
+type poolInput struct {
+	Out  outpoint
+	UTXO utxo
+	// known is set when the output being spent was found, in the index
+	// or in the mempool.
+	known bool
+}
+
+type poolOutput struct {
+	Out    outpoint
+	Script hash32
+	Value  int64
+}
+
+type poolTx struct {
+	inputs  []poolInput
+	outputs []poolOutput
+	scripts []hash32
+	fee     int64
+	// height is 0, or -1 when the transaction spends another mempool
+	// transaction, as the Electrum protocol reports it.
+	height int32
+}
+
+// mempool tracks Core's unconfirmed transactions by scripthash. It is
+// guarded by the chainIndex lock.
+type mempool struct {
+	txs      map[hash32]*poolTx
+	byScript map[hash32]map[hash32]bool
+	spent    map[outpoint]bool
+}
+
+func (m *mempool) reset() {
+	m.txs = map[hash32]*poolTx{}
+	m.byScript = map[hash32]map[hash32]bool{}
+	m.spent = map[outpoint]bool{}
+}
+
+func newPoolTx(tx *transaction) *poolTx {
+	p := &poolTx{}
+	for _, in := range tx.inputs {
+		p.inputs = append(p.inputs, poolInput{Out: in.prev})
+	}
+	for n, out := range tx.outputs {
+		if unspendable(out.script) {
+			continue
+		}
+		p.outputs = append(p.outputs, poolOutput{
+			Out:    outpoint{Tx: tx.txid, N: uint32(n)},
+			Script: scriptHash(out.script),
+			Value:  out.value,
+		})
+	}
+	return p
+}
+
+// remove drops txid, returning the scripthashes it touched.
+func (m *mempool) remove(txid hash32) []hash32 {
+	p, ok := m.txs[txid]
+	if !ok {
+		return nil
+	}
+	delete(m.txs, txid)
+	for _, sh := range p.scripts {
+		if set := m.byScript[sh]; set != nil {
+			delete(set, txid)
+			if len(set) == 0 {
+				delete(m.byScript, sh)
+			}
+		}
+	}
+	for _, in := range p.inputs {
+		delete(m.spent, in.Out)
+	}
+	return p.scripts
+}
+
+// history lists sh's mempool transactions, those with only confirmed
+// inputs first.
+func (m *mempool) history(sh hash32) []historyEntry {
+	var entries []historyEntry
+	for txid := range m.byScript[sh] {
+		p := m.txs[txid]
+		fee := p.fee
+		entries = append(entries, historyEntry{TxHash: txid.String(), Height: p.height, Fee: &fee})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Height != entries[j].Height {
+			return entries[i].Height > entries[j].Height
+		}
+		return entries[i].TxHash < entries[j].TxHash
+	})
+	return entries
+}
+
+// refreshMempool brings the mempool in line with Core's, fetching any
+// new transactions, and tells subscribers which scripthashes changed.
+func (x *chainIndex) refreshMempool() error {
+	ids, err := getRawMempool()
+	if err != nil {
+		return err
+	}
+
+	current := make(map[hash32]bool, len(ids))
+	var missing []hash32
+	x.mu.RLock()
+	for _, txid := range ids {
+		current[txid] = true
+		if _, ok := x.pool.txs[txid]; !ok {
+			missing = append(missing, txid)
+		}
+	}
+	x.mu.RUnlock()
+
+	if len(missing) > maxMempoolFetch {
+		missing = missing[:maxMempoolFetch]
+	}
+	fetched := map[hash32]*transaction{}
+	for _, txid := range missing {
+		raw, err := getRawTransaction(txid)
+		if err != nil {
+			// Mined or evicted since getrawmempool
+			continue
+		}
+		tx, err := parseTransaction(raw)
+		if err != nil || tx.txid != txid {
+			continue
+		}
+		fetched[txid] = tx
+	}
+
+	x.mu.Lock()
+	touched := map[hash32]bool{}
+	for txid := range x.pool.txs {
+		if !current[txid] {
+			for _, sh := range x.pool.remove(txid) {
+				touched[sh] = true
+			}
+		}
+	}
+	added := map[hash32]bool{}
+	for txid, tx := range fetched {
+		if _, confirmed := x.TxHeights[txid]; confirmed {
+			continue
+		}
+		x.pool.txs[txid] = newPoolTx(tx)
+		added[txid] = true
+	}
+	for sh := range x.resolvePool(added) {
+		touched[sh] = true
+	}
+	x.mu.Unlock()
+
+	if len(touched) > 0 {
+		x.onChange(touched, false)
+	}
+	return nil
+}
+
+// resolvePool looks up the outputs every mempool transaction spends,
+// which can change as blocks arrive and other transactions come and go,
+// and rebuilds the lookup tables. It returns the scripthashes whose
+// mempool history changed, including those of the added transactions.
+// Callers must hold x.mu.
+func (x *chainIndex) resolvePool(added map[hash32]bool) map[hash32]bool {
+	m := &x.pool
+	changed := map[hash32]bool{}
+	m.byScript = map[hash32]map[hash32]bool{}
+	m.spent = map[outpoint]bool{}
+
+	for txid, p := range m.txs {
+		oldFee, oldHeight, oldScripts := p.fee, p.height, p.scripts
+
+		p.height = 0
+		complete := true
+		var in, out int64
+		scripts := map[hash32]bool{}
+		for i := range p.inputs {
+			input := &p.inputs[i]
+			input.known = false
+			if u, ok := x.UTXOs[input.Out]; ok {
+				input.UTXO, input.known = u, true
+			} else if parent, ok := m.txs[input.Out.Tx]; ok {
+				p.height = -1
+				for _, o := range parent.outputs {
+					if o.Out == input.Out {
+						input.UTXO, input.known = utxo{Script: o.Script, Value: o.Value}, true
+					}
+				}
+			}
+			if !input.known {
+				complete = false
+				continue
+			}
+			in += input.UTXO.Value
+			scripts[input.UTXO.Script] = true
+			m.spent[input.Out] = true
+		}
+		for _, o := range p.outputs {
+			out += o.Value
+			scripts[o.Script] = true
+		}
+		p.fee = 0
+		if complete {
+			p.fee = in - out
+		}
+
+		p.scripts = nil
+		for sh := range scripts {
+			p.scripts = append(p.scripts, sh)
+			if m.byScript[sh] == nil {
+				m.byScript[sh] = map[hash32]bool{}
+			}
+			m.byScript[sh][txid] = true
+		}
+
+		if added[txid] || p.fee != oldFee || p.height != oldHeight || len(p.scripts) != len(oldScripts) {
+			for _, sh := range append(oldScripts, p.scripts...) {
+				changed[sh] = true
+			}
+		}
+	}
+	return changed
+}
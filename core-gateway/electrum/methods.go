@@ -0,0 +1,489 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+)
+
+const (
+	serverVersion   = "Dogebox Electrum 0.0.1"
+	protocolVersion = "1.4"
+
+	// maxHeaders is the most headers blockchain.block.headers returns
+	// at once, the size of a difficulty period in Bitcoin that Electrum
+	// clients request in chunks of.
+	maxHeaders = 2016
+)
+
+type methodHandler func(sess *session, params []json.RawMessage) (interface{}, error)
+
+var methods map[string]methodHandler
+
+func init() {
+	methods = map[string]methodHandler{
+		"server.version":            serverVersionMethod,
+		"server.banner":             serverBanner,
+		"server.donation_address":   constant(""),
+		"server.features":           serverFeatures,
+		"server.peers.subscribe":    constant([]interface{}{}),
+		"server.ping":               constant(nil),
+		"mempool.get_fee_histogram": constant([]interface{}{}),
+
+		"blockchain.headers.subscribe": headersSubscribe,
+		"blockchain.block.header":      blockHeader,
+		"blockchain.block.headers":     blockHeaders,
+		"blockchain.estimatefee":       estimateFee,
+		"blockchain.relayfee":          relayFee,
+
+		"blockchain.scripthash.get_balance": scripthashBalance,
+		"blockchain.scripthash.get_history": scripthashHistory,
+		"blockchain.scripthash.get_mempool": scripthashMempool,
+		"blockchain.scripthash.listunspent": scripthashUnspent,
+		"blockchain.scripthash.subscribe":   scripthashSubscribe,
+		"blockchain.scripthash.unsubscribe": scripthashUnsubscribe,
+
+		"blockchain.transaction.broadcast":   transactionBroadcast,
+		"blockchain.transaction.get":         transactionGet,
+		"blockchain.transaction.get_merkle":  transactionMerkle,
+		"blockchain.transaction.id_from_pos": transactionFromPos,
+	}
+}
+
+func constant(v interface{}) methodHandler {
+	return func(*session, []json.RawMessage) (interface{}, error) {
+		return v, nil
+	}
+}
+
+// Parameter helpers. Optional parameters that are missing or null take
+// the default.
+
+func optionalParam(params []json.RawMessage, i int) (json.RawMessage, bool) {
+	if i >= len(params) || string(params[i]) == "null" {
+		return nil, false
+	}
+	return params[i], true
+}
+
+func stringParam(params []json.RawMessage, i int, name string) (string, error) {
+	raw, ok := optionalParam(params, i)
+	if !ok {
+		return "", invalidParams("missing " + name)
+	}
+	var s string
+	if err := json.Unmarshal(raw, &s); err != nil {
+		return "", invalidParams(name + " must be a string")
+	}
+	return s, nil
+}
+
+func intParam(params []json.RawMessage, i int, name string, def int64, required bool) (int64, error) {
+	raw, ok := optionalParam(params, i)
+	if !ok {
+		if required {
+			return 0, invalidParams("missing " + name)
+		}
+		return def, nil
+	}
+	var n int64
+	if err := json.Unmarshal(raw, &n); err != nil || n < 0 {
+		return 0, invalidParams(name + " must be a non-negative integer")
+	}
+	return n, nil
+}
+
+func boolParam(params []json.RawMessage, i int, name string) (bool, error) {
+	raw, ok := optionalParam(params, i)
+	if !ok {
+		return false, nil
+	}
+	var b bool
+	if err := json.Unmarshal(raw, &b); err != nil {
+		return false, invalidParams(name + " must be a boolean")
+	}
+	return b, nil
+}
+
+func hashParam(params []json.RawMessage, i int, name string) (hash32, error) {
+	s, err := stringParam(params, i, name)
+	if err != nil {
+		return hash32{}, err
+	}
+	h, err := parseHash(s)
+	if err != nil {
+		return hash32{}, invalidParams(name + " must be a 64 character hex string")
+	}
+	return h, nil
+}
+
+// cpHeight rejects checkpoint proofs, which would need every header hash
+// up to the checkpoint.
+func cpHeight(params []json.RawMessage, i int) error {
+	cp, err := intParam(params, i, "cp_height", 0, false)
+	if err != nil {
+		return err
+	}
+	if cp != 0 {
+		return &rpcError{Code: errBadRequest, Message: "cp_height is not supported by this server"}
+	}
+	return nil
+}
+
+// server.*
+
+func serverVersionMethod(sess *session, params []json.RawMessage) (interface{}, error) {
+	return []string{serverVersion, protocolVersion}, nil
+}
+
+// serverBanner warns users, through the wallets that show it, when their
+// balances and history only cover part of the chain.
+func serverBanner(sess *session, params []json.RawMessage) (interface{}, error) {
+	banner := "Dogecoin Core Gateway Electrum server"
+	if start := sess.srv.index.startHeight(); start > 0 {
+		banner += fmt.Sprintf(". Only blocks from height %d on are indexed: coins received before it, "+
+			"and transactions spending them, are left out of balances and history.", start)
+	}
+	return banner, nil
+}
+
+var genesis struct {
+	once sync.Once
+	hash string
+}
+
+func serverFeatures(sess *session, params []json.RawMessage) (interface{}, error) {
+	genesis.once.Do(func() {
+		if hash, err := getBlockHash(0); err == nil {
+			genesis.hash = hash.String()
+		}
+	})
+	return map[string]interface{}{
+		"genesis_hash":   genesis.hash,
+		"hosts":          map[string]interface{}{},
+		"protocol_max":   protocolVersion,
+		"protocol_min":   protocolVersion,
+		"pruning":        nil,
+		"server_version": serverVersion,
+		"hash_function":  "sha256",
+		// Not part of the Electrum protocol; where history begins
+		"index_start_height": sess.srv.index.startHeight(),
+	}, nil
+}
+
+// blockchain.headers.* and blockchain.block.*
+
+func headerResult(height int32, header []byte) map[string]interface{} {
+	return map[string]interface{}{"height": height, "hex": hex.EncodeToString(header)}
+}
+
+func headersSubscribe(sess *session, params []json.RawMessage) (interface{}, error) {
+	height, header := sess.srv.index.tip()
+	if len(header) == 0 {
+		return nil, &rpcError{Code: errBadRequest, Message: "the server is still indexing"}
+	}
+	sess.mu.Lock()
+	sess.headers = true
+	sess.lastHeader = header
+	sess.mu.Unlock()
+	return headerResult(height, header), nil
+}
+
+func blockHeader(sess *session, params []json.RawMessage) (interface{}, error) {
+	height, err := intParam(params, 0, "height", 0, true)
+	if err != nil {
+		return nil, err
+	}
+	if err := cpHeight(params, 1); err != nil {
+		return nil, err
+	}
+	if tip, _ := sess.srv.index.tip(); height > int64(tip) {
+		return nil, &rpcError{Code: errBadRequest, Message: "height " + strconv.FormatInt(height, 10) + " out of range"}
+	}
+	header, err := getHeaders(int32(height), 1)
+	if err != nil {
+		return nil, err
+	}
+	return hex.EncodeToString(header), nil
+}
+
+func blockHeaders(sess *session, params []json.RawMessage) (interface{}, error) {
+	start, err := intParam(params, 0, "start_height", 0, true)
+	if err != nil {
+		return nil, err
+	}
+	count, err := intParam(params, 1, "count", 0, true)
+	if err != nil {
+		return nil, err
+	}
+	if err := cpHeight(params, 2); err != nil {
+		return nil, err
+	}
+
+	tip, _ := sess.srv.index.tip()
+	if count > maxHeaders {
+		count = maxHeaders
+	}
+	if available := int64(tip) - start + 1; count > available {
+		count = available
+	}
+	if count < 0 {
+		count = 0
+	}
+	var headers []byte
+	if count > 0 {
+		if headers, err = getHeaders(int32(start), int32(count)); err != nil {
+			return nil, err
+		}
+	}
+	return map[string]interface{}{
+		"count": count,
+		"hex":   hex.EncodeToString(headers),
+		"max":   maxHeaders,
+	}, nil
+}
+
+// estimateFee passes through Core's estimate in DOGE/kB, -1 when Core
+// has no estimate.
+func estimateFee(sess *session, params []json.RawMessage) (interface{}, error) {
+	blocks, err := intParam(params, 0, "number", 0, true)
+	if err != nil {
+		return nil, err
+	}
+	return coreCall("estimatefee", blocks)
+}
+
+func relayFee(sess *session, params []json.RawMessage) (interface{}, error) {
+	result, err := coreCall("getnetworkinfo")
+	if err != nil {
+		return nil, err
+	}
+	var info struct {
+		RelayFee json.RawMessage `json:"relayfee"`
+	}
+	if err := json.Unmarshal(result, &info); err != nil {
+		return nil, err
+	}
+	return info.RelayFee, nil
+}
+
+// blockchain.scripthash.*
+
+func scripthashBalance(sess *session, params []json.RawMessage) (interface{}, error) {
+	sh, err := hashParam(params, 0, "scripthash")
+	if err != nil {
+		return nil, err
+	}
+	confirmed, unconfirmed := sess.srv.index.balance(sh)
+	return map[string]int64{"confirmed": confirmed, "unconfirmed": unconfirmed}, nil
+}
+
+func scripthashHistory(sess *session, params []json.RawMessage) (interface{}, error) {
+	sh, err := hashParam(params, 0, "scripthash")
+	if err != nil {
+		return nil, err
+	}
+	return sess.srv.index.history(sh), nil
+}
+
+func scripthashMempool(sess *session, params []json.RawMessage) (interface{}, error) {
+	sh, err := hashParam(params, 0, "scripthash")
+	if err != nil {
+		return nil, err
+	}
+	return sess.srv.index.mempoolHistory(sh), nil
+}
+
+func scripthashUnspent(sess *session, params []json.RawMessage) (interface{}, error) {
+	sh, err := hashParam(params, 0, "scripthash")
+	if err != nil {
+		return nil, err
+	}
+	return sess.srv.index.listUnspent(sh), nil
+}
+
+func scripthashSubscribe(sess *session, params []json.RawMessage) (interface{}, error) {
+	sh, err := hashParam(params, 0, "scripthash")
+	if err != nil {
+		return nil, err
+	}
+	status := sess.srv.index.status(sh)
+
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	if _, ok := sess.scripthashes[sh]; !ok && len(sess.scripthashes) >= maxSubscriptions {
+		return nil, &rpcError{Code: errBadRequest, Message: "too many subscriptions"}
+	}
+	sess.scripthashes[sh] = status
+	return status, nil
+}
+
+func scripthashUnsubscribe(sess *session, params []json.RawMessage) (interface{}, error) {
+	sh, err := hashParam(params, 0, "scripthash")
+	if err != nil {
+		return nil, err
+	}
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	_, ok := sess.scripthashes[sh]
+	delete(sess.scripthashes, sh)
+	return ok, nil
+}
+
+// blockchain.transaction.*
+
+func transactionBroadcast(sess *session, params []json.RawMessage) (interface{}, error) {
+	raw, err := stringParam(params, 0, "raw_tx")
+	if err != nil {
+		return nil, err
+	}
+	result, err := coreCall("sendrawtransaction", raw)
+	if err != nil {
+		var coreErr *coreError
+		if errors.As(err, &coreErr) {
+			return nil, &rpcError{Code: errBadRequest, Message: coreErr.Message}
+		}
+		return nil, err
+	}
+	sess.srv.index.refreshSoon()
+	return result, nil
+}
+
+// transactionGet asks Core first, which finds mempool transactions (and
+// any transaction when Core runs with -txindex), then falls back to
+// reading the transaction out of its block using the index.
+func transactionGet(sess *session, params []json.RawMessage) (interface{}, error) {
+	txid, err := hashParam(params, 0, "tx_hash")
+	if err != nil {
+		return nil, err
+	}
+	verbose, err := boolParam(params, 1, "verbose")
+	if err != nil {
+		return nil, err
+	}
+
+	if verbose {
+		if result, err := coreCall("getrawtransaction", txid.String(), true); err == nil {
+			return result, nil
+		}
+	} else if raw, err := getRawTransaction(txid); err == nil {
+		return hex.EncodeToString(raw), nil
+	}
+
+	height, ok := sess.srv.index.txHeight(txid)
+	if !ok {
+		return nil, &rpcError{Code: errBadRequest, Message: "no such mempool or blockchain transaction: " + txid.String()}
+	}
+	hash, err := getBlockHash(height)
+	if err != nil {
+		return nil, err
+	}
+	rawBlock, err := getRawBlock(hash)
+	if err != nil {
+		return nil, err
+	}
+	b, err := parseBlock(rawBlock)
+	if err != nil {
+		return nil, err
+	}
+	for _, tx := range b.txs {
+		if tx.txid != txid {
+			continue
+		}
+		rawHex := hex.EncodeToString(tx.raw)
+		if !verbose {
+			return rawHex, nil
+		}
+		result, err := coreCall("decoderawtransaction", rawHex)
+		if err != nil {
+			return nil, err
+		}
+		var decoded map[string]interface{}
+		if err := json.Unmarshal(result, &decoded); err != nil {
+			return nil, err
+		}
+		tip, _ := sess.srv.index.tip()
+		decoded["hex"] = rawHex
+		decoded["blockhash"] = hash.String()
+		decoded["confirmations"] = tip - height + 1
+		return decoded, nil
+	}
+	return nil, &rpcError{Code: errBadRequest, Message: "transaction " + txid.String() + " not found in block " + hash.String()}
+}
+
+func transactionMerkle(sess *session, params []json.RawMessage) (interface{}, error) {
+	txid, err := hashParam(params, 0, "tx_hash")
+	if err != nil {
+		return nil, err
+	}
+	height, err := intParam(params, 1, "height", 0, true)
+	if err != nil {
+		return nil, err
+	}
+	txids, err := blockTxids(height)
+	if err != nil {
+		return nil, err
+	}
+	for pos, id := range txids {
+		if id == txid {
+			return map[string]interface{}{
+				"block_height": height,
+				"merkle":       hashStrings(merkleBranch(txids, pos)),
+				"pos":          pos,
+			}, nil
+		}
+	}
+	return nil, &rpcError{Code: errBadRequest, Message: "tx " + txid.String() + " not in block at height " + strconv.FormatInt(height, 10)}
+}
+
+func transactionFromPos(sess *session, params []json.RawMessage) (interface{}, error) {
+	height, err := intParam(params, 0, "height", 0, true)
+	if err != nil {
+		return nil, err
+	}
+	pos, err := intParam(params, 1, "tx_pos", 0, true)
+	if err != nil {
+		return nil, err
+	}
+	merkle, err := boolParam(params, 2, "merkle")
+	if err != nil {
+		return nil, err
+	}
+	txids, err := blockTxids(height)
+	if err != nil {
+		return nil, err
+	}
+	if pos >= int64(len(txids)) {
+		return nil, &rpcError{Code: errBadRequest, Message: "no tx at position " + strconv.FormatInt(pos, 10) + " in block at height " + strconv.FormatInt(height, 10)}
+	}
+	if !merkle {
+		return txids[pos].String(), nil
+	}
+	return map[string]interface{}{
+		"tx_hash": txids[pos].String(),
+		"merkle":  hashStrings(merkleBranch(txids, int(pos))),
+	}, nil
+}
+
+func blockTxids(height int64) ([]hash32, error) {
+	txids, err := getBlockTxids(int32(height))
+	if err != nil {
+		var coreErr *coreError
+		if errors.As(err, &coreErr) {
+			return nil, &rpcError{Code: errBadRequest, Message: "block at height " + strconv.FormatInt(height, 10) + " not found"}
+		}
+		return nil, err
+	}
+	return txids, nil
+}
+
+func hashStrings(hashes []hash32) []string {
+	out := make([]string, len(hashes))
+	for i, h := range hashes {
+		out[i] = h.String()
+	}
+	return out
+}
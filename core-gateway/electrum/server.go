@@ -0,0 +1,378 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// maxLine bounds a single request line; the largest legitimate one
+	// is a transaction broadcast.
+	maxLine = 1 << 20
+
+	idleTimeout  = 10 * time.Minute
+	writeTimeout = 30 * time.Second
+
+	// maxSubscriptions caps the scripthashes one session may follow.
+	maxSubscriptions = 10000
+)
+
+// JSON-RPC error codes, as used by other Electrum servers.
+const (
+	errParse          = -32700
+	errInvalidRequest = -32600
+	errMethodNotFound = -32601
+	errInvalidParams  = -32602
+	errBadRequest     = 1
+	errDaemon         = 2
+)
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *rpcError) Error() string {
+	return e.Message
+}
+
+func invalidParams(message string) error {
+	return &rpcError{Code: errInvalidParams, Message: message}
+}
+
+type request struct {
+	JSONRPC string            `json:"jsonrpc"`
+	ID      json.RawMessage   `json:"id"`
+	Method  string            `json:"method"`
+	Params  []json.RawMessage `json:"params"`
+}
+
+type response struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  interface{}     `json:"result,omitempty"`
+	Error   *rpcError       `json:"error,omitempty"`
+}
+
+type notification struct {
+	JSONRPC string        `json:"jsonrpc"`
+	Method  string        `json:"method"`
+	Params  []interface{} `json:"params"`
+}
+
+// server accepts Electrum sessions over plain TCP and TLS and pushes
+// subscription notifications to them as the index changes.
+type server struct {
+	index *chainIndex
+	slots chan struct{}
+
+	mu        sync.Mutex
+	sessions  map[*session]struct{}
+	listeners []net.Listener
+	conns     sync.WaitGroup
+	closing   atomic.Bool
+
+	requests atomic.Int64
+}
+
+type session struct {
+	srv  *server
+	conn net.Conn
+
+	wmu sync.Mutex
+
+	mu           sync.Mutex
+	scripthashes map[hash32]*string
+	headers      bool
+	lastHeader   []byte
+}
+
+func newServer(index *chainIndex, maxSessions int) *server {
+	s := &server{
+		index:    index,
+		sessions: map[*session]struct{}{},
+	}
+	if maxSessions > 0 {
+		s.slots = make(chan struct{}, maxSessions)
+	}
+	index.onChange = s.notify
+	return s
+}
+
+// listen starts accepting sessions on addr, over TLS when config is
+// set.
+func (s *server) listen(addr string, config *tls.Config) error {
+	var listener net.Listener
+	var err error
+	if config != nil {
+		listener, err = tls.Listen("tcp", addr, config)
+	} else {
+		listener, err = net.Listen("tcp", addr)
+	}
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.listeners = append(s.listeners, listener)
+	s.mu.Unlock()
+
+	go s.accept(listener)
+	return nil
+}
+
+func (s *server) accept(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if s.closing.Load() {
+				return
+			}
+			log.Printf("Failed to accept Electrum connection: %v", err)
+			continue
+		}
+		if s.slots != nil {
+			select {
+			case s.slots <- struct{}{}:
+			default:
+				log.Printf("Electrum connection from %s rejected: too many sessions", conn.RemoteAddr())
+				conn.Close()
+				continue
+			}
+		}
+		s.conns.Add(1)
+		go func() {
+			defer s.conns.Done()
+			if s.slots != nil {
+				defer func() { <-s.slots }()
+			}
+			s.serve(conn)
+		}()
+	}
+}
+
+// close stops the listeners and disconnects every session, waiting up
+// to timeout for them to finish.
+func (s *server) close(timeout time.Duration) {
+	s.closing.Store(true)
+	s.mu.Lock()
+	for _, listener := range s.listeners {
+		listener.Close()
+	}
+	for sess := range s.sessions {
+		sess.conn.Close()
+	}
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.conns.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		log.Printf("Electrum sessions did not close before the deadline")
+	}
+}
+
+func (s *server) sessionCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.sessions)
+}
+
+func (s *server) serve(conn net.Conn) {
+	defer conn.Close()
+	sess := &session{srv: s, conn: conn, scripthashes: map[hash32]*string{}}
+
+	s.mu.Lock()
+	if s.closing.Load() {
+		s.mu.Unlock()
+		return
+	}
+	s.sessions[sess] = struct{}{}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.sessions, sess)
+		s.mu.Unlock()
+	}()
+
+	log.Printf("Electrum session from %s", conn.RemoteAddr())
+	r := bufio.NewReaderSize(conn, 64<<10)
+	for {
+		conn.SetReadDeadline(time.Now().Add(idleTimeout))
+		line, err := readLine(r)
+		if err != nil {
+			log.Printf("Electrum session from %s closed: %v", conn.RemoteAddr(), err)
+			return
+		}
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		if reply := sess.handle(line); reply != nil {
+			if err := sess.send(reply); err != nil {
+				log.Printf("Electrum session from %s closed: %v", conn.RemoteAddr(), err)
+				return
+			}
+		}
+	}
+}
+
+// readLine reads one newline terminated message, refusing any longer
+// than maxLine.
+func readLine(r *bufio.Reader) ([]byte, error) {
+	var line []byte
+	for {
+		chunk, err := r.ReadSlice('\n')
+		line = append(line, chunk...)
+		if len(line) > maxLine {
+			return nil, errors.New("request too large")
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		return line, err
+	}
+}
+
+func (sess *session) send(v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	sess.wmu.Lock()
+	defer sess.wmu.Unlock()
+	sess.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	_, err = sess.conn.Write(append(data, '\n'))
+	return err
+}
+
+// handle answers a request line, a single call or a batch. Notifications
+// sent by the client (calls without an id) get no reply.
+func (sess *session) handle(line []byte) interface{} {
+	if line[0] == '[' {
+		var batch []json.RawMessage
+		if err := json.Unmarshal(line, &batch); err != nil || len(batch) == 0 {
+			return errorResponse(nil, errParse, "Parse error")
+		}
+		var replies []interface{}
+		for _, entry := range batch {
+			if reply := sess.call(entry); reply != nil {
+				replies = append(replies, reply)
+			}
+		}
+		if len(replies) == 0 {
+			return nil
+		}
+		return replies
+	}
+	if reply := sess.call(line); reply != nil {
+		return reply
+	}
+	return nil
+}
+
+func (sess *session) call(body []byte) *response {
+	var req request
+	if err := json.Unmarshal(body, &req); err != nil {
+		return errorResponse(nil, errInvalidRequest, "Invalid Request")
+	}
+	sess.srv.requests.Add(1)
+
+	handler, ok := methods[req.Method]
+	var result interface{}
+	var err error
+	if !ok {
+		err = &rpcError{Code: errMethodNotFound, Message: "unknown method \"" + req.Method + "\""}
+	} else {
+		result, err = handler(sess, req.Params)
+	}
+	if len(req.ID) == 0 {
+		return nil
+	}
+	if err != nil {
+		var rpcErr *rpcError
+		if !errors.As(err, &rpcErr) {
+			log.Printf("Electrum %s failed: %v", req.Method, err)
+			rpcErr = &rpcError{Code: errDaemon, Message: "daemon error: " + err.Error()}
+		}
+		return &response{JSONRPC: "2.0", ID: req.ID, Error: rpcErr}
+	}
+	if result == nil {
+		result = json.RawMessage("null")
+	}
+	return &response{JSONRPC: "2.0", ID: req.ID, Result: result}
+}
+
+func errorResponse(id json.RawMessage, code int, message string) *response {
+	if len(id) == 0 {
+		id = json.RawMessage("null")
+	}
+	return &response{JSONRPC: "2.0", ID: id, Error: &rpcError{Code: code, Message: message}}
+}
+
+// notify is the index's onChange hook: sessions hear about new status
+// hashes for their scripthashes and about the new tip.
+func (s *server) notify(touched map[hash32]bool, newTip bool) {
+	s.mu.Lock()
+	sessions := make([]*session, 0, len(s.sessions))
+	for sess := range s.sessions {
+		sessions = append(sessions, sess)
+	}
+	s.mu.Unlock()
+
+	height, header := s.index.tip()
+	for _, sess := range sessions {
+		var messages []notification
+
+		sess.mu.Lock()
+		if newTip && sess.headers && len(header) > 0 && !bytes.Equal(header, sess.lastHeader) {
+			sess.lastHeader = header
+			messages = append(messages, notification{
+				JSONRPC: "2.0",
+				Method:  "blockchain.headers.subscribe",
+				Params:  []interface{}{headerResult(height, header)},
+			})
+		}
+		for sh, last := range sess.scripthashes {
+			if touched != nil && !touched[sh] {
+				continue
+			}
+			status := s.index.status(sh)
+			if sameStatus(status, last) {
+				continue
+			}
+			sess.scripthashes[sh] = status
+			messages = append(messages, notification{
+				JSONRPC: "2.0",
+				Method:  "blockchain.scripthash.subscribe",
+				Params:  []interface{}{sh.String(), status},
+			})
+		}
+		sess.mu.Unlock()
+
+		for _, msg := range messages {
+			if err := sess.send(msg); err != nil {
+				sess.conn.Close()
+				break
+			}
+		}
+	}
+}
+
+func sameStatus(a, b *string) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
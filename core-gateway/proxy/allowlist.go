@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+)
+
+var rejectedClients = newCounter("gateway_rejected_clients_total",
+	"Connections refused because the client address is not in the allowlist, by listener.", "listener")
+
+// cidrAllowlist limits which client addresses may connect to the RPC,
+// ZMQ and metrics listeners. A nil allowlist lets everyone in.
+type cidrAllowlist struct {
+	nets []*net.IPNet
+}
+
+// newCIDRAllowlist parses a comma or whitespace separated list of CIDRs
+// or bare addresses, IPv4 or IPv6. An empty list returns nil. Loopback
+// and the pup's own network are always added, so other pups and local
+// health checks keep working.
+func newCIDRAllowlist(list string) (*cidrAllowlist, error) {
+	entries := strings.FieldsFunc(list, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\n' || r == '\t'
+	})
+	if len(entries) == 0 {
+		return nil, nil
+	}
+
+	a := &cidrAllowlist{}
+	for _, entry := range entries {
+		n, err := parseCIDR(entry)
+		if err != nil {
+			return nil, err
+		}
+		a.nets = append(a.nets, n)
+	}
+	for _, loopback := range []string{"127.0.0.0/8", "::1/128"} {
+		_, n, _ := net.ParseCIDR(loopback)
+		a.nets = append(a.nets, n)
+	}
+	if n := pupNetwork(); n != nil {
+		a.nets = append(a.nets, n)
+	}
+	return a, nil
+}
+
+func parseCIDR(entry string) (*net.IPNet, error) {
+	if strings.Contains(entry, "/") {
+		_, n, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q", entry)
+		}
+		return n, nil
+	}
+	ip := net.ParseIP(entry)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid address %q", entry)
+	}
+	bits := 128
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, bits = ip4, 32
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+}
+
+// pupNetwork finds the network DBX_PUP_IP belongs to from the local
+// interface configuration, falling back to the pup's address alone.
+func pupNetwork() *net.IPNet {
+	ip := net.ParseIP(pupIP)
+	if ip == nil {
+		return nil
+	}
+	if addrs, err := net.InterfaceAddrs(); err == nil {
+		for _, addr := range addrs {
+			if n, ok := addr.(*net.IPNet); ok && n.IP.Equal(ip) {
+				return &net.IPNet{IP: n.IP.Mask(n.Mask), Mask: n.Mask}
+			}
+		}
+	}
+	n, _ := parseCIDR(pupIP)
+	return n
+}
+
+// allows reports whether remoteAddr, a host:port or bare address, is in
+// the allowlist.
+func (a *cidrAllowlist) allows(remoteAddr string) bool {
+	if a == nil {
+		return true
+	}
+	ip := net.ParseIP(clientIP(remoteAddr))
+	if ip == nil {
+		return false
+	}
+	for _, n := range a.nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *cidrAllowlist) String() string {
+	if a == nil {
+		return "(all clients)"
+	}
+	names := make([]string, len(a.nets))
+	for i, n := range a.nets {
+		names[i] = n.String()
+	}
+	return strings.Join(names, ",")
+}
+
+// allowlistHandler refuses HTTP requests from clients outside the
+// allowlist before they reach any of the endpoints of listener, "rpc" or
+// "metrics".
+func allowlistHandler(listener string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !config().allowlist.allows(r.RemoteAddr) {
+			log.Printf("%s request from %s rejected: address not in allowlist", strings.ToUpper(listener), r.RemoteAddr)
+			rejectedClients.inc(listener)
+			if listener != "rpc" {
+				http.Error(w, "Client address is not permitted by the gateway", http.StatusForbidden)
+				return
+			}
+			writeRPCError(w, http.StatusForbidden, nil, rpcErrForbidden, "Client address is not permitted by the gateway")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	auditFileName   = "audit.jsonl"
+	auditQueryLimit = 1000
+)
+
+type auditRecord struct {
+	Time          time.Time `json:"ts"`
+	User          string    `json:"user"`
+	ClientIP      string    `json:"client_ip"`
+	Method        string    `json:"method"`
+	ParamsDigest  string    `json:"params_sha256"`
+	Outcome       string    `json:"outcome"`
+	Status        int       `json:"status"`
+	LatencyMs     float64   `json:"latency_ms"`
+	ResponseBytes int       `json:"response_bytes"`
+}
+
+// auditLog appends one JSON line per RPC call to /storage/audit. The
+// active file is rotated once it reaches maxSize, and rotated files are
+// deleted after the retention period.
+type auditLog struct {
+	mu        sync.Mutex
+	dir       string
+	maxSize   int64
+	retention time.Duration
+	file      *os.File
+	size      int64
+}
+
+var audit *auditLog
+
+func openAuditLog(dir string, maxSize int64, retention time.Duration) (*auditLog, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	a := &auditLog{dir: dir, maxSize: maxSize, retention: retention}
+	if err := a.open(); err != nil {
+		return nil, err
+	}
+	a.prune()
+	return a, nil
+}
+
+func (a *auditLog) open() error {
+	f, err := os.OpenFile(filepath.Join(a.dir, auditFileName), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	a.file = f
+	a.size = info.Size()
+	return nil
+}
+
+// record writes an entry for one call. started is when the gateway
+// began handling it.
+func (a *auditLog) record(r *http.Request, caller principal, call rpcRequest, outcome string, status int, started time.Time, size int) {
+	if a == nil {
+		return
+	}
+	rec := auditRecord{
+		Time:          started.UTC(),
+		User:          caller.name,
+		ClientIP:      clientIP(r.RemoteAddr),
+		Method:        call.Method,
+		ParamsDigest:  paramsDigest(call.Params),
+		Outcome:       outcome,
+		Status:        status,
+		LatencyMs:     float64(time.Since(started).Microseconds()) / 1000,
+		ResponseBytes: size,
+	}
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return
+	}
+	line = append(line, '\n')
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.file == nil {
+		return
+	}
+	if a.maxSize > 0 && a.size+int64(len(line)) > a.maxSize {
+		if err := a.rotate(); err != nil {
+			log.Printf("Audit: rotation failed: %v", err)
+		}
+	}
+	n, err := a.file.Write(line)
+	a.size += int64(n)
+	if err != nil {
+		log.Printf("Audit: write failed: %v", err)
+	}
+}
+
+// close closes the active file; calls recorded afterwards are dropped.
+func (a *auditLog) close() {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.file != nil {
+		a.file.Close()
+		a.file = nil
+	}
+}
+
+// rotate moves the active file aside under a timestamped name; callers
+// must hold a.mu.
+func (a *auditLog) rotate() error {
+	a.file.Close()
+	rotated := filepath.Join(a.dir, "audit-"+time.Now().UTC().Format("20060102T150405.000")+".jsonl")
+	if err := os.Rename(filepath.Join(a.dir, auditFileName), rotated); err != nil {
+		log.Printf("Audit: failed to rotate: %v", err)
+	}
+	if err := a.open(); err != nil {
+		return err
+	}
+	go a.prune()
+	return nil
+}
+
+// prune deletes rotated files older than the retention period.
+func (a *auditLog) prune() {
+	if a.retention <= 0 {
+		return
+	}
+	for _, path := range a.rotatedFiles() {
+		info, err := os.Stat(path)
+		if err == nil && time.Since(info.ModTime()) > a.retention {
+			log.Printf("Audit: removing expired %s", filepath.Base(path))
+			os.Remove(path)
+		}
+	}
+}
+
+// rotatedFiles lists rotated files oldest first; their timestamped
+// names sort chronologically.
+func (a *auditLog) rotatedFiles() []string {
+	files, _ := filepath.Glob(filepath.Join(a.dir, "audit-*.jsonl"))
+	sort.Strings(files)
+	return files
+}
+
+func paramsDigest(params json.RawMessage) string {
+	var buf bytes.Buffer
+	if len(params) == 0 || json.Compact(&buf, params) != nil {
+		buf.Reset()
+		buf.WriteString("[]")
+	}
+	sum := sha256.Sum256(buf.Bytes())
+	return hex.EncodeToString(sum[:])
+}
+
+// auditAdminHandler returns matching audit records, oldest first:
+//
+//	GET /admin/audit?user=&method=&since=&until=&limit=
+//
+// since and until are RFC 3339 timestamps; limit keeps the most recent
+// matches.
+func auditAdminHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	if audit == nil {
+		writeJSONError(w, http.StatusNotFound, "audit log is disabled")
+		return
+	}
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	q := r.URL.Query()
+	user, method := q.Get("user"), strings.ToLower(q.Get("method"))
+	var since, until time.Time
+	var err error
+	if v := q.Get("since"); v != "" {
+		if since, err = time.Parse(time.RFC3339, v); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid since: "+err.Error())
+			return
+		}
+	}
+	if v := q.Get("until"); v != "" {
+		if until, err = time.Parse(time.RFC3339, v); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid until: "+err.Error())
+			return
+		}
+	}
+	limit := auditQueryLimit
+	if v := q.Get("limit"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 && n < limit {
+			limit = n
+		}
+	}
+
+	match := func(rec auditRecord) bool {
+		return (user == "" || rec.User == user) &&
+			(method == "" || strings.ToLower(rec.Method) == method) &&
+			(since.IsZero() || !rec.Time.Before(since)) &&
+			(until.IsZero() || rec.Time.Before(until))
+	}
+
+	audit.mu.Lock()
+	files := append(audit.rotatedFiles(), filepath.Join(audit.dir, auditFileName))
+	audit.mu.Unlock()
+
+	results := []auditRecord{}
+	for _, path := range files {
+		f, err := os.Open(path)
+		if err != nil {
+			continue
+		}
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			var rec auditRecord
+			if json.Unmarshal(scanner.Bytes(), &rec) != nil || !match(rec) {
+				continue
+			}
+			results = append(results, rec)
+			if len(results) > limit {
+				results = results[1:]
+			}
+		}
+		f.Close()
+	}
+
+	writeJSON(w, http.StatusOK, results)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// principal is the identity a request was authenticated as.
+type principal struct {
+	name string
+	role string
+	// scopes is only set for API tokens; password logins may use every
+	// interface.
+	scopes map[string]bool
+}
+
+// allows reports whether p may use the interface guarded by scope.
+func (p principal) allows(scope string) bool {
+	return p.scopes == nil || p.scopes[scope]
+}
+
+// anonymous is used when no credentials are configured at all, which
+// keeps the original open behaviour of the gateway.
+var anonymous = principal{name: "", role: roleAdmin}
+
+// authEnabled reports whether clients must present credentials, either
+// the configured RPC_USERNAME/RPC_PASSWORD pair, a user from the users
+// file or an API token.
+func authEnabled() bool {
+	cfg := config()
+	return (cfg.rpcUsername != "" && cfg.rpcPassword != "") || users.count() > 0 || tokens.count() > 0
+}
+
+// requireAuth authenticates r, writing a 401 and returning false when
+// the credentials are missing or wrong. Clients and usernames with too
+// many recent failures are refused without checking the password.
+func requireAuth(w http.ResponseWriter, r *http.Request) (principal, bool) {
+	if !authEnabled() {
+		return anonymous, true
+	}
+	ip := clientIP(r.RemoteAddr)
+	name, _, _ := r.BasicAuth()
+	if wait, locked := ipLockout.locked(ip); locked {
+		writeLockedOut(w, wait)
+		return principal{}, false
+	}
+	if wait, locked := userLockout.locked(name); locked {
+		writeLockedOut(w, wait)
+		return principal{}, false
+	}
+
+	p, ok := validateAuth(r.Header.Get("Authorization"))
+	if !ok {
+		authFailures.inc()
+		ipLockout.fail(ip)
+		userLockout.fail(name)
+		log.Printf("Authentication failed for %q from %s", name, r.RemoteAddr)
+		w.Header().Set("WWW-Authenticate", `Basic realm="Dogecoin RPC"`)
+		w.Header().Add("WWW-Authenticate", `Bearer realm="Dogecoin RPC"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return principal{}, false
+	}
+	ipLockout.succeed(ip)
+	userLockout.succeed(name)
+	return p, true
+}
+
+// validateAuth checks an Authorization header: Basic credentials against
+// the configured admin pair and then the users file, or a Bearer API
+// token.
+func validateAuth(auth string) (principal, bool) {
+	if strings.HasPrefix(auth, "Bearer ") {
+		return tokens.authenticate(strings.TrimSpace(auth[7:]))
+	}
+	if !strings.HasPrefix(auth, "Basic ") {
+		return principal{}, false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(auth[6:])
+	if err != nil {
+		return principal{}, false
+	}
+	parts := strings.SplitN(string(decoded), ":", 2)
+	if len(parts) != 2 {
+		return principal{}, false
+	}
+	return validatePassword(parts[0], parts[1])
+}
+
+// validatePassword checks a username and password against the
+// configured admin pair and then the users file.
+func validatePassword(name, password string) (principal, bool) {
+	if cfg := config(); cfg.rpcUsername != "" && cfg.rpcPassword != "" {
+		// Check both parts so the timing does not reveal which was wrong
+		userOK := secretEqual(name, cfg.rpcUsername)
+		passOK := secretEqual(password, cfg.rpcPassword)
+		if userOK && passOK {
+			return principal{name: cfg.rpcUsername, role: roleAdmin}, true
+		}
+	}
+	if u, ok := users.authenticate(name, password); ok {
+		return principal{name: u.Name, role: u.Role}, true
+	}
+	return principal{}, false
+}
+
+// secretEqual compares two secrets in constant time. Hashing first keeps
+// the comparison from revealing the expected length.
+func secretEqual(got, want string) bool {
+	g := sha256.Sum256([]byte(got))
+	w := sha256.Sum256([]byte(want))
+	return subtle.ConstantTimeCompare(g[:], w[:]) == 1
+}
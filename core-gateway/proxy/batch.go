@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// maxBatchEntries is the most calls one batch may carry.
+const maxBatchEntries = 1000
+
+// handleBatch splits a JSON-RPC batch into its entries, checks each one
+// against the method policy, the caller's role and the method's params
+// schema, answers what it can
+// from the cache, forwards the remaining entries to Core as a single
+// batch and stitches the replies back together in request order.
+// Entries that are malformed or rejected get a per-entry error instead
+// of failing the whole batch.
+func handleBatch(w http.ResponseWriter, r *http.Request, caller principal, body []byte, started time.Time) {
+	var entries []json.RawMessage
+	if err := json.Unmarshal(body, &entries); err != nil {
+		writeParseError(w, errParse)
+		return
+	}
+	if len(entries) == 0 {
+		writeRPCError(w, http.StatusBadRequest, nil, rpcErrInvalidRequest, "Empty batch")
+		return
+	}
+	if len(entries) > maxBatchEntries {
+		writeRPCError(w, http.StatusBadRequest, nil, rpcErrInvalidRequest,
+			fmt.Sprintf("Batch exceeds the gateway's limit of %d calls", maxBatchEntries))
+		return
+	}
+
+	// Every entry costs a token, anonymous or not; the request itself
+	// already paid for the first
+	if !ipLimiter.allow(clientIP(r.RemoteAddr), len(entries)-1) {
+		log.Printf("RPC batch from %s throttled: rate limit", r.RemoteAddr)
+		writeThrottled(w, "Rate limit exceeded")
+		return
+	}
+	if !allowUser(caller, len(entries)) {
+		log.Printf("RPC batch from user %q throttled: rate limit", caller.name)
+		writeThrottled(w, "Rate limit exceeded")
+		return
+	}
+
+	replies := make([]json.RawMessage, len(entries))
+	var forward []json.RawMessage
+	var forwardIdx []int
+	var forwardCalls []rpcRequest
+
+	for i, entry := range entries {
+		call, err := parseRPCRequest(entry)
+		if err != nil {
+			replies[i] = errorReply(nil, rpcErrInvalidRequest, "Invalid Request")
+			continue
+		}
+		log.Printf("RPC batch entry %d: %s from %s", i, call.Method, r.RemoteAddr)
+		if !permitted(caller, call.Method) {
+			log.Printf("RPC method %q rejected for %s (%s)", call.Method, r.RemoteAddr, caller.role)
+			replies[i] = errorReply(call.ID, rpcErrForbidden,
+				"Method '"+call.Method+"' is not permitted by the gateway")
+			observeCall(r, caller, call, "denied", http.StatusForbidden, started, len(replies[i]))
+			continue
+		}
+		if reason := checkParams(caller.role, call); reason != "" {
+			log.Printf("RPC call %q from %s has invalid params: %s", call.Method, r.RemoteAddr, reason)
+			replies[i] = errorReply(call.ID, rpcErrInvalidParams, "Invalid params: "+reason)
+			observeCall(r, caller, call, "invalid_params", http.StatusBadRequest, started, len(replies[i]))
+			continue
+		}
+		if reply, ok := cache.lookup(call); ok {
+			replies[i] = reply
+			observeCall(r, caller, call, "cached", http.StatusOK, started, len(reply))
+			continue
+		}
+		forward = append(forward, entry)
+		forwardIdx = append(forwardIdx, i)
+		forwardCalls = append(forwardCalls, call)
+	}
+
+	if len(forward) > 0 {
+		// The batch gets as long as its slowest entry would on its own
+		var timeout time.Duration
+		for _, call := range forwardCalls {
+			if t := callTimeout(call.Method, call.Params); t > timeout {
+				timeout = t
+			}
+		}
+		upstreamReplies, status, err := forwardBatch(r, forward, timeout)
+		if err != nil {
+			log.Printf("Upstream batch request failed: %v", err)
+		}
+		for n, i := range forwardIdx {
+			if err != nil {
+				code, _, message := upstreamErrorCode(err)
+				replies[i] = errorReply(forwardCalls[n].ID, code, message)
+				observeCall(r, caller, forwardCalls[n], upstreamOutcome(err), status, started, len(replies[i]))
+				continue
+			}
+			replies[i] = upstreamReplies[n]
+			cache.store(forwardCalls[n], upstreamReplies[n])
+			observeCall(r, caller, forwardCalls[n], "forwarded", status, started, len(replies[i]))
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(replies)
+}
+
+// forwardBatch sends the permitted entries to Core and returns one reply
+// per entry, in the same order, along with Core's HTTP status.
+func forwardBatch(r *http.Request, entries []json.RawMessage, timeout time.Duration) ([]json.RawMessage, int, error) {
+	body, err := json.Marshal(entries)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	resp, err := forwardRPC(r, body, timeout)
+	if err != nil {
+		_, status, _ := upstreamErrorCode(err)
+		return nil, status, err
+	}
+
+	var replies []json.RawMessage
+	if err := json.Unmarshal(resp.body, &replies); err != nil {
+		return nil, resp.status, fmt.Errorf("unexpected batch response (status %d): %v", resp.status, err)
+	}
+	if len(replies) != len(entries) {
+		return nil, resp.status, fmt.Errorf("batch response has %d entries, expected %d", len(replies), len(entries))
+	}
+	return replies, resp.status, nil
+}
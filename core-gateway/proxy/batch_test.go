@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// useConfig applies the pup config in env for the rest of the test.
+func useConfig(t *testing.T, env map[string]string) {
+	t.Helper()
+	for name, value := range env {
+		t.Setenv(name, value)
+	}
+	c, err := buildConfig(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	applyConfig(c)
+	t.Cleanup(func() {
+		c, _ := buildConfig(nil)
+		applyConfig(c)
+	})
+}
+
+// postRPC sends body to the RPC handler from ip without credentials.
+func postRPC(ip, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+	r.RemoteAddr = ip + ":40000"
+	w := httptest.NewRecorder()
+	rpcProxyHandler(w, r)
+	return w
+}
+
+// deniedBatch is a batch of n calls the policy rejects, so the handler
+// answers it without reaching Core.
+func deniedBatch(n int) string {
+	calls := make([]string, n)
+	for i := range calls {
+		calls[i] = fmt.Sprintf(`{"id":%d,"method":"stop","params":[]}`, i)
+	}
+	return "[" + strings.Join(calls, ",") + "]"
+}
+
+func TestAnonymousBatchCostsOneIPTokenPerCall(t *testing.T) {
+	// Practically no refill, so the bucket only changes by what is taken
+	useConfig(t, map[string]string{
+		"RATE_LIMIT_IP_RPS":   "0.0001",
+		"RATE_LIMIT_IP_BURST": "10",
+		"RPC_DENIED_METHODS":  "stop",
+	})
+
+	w := postRPC("192.0.2.10", deniedBatch(4))
+	if w.Code != http.StatusOK {
+		t.Fatalf("batch of 4: status %d, want 200: %s", w.Code, w.Body)
+	}
+	var replies []json.RawMessage
+	if err := json.Unmarshal(w.Body.Bytes(), &replies); err != nil || len(replies) != 4 {
+		t.Fatalf("batch of 4: got %s, want 4 replies", w.Body)
+	}
+
+	// 10 - 4 leaves 6, which a batch of 7 exceeds. The refused batch
+	// still pays for the request it came in, leaving 5.
+	if w := postRPC("192.0.2.10", deniedBatch(7)); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("batch of 7 with 6 tokens left: status %d, want 429", w.Code)
+	}
+	if w := postRPC("192.0.2.10", deniedBatch(5)); w.Code != http.StatusOK {
+		t.Fatalf("batch of 5 with 5 tokens left: status %d, want 200", w.Code)
+	}
+	if w := postRPC("192.0.2.10", `{"id":1,"method":"stop","params":[]}`); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("single call with no tokens left: status %d, want 429", w.Code)
+	}
+
+	// Other clients have buckets of their own
+	if w := postRPC("192.0.2.11", deniedBatch(10)); w.Code != http.StatusOK {
+		t.Fatalf("batch of 10 from a new client: status %d, want 200", w.Code)
+	}
+}
+
+func TestBatchSizeLimit(t *testing.T) {
+	useConfig(t, map[string]string{"RPC_DENIED_METHODS": "stop"})
+
+	if w := postRPC("192.0.2.20", deniedBatch(maxBatchEntries)); w.Code != http.StatusOK {
+		t.Fatalf("batch of %d: status %d, want 200", maxBatchEntries, w.Code)
+	}
+	w := postRPC("192.0.2.20", deniedBatch(maxBatchEntries+1))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("batch of %d: status %d, want 400", maxBatchEntries+1, w.Code)
+	}
+	var reply rpcResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &reply); err != nil || reply.Error == nil || reply.Error.Code != rpcErrInvalidRequest {
+		t.Fatalf("batch of %d: got %s, want error %d", maxBatchEntries+1, w.Body, rpcErrInvalidRequest)
+	}
+}
@@ -0,0 +1,473 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// cacheableMethods are the calls whose results never change once the
+// block they describe is buried deep enough.
+var cacheableMethods = map[string]bool{
+	"getblock":          true,
+	"getblockhash":      true,
+	"getblockheader":    true,
+	"getrawtransaction": true,
+}
+
+type cacheEntry struct {
+	key    string
+	height int64
+	result json.RawMessage
+}
+
+// diskEntry is a result kept in a file of the disk cache.
+type diskEntry struct {
+	fileKey string
+	height  int64
+}
+
+// responseCache is an LRU of immutable RPC results, optionally backed by
+// files in /storage. Entries are only stored once their block is at
+// least minConf deep, and anything that falls back inside that window
+// (after a reorg) is evicted when a new block arrives. Files are read,
+// written and deleted without holding mu.
+type responseCache struct {
+	mu      sync.Mutex
+	max     int
+	minConf int64
+	tip     int64
+	lru     *list.List
+	entries map[string]*list.Element
+
+	diskDir string
+	diskMax int
+	// diskIndex finds an entry's element in diskOrder, which runs from
+	// the oldest file written to the newest.
+	diskIndex map[string]*list.Element
+	diskOrder *list.List
+}
+
+var cache *responseCache
+
+func newResponseCache(max int, minConf int64, diskDir string, diskMax int) *responseCache {
+	if max <= 0 {
+		return nil
+	}
+	if minConf < 1 {
+		minConf = 1
+	}
+	c := &responseCache{
+		max:     max,
+		minConf: minConf,
+		lru:     list.New(),
+		entries: map[string]*list.Element{},
+		diskDir: diskDir,
+		diskMax: diskMax,
+	}
+	if diskDir != "" {
+		c.loadDiskIndex()
+	}
+	return c
+}
+
+// cacheKey identifies a call by method and canonical params.
+func cacheKey(call rpcRequest) (string, bool) {
+	method := strings.ToLower(call.Method)
+	if !cacheableMethods[method] {
+		return "", false
+	}
+	params := []byte("[]")
+	if len(call.Params) > 0 {
+		var buf bytes.Buffer
+		if err := json.Compact(&buf, call.Params); err != nil {
+			return "", false
+		}
+		params = buf.Bytes()
+	}
+	return method + " " + string(params), true
+}
+
+// lookup returns a cached reply for call, with the caller's id and an
+// up to date confirmation count.
+func (c *responseCache) lookup(call rpcRequest) (json.RawMessage, bool) {
+	if c == nil {
+		return nil, false
+	}
+	key, ok := cacheKey(call)
+	if !ok {
+		return nil, false
+	}
+
+	c.mu.Lock()
+	var entry *cacheEntry
+	var onDisk *diskEntry
+	if el, ok := c.entries[key]; ok {
+		c.lru.MoveToFront(el)
+		entry = el.Value.(*cacheEntry)
+	} else if c.diskDir != "" {
+		if el, ok := c.diskIndex[diskFileKey(key)]; ok {
+			onDisk = el.Value.(*diskEntry)
+		}
+	}
+	tip := c.tip
+	c.mu.Unlock()
+
+	if onDisk != nil {
+		entry, tip = c.readDisk(key, *onDisk)
+	}
+
+	if entry == nil {
+		return nil, false
+	}
+	reply, err := json.Marshal(rpcResponse{
+		Result: refreshConfirmations(entry.result, entry.height, tip),
+		ID:     call.ID,
+	})
+	if err != nil {
+		return nil, false
+	}
+	return reply, true
+}
+
+// store caches Core's reply to call if the result is deep enough to be
+// immutable.
+func (c *responseCache) store(call rpcRequest, reply []byte) {
+	if c == nil {
+		return
+	}
+	key, ok := cacheKey(call)
+	if !ok {
+		return
+	}
+	var resp rpcResponse
+	if err := json.Unmarshal(reply, &resp); err != nil || resp.Error != nil || len(resp.Result) == 0 {
+		return
+	}
+
+	c.mu.Lock()
+	if c.tip == 0 {
+		c.mu.Unlock()
+		return
+	}
+	height, ok := resultHeight(call, resp.Result, c.tip)
+	if !ok || c.tip-height+1 < c.minConf {
+		c.mu.Unlock()
+		return
+	}
+	e := &cacheEntry{key: key, height: height, result: resp.Result}
+	c.insert(e)
+	toDisk := c.diskDir != ""
+	if toDisk {
+		_, exists := c.diskIndex[diskFileKey(key)]
+		toDisk = !exists
+	}
+	c.mu.Unlock()
+
+	if toDisk {
+		c.writeDisk(e)
+	}
+}
+
+// insert adds e to the LRU; callers must hold c.mu.
+func (c *responseCache) insert(e *cacheEntry) {
+	if el, ok := c.entries[e.key]; ok {
+		el.Value = e
+		c.lru.MoveToFront(el)
+		return
+	}
+	c.entries[e.key] = c.lru.PushFront(e)
+	for c.lru.Len() > c.max {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+// resultHeight works out which block height a result belongs to, if the
+// call and result carry enough information to tell.
+func resultHeight(call rpcRequest, result json.RawMessage, tip int64) (int64, bool) {
+	var fields struct {
+		Height        *int64 `json:"height"`
+		Confirmations *int64 `json:"confirmations"`
+	}
+
+	switch strings.ToLower(call.Method) {
+	case "getblockhash":
+		var params []int64
+		if err := json.Unmarshal(call.Params, &params); err != nil || len(params) != 1 {
+			return 0, false
+		}
+		return params[0], true
+
+	case "getblock", "getblockheader":
+		if err := json.Unmarshal(result, &fields); err != nil || fields.Height == nil {
+			return 0, false
+		}
+		// Blocks that are no longer on the main chain report -1
+		if fields.Confirmations != nil && *fields.Confirmations < 1 {
+			return 0, false
+		}
+		return *fields.Height, true
+
+	case "getrawtransaction":
+		if err := json.Unmarshal(result, &fields); err != nil || fields.Confirmations == nil || *fields.Confirmations < 1 {
+			return 0, false
+		}
+		return tip - *fields.Confirmations + 1, true
+	}
+	return 0, false
+}
+
+// refreshConfirmations rewrites the "confirmations" field of a cached
+// object result, the one part of it that moves with the tip.
+func refreshConfirmations(result json.RawMessage, height, tip int64) json.RawMessage {
+	if len(result) == 0 || result[0] != '{' || tip == 0 {
+		return result
+	}
+	var obj map[string]json.RawMessage
+	if err := json.Unmarshal(result, &obj); err != nil {
+		return result
+	}
+	if _, ok := obj["confirmations"]; !ok {
+		return result
+	}
+	obj["confirmations"] = json.RawMessage(strconv.FormatInt(tip-height+1, 10))
+	updated, err := json.Marshal(obj)
+	if err != nil {
+		return result
+	}
+	return updated
+}
+
+// setTip records a new chain tip and evicts everything that is no longer
+// at least minConf deep, which covers both new blocks and reorgs.
+func (c *responseCache) setTip(tip int64) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	// The same tip is often reported twice, by refreshTip and onBlock;
+	// only a lower one means blocks were disconnected
+	if c.tip != 0 && tip < c.tip {
+		log.Printf("Cache: tip moved from %d to %d, reorg detected", c.tip, tip)
+	}
+	c.tip = tip
+	limit := tip - c.minConf + 1
+
+	evicted := 0
+	for el := c.lru.Front(); el != nil; {
+		next := el.Next()
+		if e := el.Value.(*cacheEntry); e.height > limit {
+			c.lru.Remove(el)
+			delete(c.entries, e.key)
+			evicted++
+		}
+		el = next
+	}
+	var files []string
+	if c.diskDir != "" {
+		for el := c.diskOrder.Front(); el != nil; {
+			next := el.Next()
+			if d := el.Value.(*diskEntry); d.height > limit {
+				files = append(files, c.dropDisk(d.fileKey))
+				evicted++
+			}
+			el = next
+		}
+	}
+	c.mu.Unlock()
+
+	removeFiles(files)
+	if evicted > 0 {
+		log.Printf("Cache: evicted %d entries above height %d", evicted, limit)
+	}
+}
+
+// onBlock is called for every hashblock notification from Core.
+func (c *responseCache) onBlock(hash string) {
+	if c == nil {
+		return
+	}
+	if err := c.refreshTip(); err != nil {
+		log.Printf("Cache: failed to refresh tip after block %s: %v", hash, err)
+	}
+}
+
+func (c *responseCache) refreshTip() error {
+	result, err := coreCall("getblockcount")
+	if err != nil {
+		return err
+	}
+	var tip int64
+	if err := json.Unmarshal(result, &tip); err != nil {
+		return fmt.Errorf("unexpected getblockcount result %s", result)
+	}
+	c.setTip(tip)
+	return nil
+}
+
+// On-disk entries are named <height>-<sha256(key)>.json so the height is
+// known without reading the file. They are written to a tmp- file first
+// and renamed, so a reader never sees half a result.
+
+func diskFileKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func (c *responseCache) diskPath(fileKey string, height int64) string {
+	return filepath.Join(c.diskDir, strconv.FormatInt(height, 10)+"-"+fileKey+".json")
+}
+
+func (c *responseCache) loadDiskIndex() {
+	c.diskIndex = map[string]*list.Element{}
+	c.diskOrder = list.New()
+	if err := os.MkdirAll(c.diskDir, 0700); err != nil {
+		log.Printf("Cache: disabling disk cache: %v", err)
+		c.diskDir = ""
+		return
+	}
+	files, err := os.ReadDir(c.diskDir)
+	if err != nil {
+		log.Printf("Cache: disabling disk cache: %v", err)
+		c.diskDir = ""
+		return
+	}
+
+	type diskFile struct {
+		diskEntry
+		modTime int64
+	}
+	var found []diskFile
+	for _, f := range files {
+		if strings.HasPrefix(f.Name(), "tmp-") {
+			os.Remove(filepath.Join(c.diskDir, f.Name()))
+			continue
+		}
+		name := strings.TrimSuffix(f.Name(), ".json")
+		parts := strings.SplitN(name, "-", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		height, err := strconv.ParseInt(parts[0], 10, 64)
+		if err != nil {
+			continue
+		}
+		info, err := f.Info()
+		if err != nil {
+			continue
+		}
+		found = append(found, diskFile{diskEntry{parts[1], height}, info.ModTime().UnixNano()})
+	}
+	sort.Slice(found, func(i, j int) bool { return found[i].modTime < found[j].modTime })
+	for _, f := range found {
+		d := f.diskEntry
+		if el, ok := c.diskIndex[d.fileKey]; ok {
+			// The same result stored at two heights, from before a reorg
+			os.Remove(c.diskPath(d.fileKey, el.Value.(*diskEntry).height))
+			c.diskOrder.Remove(el)
+		}
+		c.diskIndex[d.fileKey] = c.diskOrder.PushBack(&d)
+	}
+	log.Printf("Cache: %d entries on disk in %s", len(c.diskIndex), c.diskDir)
+}
+
+// readDisk reads the result d holds for key and brings it into memory,
+// returning it with the tip to count confirmations from. An entry that
+// was evicted while it was read is not brought back.
+func (c *responseCache) readDisk(key string, d diskEntry) (*cacheEntry, int64) {
+	path := c.diskPath(d.fileKey, d.height)
+	data, err := os.ReadFile(path)
+
+	c.mu.Lock()
+	el, ok := c.diskIndex[d.fileKey]
+	if ok && el.Value.(*diskEntry).height != d.height {
+		ok = false
+	}
+	if ok && err != nil {
+		c.dropDisk(d.fileKey)
+	}
+	var e *cacheEntry
+	if ok && err == nil {
+		e = &cacheEntry{key: key, height: d.height, result: data}
+		c.insert(e)
+	}
+	tip := c.tip
+	c.mu.Unlock()
+
+	if ok && err != nil {
+		os.Remove(path)
+	}
+	return e, tip
+}
+
+// writeDisk stores e in a file, then indexes it, dropping the oldest
+// files beyond diskMax. A result that fell back inside the minConf window
+// while it was written is deleted again instead.
+func (c *responseCache) writeDisk(e *cacheEntry) {
+	fileKey := diskFileKey(e.key)
+	path := c.diskPath(fileKey, e.height)
+	tmp := filepath.Join(c.diskDir, "tmp-"+fileKey)
+	if err := os.WriteFile(tmp, e.result, 0600); err != nil {
+		log.Printf("Cache: failed to write disk entry: %v", err)
+		os.Remove(tmp)
+		return
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		log.Printf("Cache: failed to write disk entry: %v", err)
+		os.Remove(tmp)
+		return
+	}
+
+	var files []string
+	c.mu.Lock()
+	if el, exists := c.diskIndex[fileKey]; exists {
+		// Another request wrote the same result meanwhile; keep only the
+		// file the index points at
+		if old := el.Value.(*diskEntry); old.height != e.height {
+			files = append(files, path)
+		}
+	} else if c.tip-e.height+1 < c.minConf {
+		files = append(files, path)
+	} else {
+		c.diskIndex[fileKey] = c.diskOrder.PushBack(&diskEntry{fileKey, e.height})
+		for c.diskMax > 0 && c.diskOrder.Len() > c.diskMax {
+			files = append(files, c.dropDisk(c.diskOrder.Front().Value.(*diskEntry).fileKey))
+		}
+	}
+	c.mu.Unlock()
+
+	removeFiles(files)
+}
+
+// dropDisk takes a file out of the index and returns its path, for the
+// caller to delete once it has let go of c.mu. Callers must hold c.mu.
+func (c *responseCache) dropDisk(fileKey string) string {
+	el, ok := c.diskIndex[fileKey]
+	if !ok {
+		return ""
+	}
+	d := el.Value.(*diskEntry)
+	delete(c.diskIndex, fileKey)
+	c.diskOrder.Remove(el)
+	return c.diskPath(d.fileKey, d.height)
+}
+
+func removeFiles(paths []string) {
+	for _, path := range paths {
+		if path != "" {
+			os.Remove(path)
+		}
+	}
+}
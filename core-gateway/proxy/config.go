@@ -0,0 +1,338 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// configFileName is the file in /storage whose values override the pup
+// config, keyed by the same names, e.g. {"RPC_PASSWORD": "...",
+// "RATE_LIMIT_IP_RPS": 50}. It is re-read when it changes and on SIGHUP.
+const configFileName = "config.json"
+
+// configPollInterval is how often the config file is checked for changes.
+const configPollInterval = 5 * time.Second
+
+// reloadableSettings are the pup config values that take effect without
+// a restart. Anything else in the config file is ignored.
+var reloadableSettings = []string{
+	"RPC_USERNAME", "RPC_PASSWORD",
+	"RPC_ALLOWED_METHODS", "RPC_DENIED_METHODS", "ALLOWED_CIDRS",
+	"ZMQ_REQUIRE_AUTH", "FEED_ALLOWED_ORIGINS", "REST_ENABLED", "REST_PUBLIC",
+	"RATE_LIMIT_IP_RPS", "RATE_LIMIT_IP_BURST", "RATE_LIMIT_USER_RPS", "RATE_LIMIT_USER_BURST",
+	"MAX_CONCURRENT_RPC", "MAX_ZMQ_CONNECTIONS",
+	"AUTH_LOCKOUT_THRESHOLD", "AUTH_LOCKOUT_SECONDS", "AUTH_LOCKOUT_MAX_SECONDS",
+	"RPC_TIMEOUT", "RPC_SLOW_TIMEOUT", "MAX_REQUEST_SIZE_MB", "MAX_RESPONSE_SIZE_MB",
+}
+
+// secretSettings are left out of the reported config hash, so the hash
+// cannot be used to guess them.
+var secretSettings = map[string]bool{"RPC_PASSWORD": true}
+
+// proxyConfig is the part of the gateway's configuration that can change
+// while it runs. A reload builds a new one and swaps it in whole; the
+// rate limiters, lockouts and connection slots keep their state and are
+// given the new limits.
+type proxyConfig struct {
+	rpcUsername string
+	rpcPassword string
+	policy      methodPolicy
+	allowlist   *cidrAllowlist
+	// zmqRequireAuth refuses ZMQ clients using the NULL mechanism, so
+	// every subscriber has to log in with PLAIN.
+	zmqRequireAuth bool
+	// feedOrigins are the web origins, such as https://app.example, whose
+	// pages may use the block feeds besides the gateway's own.
+	feedOrigins map[string]bool
+	restEnabled bool
+	restPublic  bool
+
+	rpcTimeout       time.Duration
+	rpcSlowTimeout   time.Duration
+	maxRequestBytes  int64
+	maxResponseBytes int64
+
+	ipRate, ipBurst     float64
+	userRate, userBurst float64
+	maxRPC, maxZMQ      int
+	lockoutThreshold    int
+	lockoutBase         time.Duration
+	lockoutMax          time.Duration
+
+	// values are the settings the config was built from, and hash a
+	// digest of those that are not secret. version counts the changes
+	// applied since the gateway started.
+	values  map[string]string
+	hash    string
+	version int64
+}
+
+var (
+	currentConfig atomic.Pointer[proxyConfig]
+	configPath    string
+	reloadMu      sync.Mutex
+
+	configReloadErrors = newCounter("gateway_config_reload_errors_total",
+		"Config reloads rejected because the config file could not be read or parsed.")
+	_ = newGauge("gateway_config_version",
+		"Number of config changes applied since the gateway started.",
+		func() float64 { return float64(config().version) })
+)
+
+// config returns the configuration in effect. Callers should not keep it
+// beyond the request they are handling.
+func config() *proxyConfig {
+	return currentConfig.Load()
+}
+
+// loadConfig reads the pup config and the config file in dir and applies
+// them. It is called once at startup; later changes go through
+// reloadConfig.
+func loadConfig(dir string) error {
+	configPath = filepath.Join(dir, configFileName)
+	overrides, err := readConfigFile(configPath)
+	if err != nil {
+		return err
+	}
+	c, err := buildConfig(overrides)
+	if err != nil {
+		return err
+	}
+	applyConfig(c)
+	return nil
+}
+
+// reloadConfig re-reads the config file and applies it if anything
+// changed. An unreadable or invalid file leaves the running config as it
+// is.
+func reloadConfig(reason string) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	overrides, err := readConfigFile(configPath)
+	if err == nil {
+		var c *proxyConfig
+		if c, err = buildConfig(overrides); err == nil {
+			prev := config()
+			changed := changedSettings(prev.values, c.values)
+			if len(changed) == 0 {
+				log.Printf("Config: %s, nothing changed", reason)
+				return
+			}
+			c.version = prev.version + 1
+			applyConfig(c)
+			log.Printf("Config: %s, applied version %d (changed: %s)", reason, c.version, strings.Join(changed, ", "))
+			return
+		}
+	}
+	configReloadErrors.inc()
+	log.Printf("Config: %s, keeping the current config: %v", reason, err)
+}
+
+// readConfigFile returns the settings in path as strings. A missing file
+// overrides nothing.
+func readConfigFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var raw map[string]interface{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("parsing %s: %v", path, err)
+	}
+	overrides := map[string]string{}
+	for name, value := range raw {
+		if !isReloadable(name) {
+			log.Printf("Config: ignoring %s in %s, it needs a restart to change", name, path)
+			continue
+		}
+		switch v := value.(type) {
+		case string:
+			overrides[name] = v
+		case float64:
+			overrides[name] = strconv.FormatFloat(v, 'f', -1, 64)
+		case bool:
+			overrides[name] = strconv.FormatBool(v)
+		case nil:
+		default:
+			return nil, fmt.Errorf("%s in %s must be a string, number or boolean", name, path)
+		}
+	}
+	return overrides, nil
+}
+
+func isReloadable(name string) bool {
+	for _, s := range reloadableSettings {
+		if s == name {
+			return true
+		}
+	}
+	return false
+}
+
+// buildConfig reads each reloadable setting from overrides, falling back
+// to the pup config.
+func buildConfig(overrides map[string]string) (*proxyConfig, error) {
+	values := map[string]string{}
+	for _, name := range reloadableSettings {
+		if value, ok := overrides[name]; ok {
+			values[name] = value
+		} else {
+			values[name] = os.Getenv(name)
+		}
+	}
+	get := func(name string) string { return values[name] }
+	number := func(name string, def float64) float64 { return parseFloatSetting(name, values[name], def) }
+	seconds := func(name string, def float64) time.Duration {
+		return time.Duration(number(name, def) * float64(time.Second))
+	}
+	flag := func(name string) bool {
+		b, _ := strconv.ParseBool(values[name])
+		return b
+	}
+
+	c := &proxyConfig{
+		rpcUsername:    get("RPC_USERNAME"),
+		rpcPassword:    get("RPC_PASSWORD"),
+		policy:         newMethodPolicy(get("RPC_ALLOWED_METHODS"), get("RPC_DENIED_METHODS")),
+		zmqRequireAuth: flag("ZMQ_REQUIRE_AUTH"),
+		restEnabled:    flag("REST_ENABLED"),
+		restPublic:     flag("REST_PUBLIC"),
+
+		rpcTimeout:       seconds("RPC_TIMEOUT", 30),
+		rpcSlowTimeout:   seconds("RPC_SLOW_TIMEOUT", 300),
+		maxRequestBytes:  int64(number("MAX_REQUEST_SIZE_MB", 2) * 1024 * 1024),
+		maxResponseBytes: int64(number("MAX_RESPONSE_SIZE_MB", 64) * 1024 * 1024),
+
+		ipRate:           number("RATE_LIMIT_IP_RPS", 0),
+		ipBurst:          number("RATE_LIMIT_IP_BURST", 0),
+		userRate:         number("RATE_LIMIT_USER_RPS", 0),
+		userBurst:        number("RATE_LIMIT_USER_BURST", 0),
+		maxRPC:           int(number("MAX_CONCURRENT_RPC", 0)),
+		maxZMQ:           int(number("MAX_ZMQ_CONNECTIONS", 0)),
+		lockoutThreshold: int(number("AUTH_LOCKOUT_THRESHOLD", 5)),
+		lockoutBase:      seconds("AUTH_LOCKOUT_SECONDS", 30),
+		lockoutMax:       seconds("AUTH_LOCKOUT_MAX_SECONDS", 3600),
+
+		values: values,
+		hash:   configHash(values),
+	}
+
+	c.feedOrigins = map[string]bool{}
+	for _, origin := range strings.Fields(strings.ReplaceAll(get("FEED_ALLOWED_ORIGINS"), ",", " ")) {
+		c.feedOrigins[strings.ToLower(strings.TrimSuffix(origin, "/"))] = true
+	}
+
+	var err error
+	if c.allowlist, err = newCIDRAllowlist(get("ALLOWED_CIDRS")); err != nil {
+		return nil, fmt.Errorf("allowed CIDRs: %v", err)
+	}
+	return c, nil
+}
+
+// applyConfig makes c the running config and passes its limits on to the
+// stateful limiters.
+func applyConfig(c *proxyConfig) {
+	ipLimiter.setLimits(c.ipRate, c.ipBurst)
+	userLimiter.setLimits(c.userRate, c.userBurst)
+	ipLockout.setLimits(c.lockoutThreshold, c.lockoutBase, c.lockoutMax)
+	userLockout.setLimits(c.lockoutThreshold, c.lockoutBase, c.lockoutMax)
+	rpcSlots.setLimit(c.maxRPC)
+	zmqSlots.setLimit(c.maxZMQ)
+	currentConfig.Store(c)
+}
+
+// configHash digests the settings that are not secret, so two gateways,
+// or one before and after a reload, can be compared at a glance.
+func configHash(values map[string]string) string {
+	names := make([]string, 0, len(values))
+	for name := range values {
+		if !secretSettings[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	h := sha256.New()
+	for _, name := range names {
+		fmt.Fprintf(h, "%s=%s\n", name, values[name])
+	}
+	return hex.EncodeToString(h.Sum(nil))[:12]
+}
+
+func changedSettings(prev, next map[string]string) []string {
+	var changed []string
+	for _, name := range reloadableSettings {
+		if prev[name] != next[name] {
+			changed = append(changed, name)
+		}
+	}
+	return changed
+}
+
+// watchConfig reloads the config on SIGHUP and whenever the config file
+// changes, until the gateway stops.
+func watchConfig() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	last := configFileState()
+	ticker := time.NewTicker(configPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopping:
+			return
+		case <-hup:
+			last = configFileState()
+			reloadConfig("SIGHUP received")
+		case <-ticker.C:
+			if state := configFileState(); state != last {
+				last = state
+				reloadConfig(configFileName + " changed")
+			}
+		}
+	}
+}
+
+// configFileState is a digest of the config file's contents, or empty if
+// it cannot be read.
+func configFileState() string {
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// parseFloatSetting parses a numeric setting, falling back to def when it
+// is unset or malformed.
+func parseFloatSetting(name, value string, def float64) float64 {
+	if value == "" {
+		return def
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		log.Printf("Ignoring invalid %s=%q: %v", name, value, err)
+		return def
+	}
+	return f
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// coreCredentialsFileName is the file in /storage holding the login Core
+// issued to this pup. electrum-server reads it too.
+const coreCredentialsFileName = "core-credentials.json"
+
+// The login every pup shared before Core issued them per pup. It is used
+// when the provider of core-rpc is too old to issue credentials.
+const staticCoreAuth = "dogebox_core_pup_temporary_static_username:dogebox_core_pup_temporary_static_password"
+
+const (
+	// coreRotateAfter is how old the credential may get before it is
+	// swapped for a new one.
+	coreRotateAfter = 30 * 24 * time.Hour
+	// coreRetryEvery paces enrolling while Core cannot be reached, and
+	// again after Core refused the credential, so Core is not asked on
+	// every call.
+	coreRetryEvery = time.Minute
+)
+
+var (
+	errCoreNoCredentials = errors.New("the core-rpc provider does not issue credentials")
+	errCoreEnrolled      = errors.New("Core already issued this pup a credential; it can enroll again once that has gone unused for an hour, or is revoked in the Core pup's config")
+)
+
+// coreCredential is the login Core issued to this pup. provider is the
+// core-rpc address it was issued by, so a new one is requested when the
+// pup is linked to another provider.
+type coreCredential struct {
+	Provider string    `json:"provider"`
+	Username string    `json:"username"`
+	Password string    `json:"password"`
+	Name     string    `json:"name"`
+	Issued   time.Time `json:"issued"`
+}
+
+var (
+	coreLogin    atomic.Pointer[string]
+	coreCredMu   sync.Mutex
+	coreCred     *coreCredential
+	coreCredPath string
+	lastReenroll time.Time
+	// coreEnrollPending is set while enrolling failed for a reason that
+	// may pass, such as Core still starting.
+	coreEnrollPending bool
+	coreAuthHTTP      = &http.Client{Timeout: 10 * time.Second}
+)
+
+// coreAuth returns the Authorization header for calls to Core.
+func coreAuth() string {
+	return *coreLogin.Load()
+}
+
+func setCoreLogin(username, password string) {
+	auth := "Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password))
+	coreLogin.Store(&auth)
+}
+
+// setupCoreAuth loads the credential Core issued to this pup, or enrolls
+// for one. When the provider cannot issue credentials the static login
+// is used instead.
+func setupCoreAuth(dir string) {
+	staticAuth := "Basic " + base64.StdEncoding.EncodeToString([]byte(staticCoreAuth))
+	coreLogin.Store(&staticAuth)
+	coreCredPath = filepath.Join(dir, coreCredentialsFileName)
+	if replayer != nil {
+		return
+	}
+
+	coreCredMu.Lock()
+	defer coreCredMu.Unlock()
+	if data, err := os.ReadFile(coreCredPath); err == nil {
+		var c coreCredential
+		if err := json.Unmarshal(data, &c); err != nil {
+			log.Printf("Core credentials: ignoring %s: %v", coreCredPath, err)
+		} else if c.Provider == rpcUpstream {
+			coreCred = &c
+			setCoreLogin(c.Username, c.Password)
+			log.Printf("  Core Login: %s, issued %s", c.Username, c.Issued.Format(time.RFC3339))
+			return
+		}
+	}
+	if err := enrollWithCoreLocked(); err != nil {
+		coreEnrollPending = retryEnroll(err)
+		log.Printf("  Core Login: static (%v)", err)
+		return
+	}
+	log.Printf("  Core Login: %s, newly issued", coreCred.Username)
+}
+
+// maintainCoreAuth enrolls once Core can be reached if it could not be
+// at startup, and rotates the credential once it is coreRotateAfter old.
+func maintainCoreAuth() {
+	if replayer != nil {
+		return
+	}
+	ticker := time.NewTicker(coreRetryEvery)
+	defer ticker.Stop()
+	for range ticker.C {
+		coreCredMu.Lock()
+		switch {
+		case coreCred == nil && coreEnrollPending:
+			if err := enrollWithCoreLocked(); err != nil {
+				coreEnrollPending = retryEnroll(err)
+			} else {
+				coreEnrollPending = false
+				log.Printf("Core credentials: enrolled as %s", coreCred.Username)
+			}
+		case coreCred != nil && time.Since(coreCred.Issued) > coreRotateAfter:
+			if err := rotateCoreCredentialLocked(); err != nil {
+				log.Printf("Core credentials: rotation failed, keeping %s: %v", coreCred.Username, err)
+			} else {
+				log.Printf("Core credentials: rotated %s", coreCred.Username)
+			}
+		}
+		coreCredMu.Unlock()
+	}
+}
+
+// retryEnroll reports whether enrolling is worth trying again after err.
+// An old provider will not change by waiting. A credential already
+// issued to this pup, for example before its storage was lost, can be
+// replaced once it has gone unused for long enough.
+func retryEnroll(err error) bool {
+	return !errors.Is(err, errCoreNoCredentials)
+}
+
+// coreRejected is called when Core answers 401: the credential was
+// revoked, or the static login is no longer accepted. It enrolls again,
+// at most once every coreRetryEvery.
+func coreRejected() {
+	if replayer != nil {
+		return
+	}
+	coreCredMu.Lock()
+	defer coreCredMu.Unlock()
+	if time.Since(lastReenroll) < coreRetryEvery {
+		return
+	}
+	lastReenroll = time.Now()
+	if err := enrollWithCoreLocked(); err != nil {
+		log.Printf("Core credentials: Core refused the login and enrolling again failed: %v", err)
+		return
+	}
+	coreEnrollPending = false
+	log.Printf("Core credentials: Core refused the login, enrolled again as %s", coreCred.Username)
+}
+
+// enrollWithCoreLocked asks Core for a credential of this pup's own and
+// stores it. Callers must hold coreCredMu.
+func enrollWithCoreLocked() error {
+	reply, err := postCoreCredentials("/dogebox/credentials", "")
+	if err != nil {
+		return err
+	}
+	return saveCoreCredentialLocked(reply)
+}
+
+// rotateCoreCredentialLocked swaps the credential for a new one. Core
+// keeps the old one working for a while, so calls in flight are not
+// refused. Callers must hold coreCredMu.
+func rotateCoreCredentialLocked() error {
+	reply, err := postCoreCredentials("/dogebox/credentials/rotate", coreAuth())
+	if err != nil {
+		return err
+	}
+	return saveCoreCredentialLocked(reply)
+}
+
+func saveCoreCredentialLocked(c *coreCredential) error {
+	c.Provider = rpcUpstream
+	c.Issued = time.Now().UTC()
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := coreCredPath + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, coreCredPath); err != nil {
+		return err
+	}
+	coreCred = c
+	setCoreLogin(c.Username, c.Password)
+	return nil
+}
+
+// postCoreCredentials calls one of Core's credential endpoints. Providers
+// from before per-pup credentials answer 401 or 404.
+func postCoreCredentials(path, auth string) (*coreCredential, error) {
+	req, err := http.NewRequest("POST", rpcUpstream+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	if auth != "" {
+		req.Header.Set("Authorization", auth)
+	}
+	resp, err := coreAuthHTTP.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusCreated:
+	case http.StatusUnauthorized, http.StatusNotFound:
+		return nil, fmt.Errorf("%w (HTTP %d)", errCoreNoCredentials, resp.StatusCode)
+	case http.StatusConflict:
+		return nil, errCoreEnrolled
+	default:
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, fmt.Errorf("HTTP %d: %s", resp.StatusCode, body)
+	}
+	var c coreCredential
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 4096)).Decode(&c); err != nil {
+		return nil, err
+	}
+	if c.Username == "" || c.Password == "" {
+		return nil, errors.New("Core issued an empty credential")
+	}
+	return &c, nil
+}
@@ -0,0 +1,408 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	feedQueue     = 16
+	feedHeartbeat = 30 * time.Second
+	// feedWriteTimeout is how long a client may take to accept an event
+	// before it is disconnected, so a stalled browser cannot hold its
+	// handler, or shutdown, open.
+	feedWriteTimeout = 30 * time.Second
+
+	wsGUID       = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+	wsOpText     = 0x1
+	wsOpClose    = 0x8
+	wsOpPing     = 0x9
+	wsOpPong     = 0xA
+	wsMaxPayload = 64 << 10
+)
+
+type blockEvent struct {
+	Hash   string `json:"hash"`
+	Height int64  `json:"height"`
+	Time   int64  `json:"time"`
+}
+
+// blockFeed turns Core's hashblock notifications into JSON events for
+// clients that cannot speak ZMQ, such as browser dapps.
+type blockFeed struct {
+	mu      sync.Mutex
+	clients map[chan []byte]struct{}
+}
+
+var feed = &blockFeed{clients: map[chan []byte]struct{}{}}
+
+// announce looks up the block's height and time and sends the event to
+// every connected client. Slow clients miss events rather than block.
+func (f *blockFeed) announce(hash string) {
+	result, err := coreCall("getblockheader", hash)
+	if err != nil {
+		log.Printf("Block feed: failed to look up %s: %v", hash, err)
+		return
+	}
+	var ev blockEvent
+	if err := json.Unmarshal(result, &ev); err != nil {
+		log.Printf("Block feed: unexpected getblockheader result for %s: %v", hash, err)
+		return
+	}
+	data, err := json.Marshal(ev)
+	if err != nil {
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for ch := range f.clients {
+		select {
+		case ch <- data:
+		default:
+		}
+	}
+}
+
+func (f *blockFeed) subscribe() chan []byte {
+	ch := make(chan []byte, feedQueue)
+	f.mu.Lock()
+	f.clients[ch] = struct{}{}
+	f.mu.Unlock()
+	return ch
+}
+
+func (f *blockFeed) unsubscribe(ch chan []byte) {
+	f.mu.Lock()
+	delete(f.clients, ch)
+	f.mu.Unlock()
+}
+
+// feedAllowed applies the same auth and per-IP limit as RPC requests to
+// the event endpoints, and turns away pages from origins that are not
+// allowed. They relay Core's ZMQ notifications, so tokens need the zmq
+// scope.
+func feedAllowed(w http.ResponseWriter, r *http.Request) bool {
+	if !originAllowed(r) {
+		log.Printf("Block feed client %s refused: origin %s not allowed", r.RemoteAddr, r.Header.Get("Origin"))
+		http.Error(w, "Origin not allowed", http.StatusForbidden)
+		return false
+	}
+	if !ipLimiter.allow(clientIP(r.RemoteAddr), 1) {
+		writeThrottled(w, "Rate limit exceeded")
+		return false
+	}
+	caller, ok := feedAuth(w, r)
+	if ok && !caller.allows(scopeZMQ) {
+		http.Error(w, "Token does not have the zmq scope", http.StatusForbidden)
+		return false
+	}
+	return ok
+}
+
+// feedAuth authenticates a feed client. Browsers cannot set headers on
+// EventSource and WebSocket requests, so an API token is also accepted
+// in the token query parameter or as a Sec-WebSocket-Protocol value.
+// Passwords are only taken from the Authorization header, so a URL that
+// leaks gives away no more than a token's scopes.
+func feedAuth(w http.ResponseWriter, r *http.Request) (principal, bool) {
+	secret := feedToken(r)
+	if secret == "" || r.Header.Get("Authorization") != "" || !authEnabled() {
+		return requireAuth(w, r)
+	}
+	ip := clientIP(r.RemoteAddr)
+	if wait, locked := ipLockout.locked(ip); locked {
+		writeLockedOut(w, wait)
+		return principal{}, false
+	}
+	p, ok := tokens.authenticate(secret)
+	if !ok {
+		authFailures.inc()
+		ipLockout.fail(ip)
+		log.Printf("Authentication failed for a block feed token from %s", r.RemoteAddr)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return principal{}, false
+	}
+	ipLockout.succeed(ip)
+	return p, true
+}
+
+// feedToken returns the API token a browser sent in the query string, or
+// among the WebSocket subprotocols it offered.
+func feedToken(r *http.Request) string {
+	if t := r.URL.Query().Get("token"); t != "" {
+		return t
+	}
+	for _, header := range r.Header.Values("Sec-WebSocket-Protocol") {
+		for _, p := range strings.Split(header, ",") {
+			if p = strings.TrimSpace(p); strings.HasPrefix(p, tokenPrefix) {
+				return p
+			}
+		}
+	}
+	return ""
+}
+
+// originAllowed reports whether a browser page may use the feeds: pages
+// served from the gateway itself and from FEED_ALLOWED_ORIGINS. Clients
+// that are not browsers send no Origin and are let through, since the
+// feeds need credentials anyway. Browsers send cookies and cached Basic
+// credentials along with WebSocket upgrades from any page, so without
+// this a page elsewhere could read the feed as the user.
+func originAllowed(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if u, err := url.Parse(origin); err == nil && strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	return config().feedOrigins[strings.ToLower(strings.TrimSuffix(origin, "/"))]
+}
+
+// sseHandler streams block events as Server-Sent Events.
+func sseHandler(w http.ResponseWriter, r *http.Request) {
+	if !feedAllowed(w, r) {
+		return
+	}
+	if _, ok := w.(http.Flusher); !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	rc := http.NewResponseController(w)
+
+	ch := feed.subscribe()
+	defer feed.unsubscribe(ch)
+
+	log.Printf("SSE block feed client %s connected", r.RemoteAddr)
+	defer log.Printf("SSE block feed client %s disconnected", r.RemoteAddr)
+
+	if origin := r.Header.Get("Origin"); origin != "" {
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Set("Vary", "Origin")
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	rc.SetWriteDeadline(time.Now().Add(feedWriteTimeout))
+	w.WriteHeader(http.StatusOK)
+	if rc.Flush() != nil {
+		return
+	}
+
+	heartbeat := time.NewTicker(feedHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		var err error
+		select {
+		case <-r.Context().Done():
+			return
+		case <-stopping:
+			return
+		case data := <-ch:
+			rc.SetWriteDeadline(time.Now().Add(feedWriteTimeout))
+			_, err = fmt.Fprintf(w, "event: block\ndata: %s\n\n", data)
+		case <-heartbeat.C:
+			rc.SetWriteDeadline(time.Now().Add(feedWriteTimeout))
+			_, err = io.WriteString(w, ": keepalive\n\n")
+		}
+		if err == nil {
+			err = rc.Flush()
+		}
+		if err != nil {
+			log.Printf("SSE block feed client %s dropped: %v", r.RemoteAddr, err)
+			return
+		}
+	}
+}
+
+// wsHandler streams block events over a WebSocket (RFC 6455) as text
+// messages.
+func wsHandler(w http.ResponseWriter, r *http.Request) {
+	if !feedAllowed(w, r) {
+		return
+	}
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") ||
+		!headerContainsToken(r.Header.Get("Connection"), "upgrade") ||
+		r.Header.Get("Sec-WebSocket-Key") == "" {
+		http.Error(w, "WebSocket upgrade required", http.StatusBadRequest)
+		return
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "Unsupported WebSocket version", http.StatusUpgradeRequired)
+		return
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "WebSocket unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		log.Printf("WebSocket hijack failed: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	// A browser fails the connection unless one of the subprotocols it
+	// offered is chosen, so a token sent as one is echoed back
+	protocol := ""
+	if t := feedToken(r); t != "" && r.URL.Query().Get("token") == "" {
+		protocol = "Sec-WebSocket-Protocol: " + t + "\r\n"
+	}
+	sum := sha1.Sum([]byte(r.Header.Get("Sec-WebSocket-Key") + wsGUID))
+	conn.SetWriteDeadline(time.Now().Add(feedWriteTimeout))
+	fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\n"+
+		"Upgrade: websocket\r\n"+
+		"Connection: Upgrade\r\n"+
+		"%sSec-WebSocket-Accept: %s\r\n\r\n", protocol, base64.StdEncoding.EncodeToString(sum[:]))
+	if err := rw.Flush(); err != nil {
+		return
+	}
+
+	ch := feed.subscribe()
+	defer feed.unsubscribe(ch)
+
+	log.Printf("WebSocket block feed client %s connected", r.RemoteAddr)
+	defer log.Printf("WebSocket block feed client %s disconnected", r.RemoteAddr)
+
+	// The reader answers pings and notices when the client goes away
+	var wmu sync.Mutex
+	write := func(op byte, payload []byte) error {
+		wmu.Lock()
+		defer wmu.Unlock()
+		conn.SetWriteDeadline(time.Now().Add(feedWriteTimeout))
+		if err := writeWSFrame(rw.Writer, op, payload); err != nil {
+			return err
+		}
+		return rw.Flush()
+	}
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			op, payload, err := readWSFrame(rw.Reader)
+			if err != nil {
+				return
+			}
+			switch op {
+			case wsOpPing:
+				write(wsOpPong, payload)
+			case wsOpClose:
+				write(wsOpClose, nil)
+				return
+			}
+		}
+	}()
+
+	heartbeat := time.NewTicker(feedHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		var err error
+		select {
+		case <-closed:
+			return
+		case <-stopping:
+			write(wsOpClose, []byte{0x03, 0xE9}) // 1001 going away
+			return
+		case data := <-ch:
+			err = write(wsOpText, data)
+		case <-heartbeat.C:
+			err = write(wsOpPing, nil)
+		}
+		if err != nil {
+			log.Printf("WebSocket block feed client %s dropped: %v", r.RemoteAddr, err)
+			return
+		}
+	}
+}
+
+func headerContainsToken(header, token string) bool {
+	for _, t := range strings.Split(header, ",") {
+		if strings.EqualFold(strings.TrimSpace(t), token) {
+			return true
+		}
+	}
+	return false
+}
+
+// writeWSFrame writes a single unmasked, unfragmented server frame.
+func writeWSFrame(w *bufio.Writer, op byte, payload []byte) error {
+	header := []byte{0x80 | op}
+	switch n := len(payload); {
+	case n < 126:
+		header = append(header, byte(n))
+	case n <= 0xFFFF:
+		header = append(header, 126)
+		header = binary.BigEndian.AppendUint16(header, uint16(n))
+	default:
+		header = append(header, 127)
+		header = binary.BigEndian.AppendUint64(header, uint64(n))
+	}
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	_, err := w.Write(payload)
+	return err
+}
+
+// readWSFrame reads one client frame, which RFC 6455 requires to be
+// masked, and returns its unmasked payload.
+func readWSFrame(r *bufio.Reader) (byte, []byte, error) {
+	var head [2]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return 0, nil, err
+	}
+	op := head[0] & 0x0F
+	if head[1]&0x80 == 0 {
+		return 0, nil, errors.New("unmasked client frame")
+	}
+
+	size := uint64(head[1] & 0x7F)
+	switch size {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		size = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		size = binary.BigEndian.Uint64(ext[:])
+	}
+	if size > wsMaxPayload {
+		return 0, nil, errors.New("WebSocket frame too large")
+	}
+
+	var mask [4]byte
+	if _, err := io.ReadFull(r, mask[:]); err != nil {
+		return 0, nil, err
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return op, payload, nil
+}
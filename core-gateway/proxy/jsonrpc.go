@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// JSON-RPC error codes, matching the ones Dogecoin Core itself returns
+// where one exists.
+const (
+	rpcErrParse          = -32700
+	rpcErrInvalidRequest = -32600
+	rpcErrMethodNotFound = -32601
+	rpcErrInvalidParams  = -32602
+	rpcErrInternal       = -32603
+	rpcErrForbidden      = -32001
+	rpcErrRateLimited    = -32002
+	rpcErrTimeout        = -32003
+	rpcErrLockedOut      = -32004
+)
+
+type rpcRequest struct {
+	JSONRPC string          `json:"jsonrpc,omitempty"`
+	ID      json.RawMessage `json:"id"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+}
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// Error lets an error object returned by Core be passed around as a Go
+// error.
+func (e *rpcError) Error() string {
+	return fmt.Sprintf("RPC error %d: %s", e.Code, e.Message)
+}
+
+type rpcResponse struct {
+	Result json.RawMessage `json:"result"`
+	Error  *rpcError       `json:"error"`
+	ID     json.RawMessage `json:"id"`
+}
+
+// Errors from parseRPCRequest. errParse means the body is not JSON at
+// all; errInvalidRequest means it is JSON but not a call object.
+var (
+	errParse          = errors.New("parse error")
+	errInvalidRequest = errors.New("invalid request")
+)
+
+// parseRPCRequest decodes a single JSON-RPC call from the request body.
+func parseRPCRequest(body []byte) (rpcRequest, error) {
+	if !json.Valid(body) {
+		return rpcRequest{}, errParse
+	}
+	var req rpcRequest
+	if err := json.Unmarshal(body, &req); err != nil || req.Method == "" {
+		return rpcRequest{}, errInvalidRequest
+	}
+	return req, nil
+}
+
+// writeParseError replies to a single call that parseRPCRequest rejected.
+// Both cases are client errors, so neither gets a 5xx.
+func writeParseError(w http.ResponseWriter, err error) int {
+	if errors.Is(err, errParse) {
+		return writeRPCError(w, http.StatusBadRequest, nil, rpcErrParse, "Parse error")
+	}
+	return writeRPCError(w, http.StatusBadRequest, nil, rpcErrInvalidRequest, "Invalid Request")
+}
+
+// isBatch reports whether body holds a JSON-RPC batch (a JSON array).
+func isBatch(body []byte) bool {
+	trimmed := bytes.TrimLeft(body, " \t\r\n")
+	return len(trimmed) > 0 && trimmed[0] == '['
+}
+
+// errorReply builds a JSON-RPC error object in the same shape Core uses,
+// so clients can handle gateway rejections like node errors.
+func errorReply(id json.RawMessage, code int, message string) json.RawMessage {
+	if len(id) == 0 {
+		id = json.RawMessage("null")
+	}
+	reply, _ := json.Marshal(rpcResponse{
+		Result: json.RawMessage("null"),
+		Error:  &rpcError{Code: code, Message: message},
+		ID:     id,
+	})
+	return reply
+}
+
+// writeRPCError replies to a single call with a JSON-RPC error object,
+// returning the number of body bytes written.
+func writeRPCError(w http.ResponseWriter, status int, id json.RawMessage, code int, message string) int {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	n, _ := w.Write(errorReply(id, code, message))
+	return n
+}
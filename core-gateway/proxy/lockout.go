@@ -0,0 +1,141 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	ipLockout   = newAuthLockout()
+	userLockout = newAuthLockout()
+)
+
+type lockoutEntry struct {
+	failures int
+	until    time.Time
+	last     time.Time
+}
+
+// authLockout counts consecutive failed logins per key, a client IP or a
+// username. Once a key reaches threshold failures it is locked out for
+// base, doubling with every further failure up to max. A lockout with
+// no threshold never locks anyone out.
+type authLockout struct {
+	mu        sync.Mutex
+	threshold int
+	base      time.Duration
+	max       time.Duration
+	entries   map[string]*lockoutEntry
+}
+
+func newAuthLockout() *authLockout {
+	l := &authLockout{entries: map[string]*lockoutEntry{}}
+	go l.prune()
+	return l
+}
+
+// setLimits changes the threshold and lockout periods. A threshold or
+// base period of zero turns lockouts off and lifts those in place.
+func (l *authLockout) setLimits(threshold int, base, max time.Duration) {
+	if max < base {
+		max = base
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.threshold, l.base, l.max = threshold, base, max
+	if !l.enabled() {
+		l.entries = map[string]*lockoutEntry{}
+	}
+}
+
+// enabled reports whether lockouts are on; callers must hold l.mu.
+func (l *authLockout) enabled() bool {
+	return l.threshold > 0 && l.base > 0
+}
+
+// locked reports whether key is locked out, and for how much longer.
+func (l *authLockout) locked(key string) (time.Duration, bool) {
+	if key == "" {
+		return 0, false
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	e, ok := l.entries[key]
+	if !ok {
+		return 0, false
+	}
+	wait := time.Until(e.until)
+	return wait, wait > 0
+}
+
+// fail records a failed login for key, starting or extending its
+// lockout once the threshold is reached.
+func (l *authLockout) fail(key string) {
+	if key == "" {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.enabled() {
+		return
+	}
+
+	now := time.Now()
+	e, ok := l.entries[key]
+	if !ok {
+		e = &lockoutEntry{}
+		l.entries[key] = e
+	}
+	e.failures++
+	e.last = now
+	if over := e.failures - l.threshold; over >= 0 {
+		period := l.base
+		for i := 0; i < over && period < l.max; i++ {
+			period *= 2
+		}
+		if period > l.max {
+			period = l.max
+		}
+		e.until = now.Add(period)
+		authLockouts.inc()
+	}
+}
+
+// succeed clears key's failure count after a good login.
+func (l *authLockout) succeed(key string) {
+	if key == "" {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.entries, key)
+}
+
+// prune forgets keys whose last failure is long enough ago that their
+// lockout would have expired even at the maximum period.
+func (l *authLockout) prune() {
+	for range time.Tick(time.Minute) {
+		l.mu.Lock()
+		for key, e := range l.entries {
+			if time.Since(e.last) > l.max && time.Now().After(e.until) {
+				delete(l.entries, key)
+			}
+		}
+		l.mu.Unlock()
+	}
+}
+
+// writeLockedOut rejects a request from a locked out client or user with
+// HTTP 429 and a JSON-RPC error saying when to try again.
+func writeLockedOut(w http.ResponseWriter, wait time.Duration) {
+	seconds := int(wait.Round(time.Second) / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	writeRPCError(w, http.StatusTooManyRequests, nil, rpcErrLockedOut,
+		"Too many failed login attempts, try again in "+strconv.Itoa(seconds)+" seconds")
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// metricsPort is where the Prometheus endpoint listens, apart from RPC
+// so it can be scraped without RPC credentials.
+const metricsPort = "22590"
+
+// Prometheus metrics served on /metrics.
+var (
+	rpcRequests = newCounter("gateway_rpc_requests_total",
+		"RPC calls handled, by method, outcome and HTTP status.", "method", "outcome", "status")
+	rpcLatency = newHistogram("gateway_rpc_request_duration_seconds",
+		"Time taken to answer RPC calls, by method.",
+		[]float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}, "method")
+	rpcResponseBytes = newCounter("gateway_rpc_response_bytes_total",
+		"Bytes of RPC responses sent to clients.")
+	upstreamErrors = newCounter("gateway_upstream_errors_total",
+		"RPC calls that failed because Core could not be reached or timed out.")
+	authFailures = newCounter("gateway_auth_failures_total",
+		"Requests rejected for missing or invalid credentials.")
+	authLockouts = newCounter("gateway_auth_lockouts_total",
+		"Failed logins that started or extended a lockout of a client IP or username.")
+	zmqRelayedBytes = newCounter("gateway_zmq_relayed_bytes_total",
+		"Bytes of ZMQ messages sent to subscribers.")
+	_ = newGauge("gateway_zmq_connections",
+		"Connected ZMQ subscribers.",
+		func() float64 { return float64(len(relay.stats())) })
+	_ = newGauge("gateway_zmq_upstream_connected",
+		"Whether the relay is subscribed to Core (1) or not (0).",
+		func() float64 { return boolFloat(relay.connected.Load()) })
+)
+
+// tlsFingerprint is the SHA-256 fingerprint of the RPC listener's
+// certificate, or empty when TLS is disabled.
+var tlsFingerprint string
+
+func startMetricsServer() {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", promHandler)
+	metricsServer = &http.Server{Addr: pupIP + ":" + metricsPort, Handler: allowlistHandler("metrics", mux)}
+
+	log.Printf("Metrics listening on %s", metricsServer.Addr)
+	go func() {
+		if err := metricsServer.ListenAndServe(); err != http.ErrServerClosed {
+			log.Printf("Metrics endpoint failed: %v", err)
+		}
+	}()
+}
+
+// observeCall records one finished RPC call in the audit log and the
+// Prometheus metrics.
+func observeCall(r *http.Request, caller principal, call rpcRequest, outcome string, status int, started time.Time, size int) {
+	audit.record(r, caller, call, outcome, status, started, size)
+
+	method := methodLabel(call.Method)
+	rpcRequests.inc(method, outcome, strconv.Itoa(status))
+	rpcLatency.observe(time.Since(started).Seconds(), method)
+	rpcResponseBytes.add(float64(size))
+	if strings.HasPrefix(outcome, "upstream_") {
+		upstreamErrors.inc()
+	}
+}
+
+// methodLabel keeps the method label's cardinality bounded: names the
+// gateway does not know about are all reported as "other".
+func methodLabel(method string) string {
+	method = strings.ToLower(method)
+	policy := config().policy
+	if readOnlyMethods[method] || broadcastMethods[method] ||
+		policy.allowed[method] || policy.denied[method] {
+		return method
+	}
+	return "other"
+}
+
+func boolFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// reportMetrics periodically pushes the gateway's status to Dogebox.
+func reportMetrics() {
+	ticker := time.NewTicker(30 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		submitMetrics(collectMetrics())
+		<-ticker.C
+	}
+}
+
+func collectMetrics() map[string]interface{} {
+	fingerprint := tlsFingerprint
+	if fingerprint == "" {
+		fingerprint = "TLS disabled"
+	}
+
+	subscribers := relay.stats()
+	var dropped int64
+	for _, s := range subscribers {
+		dropped += s.Dropped
+	}
+
+	metrics := map[string]interface{}{
+		"status":           map[string]interface{}{"value": "Running"},
+		"tls_fingerprint":  map[string]interface{}{"value": fingerprint},
+		"rpc_throttled":    map[string]interface{}{"value": rpcThrottled.Load()},
+		"zmq_throttled":    map[string]interface{}{"value": zmqThrottled.Load()},
+		"zmq_subscribers":  map[string]interface{}{"value": len(subscribers)},
+		"zmq_dropped":      map[string]interface{}{"value": dropped},
+		"rpc_requests":     map[string]interface{}{"value": int64(rpcRequests.total())},
+		"upstream_errors":  map[string]interface{}{"value": int64(upstreamErrors.total())},
+		"auth_failures":    map[string]interface{}{"value": int64(authFailures.total())},
+		"rejected_clients": map[string]interface{}{"value": int64(rejectedClients.total())},
+		"config_version":   map[string]interface{}{"value": config().version},
+		"config_hash":      map[string]interface{}{"value": config().hash},
+	}
+	if status, err := getElectrumStatus(); err == nil {
+		metrics["electrum_height"] = map[string]interface{}{"value": status.Height}
+		metrics["electrum_sessions"] = map[string]interface{}{"value": status.Sessions}
+	}
+	return metrics
+}
+
+// electrumStatusURL is electrum-server's pup-local status endpoint. It is
+// not listening while the Electrum server is disabled.
+const electrumStatusURL = "http://127.0.0.1:22598/status"
+
+type electrumStatus struct {
+	Height   int32 `json:"height"`
+	Sessions int   `json:"sessions"`
+}
+
+func getElectrumStatus() (*electrumStatus, error) {
+	client := &http.Client{Timeout: 2 * time.Second}
+	resp, err := client.Get(electrumStatusURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var status electrumStatus
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+func submitMetrics(jsonData map[string]interface{}) {
+	client := &http.Client{Timeout: 10 * time.Second}
+
+	marshalledData, err := json.Marshal(jsonData)
+	if err != nil {
+		log.Printf("Error marshalling metrics: %v", err)
+		return
+	}
+
+	url := fmt.Sprintf("http://%s:%s/dbx/metrics", os.Getenv("DBX_HOST"), os.Getenv("DBX_PORT"))
+
+	req, err := http.NewRequest("POST", url, bytes.NewBuffer(marshalledData))
+	if err != nil {
+		log.Printf("Error creating request: %v", err)
+		return
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		log.Printf("Error sending metrics: %v", err)
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		log.Printf("Unexpected status code when submitting metrics: %d", resp.StatusCode)
+		body, _ := io.ReadAll(resp.Body)
+		log.Printf("Response body: %s", string(body))
+	}
+}
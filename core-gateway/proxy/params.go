@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// paramKind is the JSON type a positional RPC parameter must have.
+type paramKind int
+
+const (
+	paramString paramKind = iota
+	paramHash             // 64 character hex string
+	paramHex              // even length hex string
+	paramInt
+	paramBool
+	paramVerbosity // bool, or 0, 1 or 2
+	paramArray
+	paramObject
+)
+
+func (k paramKind) String() string {
+	switch k {
+	case paramString:
+		return "a string"
+	case paramHash:
+		return "a 64 character hex string"
+	case paramHex:
+		return "a hex string"
+	case paramInt:
+		return "an integer"
+	case paramBool:
+		return "a boolean"
+	case paramVerbosity:
+		return "a boolean or 0, 1 or 2"
+	case paramArray:
+		return "an array"
+	case paramObject:
+		return "an object"
+	}
+	return "unknown"
+}
+
+type paramSpec struct {
+	name     string
+	kind     paramKind
+	optional bool
+}
+
+// methodSchema describes a method's parameters. limit, when set, caps
+// costly options for roles other than admin, returning why a call was
+// refused.
+type methodSchema struct {
+	params []paramSpec
+	limit  func(args []json.RawMessage) string
+}
+
+func requiredParam(name string, kind paramKind) paramSpec { return paramSpec{name, kind, false} }
+func optionalParam(name string, kind paramKind) paramSpec { return paramSpec{name, kind, true} }
+
+// methodSchemas covers the Dogecoin Core 1.14 methods available to the
+// readonly and broadcast roles. Methods missing from the table are passed
+// to Core unchecked.
+var methodSchemas = map[string]methodSchema{
+	"getbestblockhash":   {},
+	"getblockchaininfo":  {},
+	"getblockcount":      {},
+	"getchaintips":       {},
+	"getdifficulty":      {},
+	"getmempoolinfo":     {},
+	"getinfo":            {},
+	"getmininginfo":      {},
+	"getconnectioncount": {},
+	"getnettotals":       {},
+	"getnetworkinfo":     {},
+	"getpeerinfo":        {},
+	"getmemoryinfo":      {},
+
+	"getblock": {
+		params: []paramSpec{requiredParam("blockhash", paramHash), optionalParam("verbose", paramVerbosity)},
+		limit: func(args []json.RawMessage) string {
+			if len(args) > 1 && string(args[1]) == "2" {
+				return "verbosity 2 is limited to admins; fetch transactions with getrawtransaction instead"
+			}
+			return ""
+		},
+	},
+	"gettxoutsetinfo":       {limit: adminOnly("it scans the whole UTXO set")},
+	"getblockhash":          {params: []paramSpec{requiredParam("height", paramInt)}},
+	"getblockheader":        {params: []paramSpec{requiredParam("blockhash", paramHash), optionalParam("verbose", paramBool)}},
+	"getmempoolancestors":   {params: []paramSpec{requiredParam("txid", paramHash), optionalParam("verbose", paramBool)}},
+	"getmempooldescendants": {params: []paramSpec{requiredParam("txid", paramHash), optionalParam("verbose", paramBool)}},
+	"getmempoolentry":       {params: []paramSpec{requiredParam("txid", paramHash)}},
+	"getrawmempool": {
+		params: []paramSpec{optionalParam("verbose", paramBool)},
+		limit: func(args []json.RawMessage) string {
+			if len(args) > 0 && string(args[0]) == "true" {
+				return "verbose is limited to admins; look up entries with getmempoolentry instead"
+			}
+			return ""
+		},
+	},
+	"gettxout": {params: []paramSpec{
+		requiredParam("txid", paramHash), requiredParam("n", paramInt), optionalParam("include_mempool", paramBool)}},
+	"gettxoutproof":    {params: []paramSpec{requiredParam("txids", paramArray), optionalParam("blockhash", paramHash)}},
+	"verifytxoutproof": {params: []paramSpec{requiredParam("proof", paramHex)}},
+	"verifychain": {
+		params: []paramSpec{optionalParam("checklevel", paramInt), optionalParam("nblocks", paramInt)},
+		limit: func(args []json.RawMessage) string {
+			if len(args) > 1 {
+				if n, ok := intArg(args[1]); ok && (n <= 0 || n > maxVerifyBlocks) {
+					return fmt.Sprintf("nblocks must be between 1 and %d", maxVerifyBlocks)
+				}
+			}
+			return ""
+		},
+	},
+	"getnetworkhashps": {params: []paramSpec{optionalParam("nblocks", paramInt), optionalParam("height", paramInt)}},
+	"getrawtransaction": {params: []paramSpec{
+		requiredParam("txid", paramHash), optionalParam("verbose", paramVerbosity)}},
+	"decoderawtransaction": {params: []paramSpec{requiredParam("hexstring", paramHex)}},
+	"decodescript":         {params: []paramSpec{requiredParam("hexstring", paramHex)}},
+	"createrawtransaction": {params: []paramSpec{
+		requiredParam("inputs", paramArray), requiredParam("outputs", paramObject), optionalParam("locktime", paramInt)}},
+	"createmultisig":        {params: []paramSpec{requiredParam("nrequired", paramInt), requiredParam("keys", paramArray)}},
+	"validateaddress":       {params: []paramSpec{requiredParam("address", paramString)}},
+	"verifymessage":         {params: []paramSpec{requiredParam("address", paramString), requiredParam("signature", paramString), requiredParam("message", paramString)}},
+	"estimatefee":           {params: []paramSpec{requiredParam("nblocks", paramInt)}},
+	"estimatepriority":      {params: []paramSpec{requiredParam("nblocks", paramInt)}},
+	"estimatesmartfee":      {params: []paramSpec{requiredParam("nblocks", paramInt)}},
+	"estimatesmartpriority": {params: []paramSpec{requiredParam("nblocks", paramInt)}},
+	"help":                  {params: []paramSpec{optionalParam("command", paramString)}},
+	"sendrawtransaction": {params: []paramSpec{
+		requiredParam("hexstring", paramHex), optionalParam("allowhighfees", paramBool)}},
+
+	// Later Core releases add these scans. No role but admin is granted
+	// them today; the limits keep it that way if the method lists grow.
+	"scantxoutset": {
+		params: []paramSpec{requiredParam("action", paramString), optionalParam("scanobjects", paramArray)},
+		limit:  adminOnly("it scans the whole UTXO set"),
+	},
+	"getchaintxstats": {
+		params: []paramSpec{optionalParam("nblocks", paramInt), optionalParam("blockhash", paramHash)},
+		limit:  adminOnly("it walks back through the block index"),
+	},
+}
+
+// adminOnly is a limit refusing every call by roles other than admin.
+func adminOnly(why string) func([]json.RawMessage) string {
+	return func([]json.RawMessage) string {
+		return "limited to admins, since " + why
+	}
+}
+
+// maxVerifyBlocks caps how far back verifychain may look for roles other
+// than admin (one day of Dogecoin blocks).
+const maxVerifyBlocks = 1440
+
+// checkParams validates call's params against its schema and the
+// caller's role, returning the reason it was refused or "".
+func checkParams(role string, call rpcRequest) string {
+	method := strings.ToLower(call.Method)
+	schema, ok := methodSchemas[method]
+	if !ok {
+		return ""
+	}
+
+	args, reason := positionalArgs(schema, call.Params)
+	if reason != "" {
+		return method + ": " + reason
+	}
+	if len(args) > len(schema.params) {
+		return fmt.Sprintf("%s: takes at most %d parameters, got %d", method, len(schema.params), len(args))
+	}
+	for i, spec := range schema.params {
+		if i >= len(args) || string(args[i]) == "null" {
+			if !spec.optional {
+				return fmt.Sprintf("%s: missing required parameter %s", method, spec.name)
+			}
+			continue
+		}
+		if !kindMatches(spec.kind, args[i]) {
+			return fmt.Sprintf("%s: %s must be %s", method, spec.name, spec.kind)
+		}
+	}
+	if role != roleAdmin && schema.limit != nil {
+		if reason := schema.limit(args); reason != "" {
+			return method + ": " + reason
+		}
+	}
+	return ""
+}
+
+// positionalArgs returns params as a positional list, mapping named
+// params onto the schema's positions as Core does.
+func positionalArgs(schema methodSchema, params json.RawMessage) ([]json.RawMessage, string) {
+	params = bytes.TrimSpace(params)
+	if len(params) == 0 || string(params) == "null" {
+		return nil, ""
+	}
+	if params[0] == '[' {
+		var args []json.RawMessage
+		if err := json.Unmarshal(params, &args); err != nil {
+			return nil, "params must be an array or an object"
+		}
+		return args, ""
+	}
+	if params[0] != '{' {
+		return nil, "params must be an array or an object"
+	}
+
+	var named map[string]json.RawMessage
+	if err := json.Unmarshal(params, &named); err != nil {
+		return nil, "params must be an array or an object"
+	}
+	var args []json.RawMessage
+	for i, spec := range schema.params {
+		value, ok := named[spec.name]
+		if !ok {
+			continue
+		}
+		delete(named, spec.name)
+		for len(args) <= i {
+			args = append(args, json.RawMessage("null"))
+		}
+		args[i] = value
+	}
+	for name := range named {
+		return nil, "unknown named parameter " + name
+	}
+	return args, ""
+}
+
+func kindMatches(kind paramKind, arg json.RawMessage) bool {
+	switch kind {
+	case paramString, paramHash, paramHex:
+		var s string
+		if json.Unmarshal(arg, &s) != nil {
+			return false
+		}
+		if kind == paramHash {
+			return len(s) == 64 && isHex(s)
+		}
+		if kind == paramHex {
+			return isHex(s)
+		}
+		return true
+	case paramInt:
+		_, ok := intArg(arg)
+		return ok
+	case paramBool:
+		var b bool
+		return json.Unmarshal(arg, &b) == nil
+	case paramVerbosity:
+		var b bool
+		if json.Unmarshal(arg, &b) == nil {
+			return true
+		}
+		n, ok := intArg(arg)
+		return ok && n >= 0 && n <= 2
+	case paramArray:
+		var a []json.RawMessage
+		return json.Unmarshal(arg, &a) == nil
+	case paramObject:
+		var o map[string]json.RawMessage
+		return json.Unmarshal(arg, &o) == nil && string(arg) != "null"
+	}
+	return false
+}
+
+func intArg(arg json.RawMessage) (int64, bool) {
+	var n int64
+	if json.Unmarshal(arg, &n) != nil {
+		return 0, false
+	}
+	return n, true
+}
+
+func isHex(s string) bool {
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+// methodPolicy decides which RPC methods external clients may call.
+// When the allowlist is non-empty only those methods pass; the denylist
+// is always applied on top.
+type methodPolicy struct {
+	allowed map[string]bool
+	denied  map[string]bool
+}
+
+func newMethodPolicy(allowList, denyList string) methodPolicy {
+	return methodPolicy{
+		allowed: parseMethodList(allowList),
+		denied:  parseMethodList(denyList),
+	}
+}
+
+// parseMethodList splits a comma or whitespace separated list of method
+// names, as entered in the pup config, into a lookup set.
+func parseMethodList(list string) map[string]bool {
+	methods := map[string]bool{}
+	for _, m := range strings.FieldsFunc(list, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\n' || r == '\t'
+	}) {
+		methods[strings.ToLower(m)] = true
+	}
+	return methods
+}
+
+func (p methodPolicy) allows(method string) bool {
+	method = strings.ToLower(method)
+	if p.denied[method] {
+		return false
+	}
+	if len(p.allowed) > 0 && !p.allowed[method] {
+		return false
+	}
+	return true
+}
+
+func (p methodPolicy) String() string {
+	describe := func(set map[string]bool) string {
+		if len(set) == 0 {
+			return "(none)"
+		}
+		names := make([]string, 0, len(set))
+		for m := range set {
+			names = append(names, m)
+		}
+		sort.Strings(names)
+		return strings.Join(names, ",")
+	}
+	return "allow=" + describe(p.allowed) + " deny=" + describe(p.denied)
+}
+
+// Roles limit which RPC methods a user may call, on top of the gateway
+// wide methodPolicy.
+const (
+	roleReadOnly  = "readonly"
+	roleBroadcast = "broadcast"
+	roleAdmin     = "admin"
+)
+
+// readOnlyMethods are the Dogecoin Core 1.14 calls that only inspect
+// chain, mempool or network state.
+var readOnlyMethods = parseMethodList(`
+	getbestblockhash,getblock,getblockchaininfo,getblockcount,getblockhash,
+	getblockheader,getchaintips,getdifficulty,getmempoolancestors,
+	getmempooldescendants,getmempoolentry,getmempoolinfo,getrawmempool,
+	gettxout,gettxoutproof,gettxoutsetinfo,verifytxoutproof,verifychain,
+	getinfo,getmininginfo,getnetworkhashps,getconnectioncount,getnettotals,
+	getnetworkinfo,getpeerinfo,getmemoryinfo,getrawtransaction,
+	decoderawtransaction,decodescript,createrawtransaction,createmultisig,
+	validateaddress,verifymessage,estimatefee,estimatepriority,
+	estimatesmartfee,estimatesmartpriority,help
+`)
+
+// broadcastMethods are granted to the broadcast role in addition to the
+// read-only set.
+var broadcastMethods = parseMethodList("sendrawtransaction")
+
+func validRole(role string) bool {
+	return role == roleReadOnly || role == roleBroadcast || role == roleAdmin
+}
+
+// roleAllows reports whether role may call method. Admins may call
+// anything the gateway policy permits.
+func roleAllows(role, method string) bool {
+	method = strings.ToLower(method)
+	switch role {
+	case roleAdmin:
+		return true
+	case roleBroadcast:
+		return readOnlyMethods[method] || broadcastMethods[method]
+	case roleReadOnly:
+		return readOnlyMethods[method]
+	}
+	return false
+}
+
+// permitted combines the gateway policy with the caller's role.
+func permitted(p principal, method string) bool {
+	return config().policy.allows(method) && roleAllows(p.role, method)
+}
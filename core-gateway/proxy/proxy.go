@@ -1,70 +1,175 @@
 package main
 
 import (
-	"encoding/base64"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
 	"io"
 	"log"
 	"net"
 	"net/http"
 	"os"
-	"strings"
-	"sync"
+	"path/filepath"
+	"strconv"
+	"time"
 )
 
+var storageDirectory string
+
 var (
 	pupIP       string
-	rpcUsername string
-	rpcPassword string
 	rpcUpstream string
 	zmqUpstream string
-	coreAuth    string
+	rpcTLS      *tls.Config
 )
 
 func main() {
 	pupIP = os.Getenv("DBX_PUP_IP")
-	rpcUsername = os.Getenv("RPC_USERNAME")
-	rpcPassword = os.Getenv("RPC_PASSWORD")
 
 	rpcUpstream = "http://" + os.Getenv("DBX_IFACE_CORE_RPC_HOST") + ":" + os.Getenv("DBX_IFACE_CORE_RPC_PORT")
 	zmqUpstream = os.Getenv("DBX_IFACE_CORE_ZMQ_HOST") + ":" + os.Getenv("DBX_IFACE_CORE_ZMQ_PORT")
 
-	// Pre-compute Core's auth header
-	coreAuth = "Basic " + base64.StdEncoding.EncodeToString(
-		[]byte("dogebox_core_pup_temporary_static_username:dogebox_core_pup_temporary_static_password"),
-	)
-
 	log.Printf("Dogecoin Core Gateway Proxy starting...")
 	log.Printf("  RPC Upstream: %s", rpcUpstream)
 	log.Printf("  ZMQ Upstream: %s", zmqUpstream)
 
-	var wg sync.WaitGroup
+	if err := loadConfig(storageDirectory); err != nil {
+		log.Fatalf("Failed to load config: %v", err)
+	}
+	cfg := config()
+	log.Printf("  RPC Method Policy: %s", cfg.policy)
+	log.Printf("  Allowed Clients: %s", cfg.allowlist)
+	log.Printf("  Config: %s (hash %s)", configPath, cfg.hash)
 
-	wg.Add(2)
-	go func() {
-		defer wg.Done()
-		startRPCProxy()
-	}()
+	var err error
+	users, err = loadUserStore(filepath.Join(storageDirectory, "users.json"))
+	if err != nil {
+		log.Fatalf("Failed to load users: %v", err)
+	}
+	log.Printf("  Users: %d configured", users.count())
 
-	go func() {
-		defer wg.Done()
-		startZMQProxy()
-	}()
+	tokens, err = loadTokenStore(filepath.Join(storageDirectory, "tokens.json"))
+	if err != nil {
+		log.Fatalf("Failed to load API tokens: %v", err)
+	}
+	log.Printf("  API Tokens: %d configured", tokens.count())
+
+	if enabled, _ := strconv.ParseBool(os.Getenv("RPC_TLS_ENABLED")); enabled {
+		rpcTLS, tlsFingerprint, err = loadTLSConfig(
+			os.Getenv("RPC_TLS_CERT"), os.Getenv("RPC_TLS_KEY"), os.Getenv("RPC_TLS_CLIENT_CA"))
+		if err != nil {
+			log.Fatalf("Failed to set up TLS: %v", err)
+		}
+		log.Printf("  TLS Fingerprint (SHA-256): %s", tlsFingerprint)
+	}
+
+	if err := openTraffic(filepath.Join(storageDirectory, "recordings")); err != nil {
+		log.Fatalf("Failed to set up traffic recording: %v", err)
+	}
+	setupCoreAuth(storageDirectory)
+	go maintainCoreAuth()
+
+	relay = newZMQRelay(zmqUpstream)
+
+	if size := int(envFloat("CACHE_ENTRIES", 0)); size > 0 {
+		diskDir := ""
+		if enabled, _ := strconv.ParseBool(os.Getenv("CACHE_DISK_ENABLED")); enabled {
+			diskDir = filepath.Join(storageDirectory, "cache")
+		}
+		cache = newResponseCache(size, int64(envFloat("CACHE_MIN_CONFIRMATIONS", 10)),
+			diskDir, int(envFloat("CACHE_DISK_ENTRIES", 0)))
+		log.Printf("  Response Cache: %d entries, %d confirmations deep", size, cache.minConf)
+
+		go func() {
+			if err := cache.refreshTip(); err != nil {
+				log.Printf("Cache: failed to fetch initial tip: %v", err)
+			}
+		}()
+	}
 
-	wg.Wait()
+	relay.onMessage(func(parts [][]byte) {
+		if len(parts) >= 2 && string(parts[0]) == "hashblock" {
+			hash := hex.EncodeToString(parts[1])
+			go cache.onBlock(hash)
+			go feed.announce(hash)
+		}
+	})
+	if replayer != nil {
+		go replayer.playZMQ(relay)
+	} else {
+		go relay.run()
+	}
+
+	if enabled, err := strconv.ParseBool(os.Getenv("AUDIT_ENABLED")); err != nil || enabled {
+		audit, err = openAuditLog(filepath.Join(storageDirectory, "audit"),
+			int64(envFloat("AUDIT_MAX_SIZE_MB", 10)*1024*1024),
+			time.Duration(envFloat("AUDIT_RETENTION_DAYS", 30)*24)*time.Hour)
+		if err != nil {
+			log.Fatalf("Failed to open audit log: %v", err)
+		}
+		log.Printf("  Audit Log: %s", audit.dir)
+	}
+
+	log.Printf("  Upstream Timeouts: %s (slow methods %s)", cfg.rpcTimeout, cfg.rpcSlowTimeout)
+	if cfg.restEnabled {
+		log.Printf("  REST API: enabled (public: %t)", cfg.restPublic)
+	}
+	if cfg.zmqRequireAuth {
+		log.Printf("  ZMQ Authentication: required")
+	}
+
+	shutdownTimeout := envSeconds("SHUTDOWN_TIMEOUT", 20)
+
+	go watchConfig()
+	go reportMetrics()
+	startMetricsServer()
+	startRPCProxy()
+	startZMQProxy()
+
+	sig := waitForSignal()
+	log.Printf("Received %s, shutting down (waiting up to %s for open requests)", sig, shutdownTimeout)
+	shutdown(shutdownTimeout)
+	log.Printf("Shutdown complete")
 }
 
 func startRPCProxy() {
 	listenAddr := pupIP + ":22555"
 	log.Printf("RPC Proxy listening on %s -> %s", listenAddr, rpcUpstream)
 
-	if rpcUsername != "" && rpcPassword != "" {
+	if authEnabled() {
 		log.Printf("RPC Authentication: enabled")
 	} else {
 		log.Printf("RPC Authentication: disabled (no credentials configured)")
 	}
 
 	http.HandleFunc("/", rpcProxyHandler)
-	log.Fatal(http.ListenAndServe(listenAddr, nil))
+	http.HandleFunc("/admin/users", usersAdminHandler)
+	http.HandleFunc("/admin/users/", usersAdminHandler)
+	http.HandleFunc("/admin/tokens", tokensAdminHandler)
+	http.HandleFunc("/admin/tokens/", tokensAdminHandler)
+	http.HandleFunc("/admin/zmq", zmqAdminHandler)
+	http.HandleFunc("/admin/audit", auditAdminHandler)
+	http.HandleFunc("/events/blocks", sseHandler)
+	http.HandleFunc("/ws/blocks", wsHandler)
+	http.HandleFunc("/rest/", restHandler)
+
+	rpcServer = &http.Server{
+		Addr:      listenAddr,
+		Handler:   allowlistHandler("rpc", http.DefaultServeMux),
+		TLSConfig: rpcTLS,
+	}
+	go func() {
+		var err error
+		if rpcTLS != nil {
+			log.Printf("RPC TLS: enabled")
+			err = rpcServer.ListenAndServeTLS("", "")
+		} else {
+			err = rpcServer.ListenAndServe()
+		}
+		if err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
 }
 
 func startZMQProxy() {
@@ -75,15 +180,40 @@ func startZMQProxy() {
 	if err != nil {
 		log.Fatalf("Failed to start ZMQ listener: %v", err)
 	}
-	defer listener.Close()
+	zmqListener = listener
+	go acceptZMQ(listener)
+}
 
+func acceptZMQ(listener net.Listener) {
 	for {
 		clientConn, err := listener.Accept()
 		if err != nil {
+			select {
+			case <-stopping:
+				return
+			default:
+			}
 			log.Printf("ZMQ accept error: %v", err)
 			continue
 		}
-		go handleZMQConnection(clientConn)
+		if !config().allowlist.allows(clientConn.RemoteAddr().String()) {
+			log.Printf("ZMQ connection from %s rejected: address not in allowlist", clientConn.RemoteAddr())
+			rejectedClients.inc("zmq")
+			clientConn.Close()
+			continue
+		}
+		if !zmqSlots.tryAcquire() {
+			log.Printf("ZMQ connection from %s rejected: connection limit reached", clientConn.RemoteAddr())
+			zmqThrottled.Add(1)
+			clientConn.Close()
+			continue
+		}
+		zmqConns.Add(1)
+		go func() {
+			defer zmqConns.Done()
+			defer zmqSlots.release()
+			handleZMQConnection(clientConn)
+		}()
 	}
 }
 
@@ -91,93 +221,111 @@ func handleZMQConnection(clientConn net.Conn) {
 	defer clientConn.Close()
 
 	log.Printf("ZMQ connection from %s", clientConn.RemoteAddr())
-
-	upstreamConn, err := net.Dial("tcp", zmqUpstream)
-	if err != nil {
-		log.Printf("Failed to connect to ZMQ upstream: %v", err)
-		return
-	}
-	defer upstreamConn.Close()
-
-	// Bidirectional copy
-	var wg sync.WaitGroup
-	wg.Add(2)
-
-	go func() {
-		defer wg.Done()
-		io.Copy(upstreamConn, clientConn)
-		upstreamConn.(*net.TCPConn).CloseWrite()
-	}()
-
-	go func() {
-		defer wg.Done()
-		io.Copy(clientConn, upstreamConn)
-		clientConn.(*net.TCPConn).CloseWrite()
-	}()
-
-	wg.Wait()
-	log.Printf("ZMQ connection from %s closed", clientConn.RemoteAddr())
+	relay.serve(clientConn)
 }
 
 func rpcProxyHandler(w http.ResponseWriter, r *http.Request) {
 	log.Printf("RPC Request: %s %s from %s", r.Method, r.URL.Path, r.RemoteAddr)
+	started := time.Now()
+
+	if !ipLimiter.allow(clientIP(r.RemoteAddr), 1) {
+		log.Printf("RPC request from %s throttled: rate limit", r.RemoteAddr)
+		writeThrottled(w, "Rate limit exceeded")
+		return
+	}
+	if !rpcSlots.tryAcquire() {
+		log.Printf("RPC request from %s throttled: too many concurrent requests", r.RemoteAddr)
+		writeThrottled(w, "Too many concurrent requests")
+		return
+	}
+	defer rpcSlots.release()
 
 	// Validate incoming auth only if credentials are configured
-	if rpcUsername != "" && rpcPassword != "" {
-		auth := r.Header.Get("Authorization")
-		if !validateAuth(auth) {
-			w.Header().Set("WWW-Authenticate", `Basic realm="Dogecoin RPC"`)
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	caller, ok := requireAuth(w, r)
+	if !ok {
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, config().maxRequestBytes))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeRPCError(w, http.StatusRequestEntityTooLarge, nil, rpcErrInvalidRequest, "Request exceeds the gateway's size limit")
 			return
 		}
+		http.Error(w, "Failed to read request", http.StatusBadRequest)
+		return
+	}
+
+	if isBatch(body) {
+		handleBatch(w, r, caller, body, started)
+		return
 	}
 
-	// Create upstream request
-	proxyReq, err := http.NewRequest(r.Method, rpcUpstream+r.URL.Path, r.Body)
+	// Enforce the method policy before anything reaches Core
+	call, err := parseRPCRequest(body)
 	if err != nil {
-		http.Error(w, "Failed to create request", http.StatusInternalServerError)
+		writeParseError(w, err)
+		return
+	}
+	if !permitted(caller, call.Method) {
+		log.Printf("RPC method %q rejected for %s (%s)", call.Method, r.RemoteAddr, caller.role)
+		n := writeRPCError(w, http.StatusForbidden, call.ID, rpcErrForbidden,
+			"Method '"+call.Method+"' is not permitted by the gateway")
+		observeCall(r, caller, call, "denied", http.StatusForbidden, started, n)
+		return
+	}
+	if reason := checkParams(caller.role, call); reason != "" {
+		log.Printf("RPC call %q from %s has invalid params: %s", call.Method, r.RemoteAddr, reason)
+		n := writeRPCError(w, http.StatusBadRequest, call.ID, rpcErrInvalidParams, "Invalid params: "+reason)
+		observeCall(r, caller, call, "invalid_params", http.StatusBadRequest, started, n)
+		return
+	}
+	if !allowUser(caller, 1) {
+		log.Printf("RPC request from user %q throttled: rate limit", caller.name)
+		n := writeThrottled(w, "Rate limit exceeded")
+		observeCall(r, caller, call, "throttled", http.StatusTooManyRequests, started, n)
 		return
 	}
 
-	// Copy headers, replace auth with Core's credentials
-	for key, values := range r.Header {
-		for _, value := range values {
-			proxyReq.Header.Add(key, value)
-		}
+	if reply, ok := cache.lookup(call); ok {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(reply)
+		observeCall(r, caller, call, "cached", http.StatusOK, started, len(reply))
+		return
 	}
-	proxyReq.Header.Set("Authorization", coreAuth)
 
-	// Forward request
-	client := &http.Client{}
-	resp, err := client.Do(proxyReq)
+	resp, err := forwardRPC(r, body, callTimeout(call.Method, call.Params))
 	if err != nil {
-		log.Printf("Upstream request failed: %v", err)
-		http.Error(w, "Upstream error", http.StatusBadGateway)
+		log.Printf("Upstream request for %s failed: %v", call.Method, err)
+		outcome, status, n := writeUpstreamError(w, call.ID, err)
+		observeCall(r, caller, call, outcome, status, started, n)
 		return
 	}
-	defer resp.Body.Close()
 
 	// Copy response headers
-	for key, values := range resp.Header {
+	for key, values := range resp.header {
 		for _, value := range values {
 			w.Header().Add(key, value)
 		}
 	}
-	w.WriteHeader(resp.StatusCode)
-	io.Copy(w, resp.Body)
-}
+	w.WriteHeader(resp.status)
+	w.Write(resp.body)
 
-func validateAuth(auth string) bool {
-	if !strings.HasPrefix(auth, "Basic ") {
-		return false
-	}
-	decoded, err := base64.StdEncoding.DecodeString(auth[6:])
-	if err != nil {
-		return false
+	if resp.status == http.StatusOK {
+		cache.store(call, resp.body)
 	}
-	parts := strings.SplitN(string(decoded), ":", 2)
-	if len(parts) != 2 {
-		return false
-	}
-	return parts[0] == rpcUsername && parts[1] == rpcPassword
+	observeCall(r, caller, call, "forwarded", resp.status, started, len(resp.body))
+}
+
+// envFloat reads a numeric pup config value, falling back to def when it
+// is unset or malformed.
+func envFloat(name string, def float64) float64 {
+	return parseFloatSetting(name, os.Getenv(name), def)
+}
+
+// envSeconds reads a duration given in seconds in the pup config.
+func envSeconds(name string, def float64) time.Duration {
+	return time.Duration(envFloat(name, def) * float64(time.Second))
 }
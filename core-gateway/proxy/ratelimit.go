@@ -0,0 +1,149 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ipLimiter   = newRateLimiter()
+	userLimiter = newRateLimiter()
+	rpcSlots    = &connSlots{}
+	zmqSlots    = &connSlots{}
+
+	rpcThrottled atomic.Int64
+	zmqThrottled atomic.Int64
+)
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter is a keyed token bucket: each key refills at rate tokens
+// per second up to burst. A limiter with no rate allows everything.
+type rateLimiter struct {
+	mu      sync.Mutex
+	rate    float64
+	burst   float64
+	buckets map[string]*tokenBucket
+}
+
+func newRateLimiter() *rateLimiter {
+	l := &rateLimiter{buckets: map[string]*tokenBucket{}}
+	go l.prune()
+	return l
+}
+
+// setLimits changes the refill rate and burst for every key. A rate of
+// zero or less turns the limit off.
+func (l *rateLimiter) setLimits(rate, burst float64) {
+	if burst < 1 {
+		burst = rate
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rate, l.burst = rate, burst
+}
+
+// allow takes n tokens from key's bucket, reporting whether there were
+// enough.
+func (l *rateLimiter) allow(key string, n int) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.rate <= 0 {
+		return true
+	}
+
+	now := time.Now()
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * l.rate
+	if b.tokens > l.burst {
+		b.tokens = l.burst
+	}
+	b.last = now
+
+	if b.tokens < float64(n) {
+		return false
+	}
+	b.tokens -= float64(n)
+	return true
+}
+
+// prune drops buckets that have been idle long enough to be full again,
+// so the map does not grow with every client ever seen.
+func (l *rateLimiter) prune() {
+	for range time.Tick(time.Minute) {
+		l.mu.Lock()
+		for key, b := range l.buckets {
+			if l.rate <= 0 || time.Since(b.last).Seconds()*l.rate >= l.burst {
+				delete(l.buckets, key)
+			}
+		}
+		l.mu.Unlock()
+	}
+}
+
+// connSlots caps how many requests or connections are handled at once.
+// A limit of zero or less means no limit. Lowering the limit leaves
+// existing holders alone; new ones are refused until enough have left.
+type connSlots struct {
+	mu    sync.Mutex
+	used  int
+	limit int
+}
+
+func (s *connSlots) setLimit(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.limit = n
+}
+
+// tryAcquire takes a slot without blocking.
+func (s *connSlots) tryAcquire() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.limit > 0 && s.used >= s.limit {
+		return false
+	}
+	s.used++
+	return true
+}
+
+func (s *connSlots) release() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.used--
+}
+
+func clientIP(remoteAddr string) string {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return remoteAddr
+	}
+	return host
+}
+
+// writeThrottled rejects an over-limit request with HTTP 429 and a
+// JSON-RPC error body.
+func writeThrottled(w http.ResponseWriter, message string) int {
+	rpcThrottled.Add(1)
+	w.Header().Set("Retry-After", "1")
+	return writeRPCError(w, http.StatusTooManyRequests, nil, rpcErrRateLimited, message)
+}
+
+// allowUser charges n calls against an authenticated user's bucket.
+// Anonymous callers are covered by the per-IP limit alone.
+func allowUser(p principal, n int) bool {
+	if p.name == "" {
+		return true
+	}
+	return userLimiter.allow(p.name, n)
+}
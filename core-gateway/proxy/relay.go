@@ -0,0 +1,410 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const zmqSubscriberQueue = 1024
+
+// zmqWriteTimeout is how long a subscriber may take to accept a frame
+// before it is dropped.
+const zmqWriteTimeout = 30 * time.Second
+
+// zmqRelay keeps a single SUB connection to Core's ZMQ publisher and fans
+// every message out to the downstream subscribers whose topic filters
+// match, so Core only ever serves one publisher session.
+type zmqRelay struct {
+	upstream string
+
+	mu           sync.Mutex
+	subscribers  map[*zmqSubscriber]struct{}
+	listeners    []func(parts [][]byte)
+	upstreamConn net.Conn
+	done         chan struct{}
+
+	connected atomic.Bool
+	received  atomic.Int64
+}
+
+// zmqSubscriber is one downstream client speaking ZMTP to the gateway.
+type zmqSubscriber struct {
+	conn   *zmtpConn
+	remote string
+	queue  chan [][]byte
+
+	mu     sync.Mutex
+	topics [][]byte
+
+	sent    atomic.Int64
+	dropped atomic.Int64
+}
+
+type zmqSubscriberStats struct {
+	Remote  string   `json:"remote"`
+	Topics  []string `json:"topics"`
+	Sent    int64    `json:"sent"`
+	Dropped int64    `json:"dropped"`
+}
+
+var relay *zmqRelay
+
+func newZMQRelay(upstream string) *zmqRelay {
+	return &zmqRelay{
+		upstream:    upstream,
+		subscribers: map[*zmqSubscriber]struct{}{},
+		done:        make(chan struct{}),
+	}
+}
+
+// onMessage registers fn to see every upstream message, for gateway
+// features that need to follow the chain themselves.
+func (z *zmqRelay) onMessage(fn func(parts [][]byte)) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	z.listeners = append(z.listeners, fn)
+}
+
+// run keeps the upstream subscription alive, reconnecting with backoff,
+// until the relay is closed.
+func (z *zmqRelay) run() {
+	backoff := time.Second
+	for {
+		started := time.Now()
+		err := z.subscribeUpstream()
+		z.connected.Store(false)
+		select {
+		case <-z.done:
+			return
+		default:
+		}
+		if time.Since(started) > time.Minute {
+			backoff = time.Second
+		}
+		log.Printf("ZMQ upstream %s disconnected: %v (retrying in %s)", z.upstream, err, backoff)
+		select {
+		case <-z.done:
+			return
+		case <-time.After(backoff):
+		}
+		if backoff < time.Minute {
+			backoff *= 2
+		}
+	}
+}
+
+func (z *zmqRelay) subscribeUpstream() error {
+	conn, err := net.DialTimeout("tcp", z.upstream, 10*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	z.mu.Lock()
+	select {
+	case <-z.done:
+		z.mu.Unlock()
+		return errors.New("relay closed")
+	default:
+	}
+	z.upstreamConn = conn
+	z.mu.Unlock()
+
+	c, _, err := zmtpHandshake(conn, "SUB", false)
+	if err != nil {
+		return err
+	}
+	// Core only publishes the topics it was configured with, so take
+	// everything and filter per subscriber.
+	if err := c.subscribe(""); err != nil {
+		return err
+	}
+	z.connected.Store(true)
+	log.Printf("ZMQ relay subscribed to %s", z.upstream)
+
+	for {
+		parts, err := c.readMessage()
+		if err != nil {
+			return err
+		}
+		z.received.Add(1)
+		recorder.recordZMQ(parts)
+		z.publish(parts)
+	}
+}
+
+// close drops the upstream subscription and ends every subscriber's
+// session once the messages already queued for it have been sent.
+func (z *zmqRelay) close() {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+
+	select {
+	case <-z.done:
+		return
+	default:
+	}
+	close(z.done)
+	if z.upstreamConn != nil {
+		z.upstreamConn.Close()
+	}
+	for s := range z.subscribers {
+		// Unblocks readLoop; serve then flushes the queue
+		s.conn.conn.SetReadDeadline(time.Now())
+	}
+}
+
+func (z *zmqRelay) publish(parts [][]byte) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+
+	for _, fn := range z.listeners {
+		fn(parts)
+	}
+	for s := range z.subscribers {
+		if !s.wants(parts[0]) {
+			continue
+		}
+		select {
+		case s.queue <- parts:
+		default:
+			s.dropped.Add(1)
+		}
+	}
+}
+
+func (z *zmqRelay) add(s *zmqSubscriber) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	z.subscribers[s] = struct{}{}
+	select {
+	case <-z.done:
+		s.conn.conn.SetReadDeadline(time.Now())
+	default:
+	}
+}
+
+func (z *zmqRelay) remove(s *zmqSubscriber) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	delete(z.subscribers, s)
+}
+
+func (z *zmqRelay) stats() []zmqSubscriberStats {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+
+	out := make([]zmqSubscriberStats, 0, len(z.subscribers))
+	for s := range z.subscribers {
+		out = append(out, s.stats())
+	}
+	return out
+}
+
+// serve runs the ZMTP PUB side of a downstream connection until the
+// client goes away.
+func (z *zmqRelay) serve(clientConn net.Conn) {
+	c, props, err := zmtpAccept(clientConn, "PUB", zmqAuthorizer(clientConn.RemoteAddr()))
+	if err != nil {
+		log.Printf("ZMQ handshake with %s failed: %v", clientConn.RemoteAddr(), err)
+		return
+	}
+	if t := props["Socket-Type"]; t != "SUB" && t != "XSUB" {
+		log.Printf("ZMQ client %s is a %s socket, expected SUB", clientConn.RemoteAddr(), t)
+		return
+	}
+
+	c.writeTimeout = zmqWriteTimeout
+
+	s := &zmqSubscriber{
+		conn:   c,
+		remote: clientConn.RemoteAddr().String(),
+		queue:  make(chan [][]byte, zmqSubscriberQueue),
+	}
+	z.add(s)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.writeLoop()
+	}()
+
+	err = s.readLoop()
+	select {
+	case <-z.done:
+		err = errors.New("relay closed")
+	default:
+	}
+	z.remove(s)
+	close(s.queue)
+	<-done
+
+	st := s.stats()
+	log.Printf("ZMQ subscriber %s closed (%v): sent=%d dropped=%d", st.Remote, err, st.Sent, st.Dropped)
+}
+
+// zmqAuthorizer checks the credentials a ZMQ client logs in with: a
+// username and password as for RPC, or an API token with the zmq scope
+// as the PLAIN password. The same lockouts as RPC logins apply.
+func zmqAuthorizer(remote net.Addr) func(mechanism, username, password string) error {
+	ip := clientIP(remote.String())
+	return func(mechanism, username, password string) error {
+		if !authEnabled() {
+			return nil
+		}
+		if mechanism == "NULL" {
+			if config().zmqRequireAuth {
+				return errors.New("credentials required")
+			}
+			return nil
+		}
+		if wait, locked := ipLockout.locked(ip); locked {
+			return fmt.Errorf("too many failed logins, retry in %s", wait.Round(time.Second))
+		}
+		if wait, locked := userLockout.locked(username); locked {
+			return fmt.Errorf("too many failed logins, retry in %s", wait.Round(time.Second))
+		}
+
+		var p principal
+		var ok bool
+		if strings.HasPrefix(password, tokenPrefix) {
+			p, ok = tokens.authenticate(password)
+		} else {
+			p, ok = validatePassword(username, password)
+		}
+		if !ok {
+			authFailures.inc()
+			ipLockout.fail(ip)
+			userLockout.fail(username)
+			log.Printf("ZMQ authentication failed for %q from %s", username, remote)
+			return errors.New("invalid credentials")
+		}
+		ipLockout.succeed(ip)
+		userLockout.succeed(username)
+		if !p.allows(scopeZMQ) {
+			return errors.New("token does not have the zmq scope")
+		}
+		return nil
+	}
+}
+
+// readLoop handles the subscriber's side of the conversation, which is
+// only ever subscription changes and heartbeats.
+func (s *zmqSubscriber) readLoop() error {
+	for {
+		flags, body, err := s.conn.readFrame()
+		if err != nil {
+			return err
+		}
+		if flags&zmtpFlagCommand != 0 {
+			if len(body) < 1 || len(body) < 1+int(body[0]) {
+				continue
+			}
+			name, data := string(body[1:1+int(body[0])]), body[1+int(body[0]):]
+			switch name {
+			case "SUBSCRIBE":
+				s.subscribe(data)
+			case "CANCEL":
+				s.cancel(data)
+			case "PING":
+				if len(data) >= 2 {
+					s.conn.writeCommand("PONG", data[2:])
+				}
+			}
+			continue
+		}
+		// ZMTP 3.0 subscriptions are messages starting with 1 or 0
+		if len(body) > 0 {
+			switch body[0] {
+			case 1:
+				s.subscribe(body[1:])
+			case 0:
+				s.cancel(body[1:])
+			}
+		}
+	}
+}
+
+func (s *zmqSubscriber) writeLoop() {
+	for parts := range s.queue {
+		if err := s.conn.writeMessage(parts); err != nil {
+			log.Printf("ZMQ subscriber %s dropped: %v", s.remote, err)
+			// Let readLoop notice the broken connection and clean up
+			s.conn.conn.Close()
+			for range s.queue {
+			}
+			return
+		}
+		s.sent.Add(1)
+		for _, part := range parts {
+			zmqRelayedBytes.add(float64(len(part)))
+		}
+	}
+}
+
+func (s *zmqSubscriber) subscribe(topic []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.topics = append(s.topics, append([]byte(nil), topic...))
+	log.Printf("ZMQ subscriber %s subscribed to %q", s.remote, topic)
+}
+
+func (s *zmqSubscriber) cancel(topic []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, t := range s.topics {
+		if bytes.Equal(t, topic) {
+			s.topics = append(s.topics[:i], s.topics[i+1:]...)
+			return
+		}
+	}
+}
+
+// wants reports whether any of the subscriber's filters is a prefix of
+// topic, which is how ZMQ matches subscriptions.
+func (s *zmqSubscriber) wants(topic []byte) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, t := range s.topics {
+		if bytes.HasPrefix(topic, t) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *zmqSubscriber) stats() zmqSubscriberStats {
+	s.mu.Lock()
+	topics := make([]string, len(s.topics))
+	for i, t := range s.topics {
+		topics[i] = string(t)
+	}
+	s.mu.Unlock()
+	return zmqSubscriberStats{
+		Remote:  s.remote,
+		Topics:  topics,
+		Sent:    s.sent.Load(),
+		Dropped: s.dropped.Load(),
+	}
+}
+
+// zmqAdminHandler reports per-subscriber message and drop counts.
+func zmqAdminHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"upstream":    relay.upstream,
+		"connected":   relay.connected.Load(),
+		"received":    relay.received.Load(),
+		"subscribers": relay.stats(),
+	})
+}
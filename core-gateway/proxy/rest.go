@@ -0,0 +1,349 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// restMaxHeaders caps /rest/headers, below the 2000 Core's own REST
+	// interface allows, since the API may be public.
+	restMaxHeaders = 500
+	// restHeadersPerToken is how many headers one rate limit token buys.
+	// They are fetched in a single batch, which costs Core far less than
+	// a request each.
+	restHeadersPerToken = 20
+)
+
+// Core's error code for unknown blocks and transactions.
+const coreErrNotFound = -5
+
+// restHandler serves a read-only REST API in the style of Core's
+// -rest interface, translating each path into the matching RPC calls:
+//
+//	GET /rest/block/<hash>.<json|hex>
+//	GET /rest/block/notxdetails/<hash>.<json|hex>
+//	GET /rest/tx/<txid>.<json|hex>
+//	GET /rest/chaininfo.json
+//	GET /rest/headers/<count>/<hash>.<json|hex>
+//
+// The RPC method policy does not apply here; the REST API has its own
+// on/off and public settings so it can be offered without RPC.
+func restHandler(w http.ResponseWriter, r *http.Request) {
+	log.Printf("REST Request: %s %s from %s", r.Method, r.URL.Path, r.RemoteAddr)
+	started := time.Now()
+
+	// The REST API is off unless enabled, and needs the same credentials
+	// as RPC unless made public.
+	cfg := config()
+	if !cfg.restEnabled {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	cost := restCost(r.URL.Path)
+	if !ipLimiter.allow(clientIP(r.RemoteAddr), cost) {
+		log.Printf("REST request from %s throttled: rate limit", r.RemoteAddr)
+		writeThrottled(w, "Rate limit exceeded")
+		return
+	}
+	if !rpcSlots.tryAcquire() {
+		log.Printf("REST request from %s throttled: too many concurrent requests", r.RemoteAddr)
+		writeThrottled(w, "Too many concurrent requests")
+		return
+	}
+	defer rpcSlots.release()
+
+	caller := principal{}
+	if !cfg.restPublic {
+		var ok bool
+		if caller, ok = requireAuth(w, r); !ok {
+			return
+		}
+		if !caller.allows(scopeREST) {
+			http.Error(w, "Token does not have the rest scope", http.StatusForbidden)
+			return
+		}
+		if !allowUser(caller, cost) {
+			log.Printf("REST request from user %q throttled: rate limit", caller.name)
+			writeThrottled(w, "Rate limit exceeded")
+			return
+		}
+	}
+
+	path, format := restFormat(strings.TrimPrefix(r.URL.Path, "/rest/"))
+	parts := strings.Split(path, "/")
+	switch {
+	case len(parts) == 2 && parts[0] == "block":
+		// Like Core, the JSON form includes every transaction in full
+		restObject(w, r, caller, started, format, "getblock", parts[1], 2)
+	case len(parts) == 3 && parts[0] == "block" && parts[1] == "notxdetails":
+		restObject(w, r, caller, started, format, "getblock", parts[2], true)
+	case len(parts) == 2 && parts[0] == "tx":
+		restObject(w, r, caller, started, format, "getrawtransaction", parts[1], true)
+	case len(parts) == 1 && parts[0] == "chaininfo":
+		restChainInfo(w, r, caller, started, format)
+	case len(parts) == 3 && parts[0] == "headers":
+		restHeaders(w, r, caller, started, format, parts[1], parts[2])
+	default:
+		http.Error(w, "Invalid URI format. Expected /rest/<block|tx>/<hash>.<ext>, /rest/block/notxdetails/<hash>.<ext>, /rest/chaininfo.json or /rest/headers/<count>/<hash>.<ext>", http.StatusBadRequest)
+	}
+}
+
+// restCost is how many rate limit tokens a REST path is charged: one,
+// or for /rest/headers one per restHeadersPerToken headers asked for.
+// Counts that are out of range are refused later, so cost one.
+func restCost(path string) int {
+	parts := strings.Split(strings.TrimPrefix(path, "/rest/"), "/")
+	if len(parts) != 3 || parts[0] != "headers" {
+		return 1
+	}
+	count, err := strconv.Atoi(parts[1])
+	if err != nil || count < 1 || count > restMaxHeaders {
+		return 1
+	}
+	return (count + restHeadersPerToken - 1) / restHeadersPerToken
+}
+
+// restFormat splits the output format off the end of a path, the way
+// Core does: everything after the last dot.
+func restFormat(path string) (string, string) {
+	i := strings.LastIndex(path, ".")
+	if i < 0 || strings.Contains(path[i:], "/") {
+		return path, ""
+	}
+	return path[:i], path[i+1:]
+}
+
+// restObject answers /rest/block and /rest/tx, which map onto a single
+// RPC call: with verbose as the verbosity for JSON, or raw for hex.
+func restObject(w http.ResponseWriter, r *http.Request, caller principal, started time.Time, format, method, hash string, verbose interface{}) {
+	if !validHash(hash) {
+		http.Error(w, "Invalid hash: "+hash, http.StatusBadRequest)
+		return
+	}
+	if format != "json" && format != "hex" {
+		http.Error(w, "output format not found (available: json, hex)", http.StatusNotFound)
+		return
+	}
+
+	if format == "hex" {
+		verbose = false
+	}
+	call := restRequest(method, hash, verbose)
+	result, err := restCall(call)
+	if err != nil {
+		writeRESTError(w, r, caller, call, started, hash, err)
+		return
+	}
+	writeRESTResult(w, r, caller, call, started, format, result)
+}
+
+func restChainInfo(w http.ResponseWriter, r *http.Request, caller principal, started time.Time, format string) {
+	if format != "json" {
+		http.Error(w, "output format not found (available: json)", http.StatusNotFound)
+		return
+	}
+
+	call := restRequest("getblockchaininfo")
+	result, err := restCall(call)
+	if err != nil {
+		writeRESTError(w, r, caller, call, started, "", err)
+		return
+	}
+	writeRESTResult(w, r, caller, call, started, format, result)
+}
+
+// restHeaders answers /rest/headers with the headers of the active chain
+// from the given block on. Like Core, a block that is unknown or not on
+// the active chain gives an empty list rather than an error. However many
+// headers are asked for, Core is called three times: for the first
+// header, then in one batch each for the hashes and headers after it.
+func restHeaders(w http.ResponseWriter, r *http.Request, caller principal, started time.Time, format, countParam, hash string) {
+	count, err := strconv.Atoi(countParam)
+	if err != nil || count < 1 || count > restMaxHeaders {
+		http.Error(w, "Header count out of range: "+countParam, http.StatusBadRequest)
+		return
+	}
+	if !validHash(hash) {
+		http.Error(w, "Invalid hash: "+hash, http.StatusBadRequest)
+		return
+	}
+	if format != "json" && format != "hex" {
+		http.Error(w, "output format not found (available: json, hex)", http.StatusNotFound)
+		return
+	}
+
+	first := restRequest("getblockheader", hash, true)
+	result, err := restCall(first)
+	var rpcErr *rpcError
+	if err != nil && !(errors.As(err, &rpcErr) && rpcErr.Code == coreErrNotFound) {
+		writeRESTError(w, r, caller, first, started, hash, err)
+		return
+	}
+	var header struct {
+		Height        int64 `json:"height"`
+		Confirmations int64 `json:"confirmations"`
+	}
+	if err == nil {
+		if err := json.Unmarshal(result, &header); err != nil {
+			writeRESTError(w, r, caller, first, started, hash, err)
+			return
+		}
+	}
+	// Confirmations counts the blocks from this one to the tip, so it is
+	// also how many headers there are to return.
+	n := int(header.Confirmations)
+	if n > count {
+		n = count
+	}
+
+	hashes := []string{}
+	if n > 0 {
+		hashes = append(hashes, hash)
+	}
+	if n > 1 {
+		heights := make([][]interface{}, n-1)
+		for i := range heights {
+			heights[i] = []interface{}{header.Height + 1 + int64(i)}
+		}
+		results, err := coreBatch("getblockhash", heights)
+		if err != nil {
+			writeRESTError(w, r, caller, first, started, hash, err)
+			return
+		}
+		for _, result := range results {
+			var next string
+			if err := json.Unmarshal(result, &next); err != nil {
+				writeRESTError(w, r, caller, first, started, hash, err)
+				return
+			}
+			hashes = append(hashes, next)
+		}
+	}
+
+	headers := []json.RawMessage{}
+	if len(hashes) > 0 {
+		params := make([][]interface{}, len(hashes))
+		for i, h := range hashes {
+			params[i] = []interface{}{h, format == "json"}
+		}
+		headers, err = coreBatch("getblockheader", params)
+		if err != nil {
+			writeRESTError(w, r, caller, first, started, hash, err)
+			return
+		}
+	}
+
+	if format == "hex" {
+		var raw strings.Builder
+		for _, h := range headers {
+			var s string
+			if err := json.Unmarshal(h, &s); err != nil {
+				writeRESTError(w, r, caller, first, started, hash, err)
+				return
+			}
+			raw.WriteString(s)
+		}
+		hexResult, _ := json.Marshal(raw.String())
+		writeRESTResult(w, r, caller, first, started, format, hexResult)
+		return
+	}
+	list, _ := json.Marshal(headers)
+	writeRESTResult(w, r, caller, first, started, format, list)
+}
+
+func validHash(s string) bool {
+	if len(s) != 64 {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
+
+// restRequest builds the RPC call behind a REST path, so it can share
+// the response cache and audit log with JSON-RPC clients.
+func restRequest(method string, params ...interface{}) rpcRequest {
+	if params == nil {
+		params = []interface{}{}
+	}
+	raw, _ := json.Marshal(params)
+	return rpcRequest{JSONRPC: "1.0", ID: json.RawMessage(`"rest"`), Method: method, Params: raw}
+}
+
+// restCall answers call from the response cache when it can, and from
+// Core otherwise.
+func restCall(call rpcRequest) (json.RawMessage, error) {
+	if reply, ok := cache.lookup(call); ok {
+		var resp rpcResponse
+		if err := json.Unmarshal(reply, &resp); err == nil {
+			return resp.Result, nil
+		}
+	}
+
+	var params []interface{}
+	if err := json.Unmarshal(call.Params, &params); err != nil {
+		return nil, err
+	}
+	result, err := coreCall(call.Method, params...)
+	if err != nil {
+		return nil, err
+	}
+	if reply, err := json.Marshal(rpcResponse{Result: result, ID: call.ID}); err == nil {
+		cache.store(call, reply)
+	}
+	return result, nil
+}
+
+// writeRESTResult sends a result as JSON, or for the hex format as the
+// bare hex string, each followed by a newline as Core does.
+func writeRESTResult(w http.ResponseWriter, r *http.Request, caller principal, call rpcRequest, started time.Time, format string, result json.RawMessage) {
+	body := []byte(result)
+	contentType := "application/json"
+	if format == "hex" {
+		var s string
+		if err := json.Unmarshal(result, &s); err != nil {
+			writeRESTError(w, r, caller, call, started, "", err)
+			return
+		}
+		body = []byte(s)
+		contentType = "text/plain"
+	}
+	body = append(body, '\n')
+
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+	observeCall(r, caller, call, "rest", http.StatusOK, started, len(body))
+}
+
+// writeRESTError turns a failed call into a plain text error. Unknown
+// blocks and transactions are 404s; failures reaching Core use the same
+// statuses as JSON-RPC.
+func writeRESTError(w http.ResponseWriter, r *http.Request, caller principal, call rpcRequest, started time.Time, hash string, err error) {
+	outcome, status, message := "rest_error", http.StatusInternalServerError, err.Error()
+	var rpcErr *rpcError
+	switch {
+	case errors.As(err, &rpcErr) && rpcErr.Code == coreErrNotFound:
+		status, message = http.StatusNotFound, hash+" not found"
+	case errors.As(err, &rpcErr):
+		message = rpcErr.Message
+	default:
+		log.Printf("Upstream request for %s failed: %v", call.Method, err)
+		_, status, message = upstreamErrorCode(err)
+		outcome = upstreamOutcome(err)
+	}
+	http.Error(w, message, status)
+	observeCall(r, caller, call, outcome, status, started, len(message)+1)
+}
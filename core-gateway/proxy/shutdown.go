@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// stopping is closed once the gateway has been asked to exit, so that
+// long-lived streams can finish up instead of holding shutdown open.
+var stopping = make(chan struct{})
+
+var (
+	rpcServer     *http.Server
+	metricsServer *http.Server
+	zmqListener   net.Listener
+	zmqConns      sync.WaitGroup
+)
+
+func waitForSignal() os.Signal {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	return <-signals
+}
+
+// shutdown stops accepting connections, then gives in-flight RPC calls
+// and ZMQ subscribers up to timeout to finish before the gateway exits.
+func shutdown(timeout time.Duration) {
+	close(stopping)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if zmqListener != nil {
+		zmqListener.Close()
+	}
+	relay.close()
+
+	var wg sync.WaitGroup
+	for _, server := range []*http.Server{rpcServer, metricsServer} {
+		if server == nil {
+			continue
+		}
+		wg.Add(1)
+		go func(server *http.Server) {
+			defer wg.Done()
+			if err := server.Shutdown(ctx); err != nil {
+				log.Printf("Forcing %s closed: %v", server.Addr, err)
+				server.Close()
+			}
+		}(server)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		drained := make(chan struct{})
+		go func() {
+			zmqConns.Wait()
+			close(drained)
+		}()
+		select {
+		case <-drained:
+		case <-ctx.Done():
+			log.Printf("ZMQ subscribers did not drain before the deadline")
+		}
+	}()
+	wg.Wait()
+
+	audit.close()
+	recorder.close()
+
+	final := collectMetrics()
+	final["status"] = map[string]interface{}{"value": "Stopping"}
+	submitMetrics(final)
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// loadTLSConfig builds the RPC listener's TLS config. A certificate and
+// key supplied through the pup config take priority; otherwise a
+// self-signed pair is generated on first start and kept in /storage so
+// clients can pin it. When a client CA bundle is configured, clients
+// must present a certificate signed by it.
+func loadTLSConfig(certPEM, keyPEM, clientCAPEM string) (*tls.Config, string, error) {
+	var cert tls.Certificate
+	var err error
+
+	if strings.TrimSpace(certPEM) != "" || strings.TrimSpace(keyPEM) != "" {
+		cert, err = tls.X509KeyPair([]byte(certPEM), []byte(keyPEM))
+		if err != nil {
+			return nil, "", fmt.Errorf("loading configured certificate: %v", err)
+		}
+		log.Printf("TLS: using configured certificate")
+	} else {
+		cert, err = loadOrCreateSelfSigned(filepath.Join(storageDirectory, "tls"))
+		if err != nil {
+			return nil, "", err
+		}
+	}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if strings.TrimSpace(clientCAPEM) != "" {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM([]byte(clientCAPEM)) {
+			return nil, "", errors.New("no valid certificates in client CA bundle")
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+		log.Printf("TLS: client certificates required")
+	}
+
+	return config, certFingerprint(cert.Certificate[0]), nil
+}
+
+func loadOrCreateSelfSigned(dir string) (tls.Certificate, error) {
+	certPath := filepath.Join(dir, "gateway.crt")
+	keyPath := filepath.Join(dir, "gateway.key")
+
+	if cert, err := tls.LoadX509KeyPair(certPath, keyPath); err == nil {
+		log.Printf("TLS: using self-signed certificate from %s", certPath)
+		return cert, nil
+	} else if !os.IsNotExist(err) {
+		return tls.Certificate{}, fmt.Errorf("loading %s: %v", certPath, err)
+	}
+
+	log.Printf("TLS: generating self-signed certificate in %s", dir)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "Dogecoin Core Gateway"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	if ip := net.ParseIP(pupIP); ip != nil {
+		template.IPAddresses = append(template.IPAddresses, ip)
+	}
+	if hostname, err := os.Hostname(); err == nil {
+		template.DNSNames = append(template.DNSNames, hostname)
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return tls.Certificate{}, err
+	}
+	if err := os.WriteFile(keyPath, keyPEM, 0600); err != nil {
+		return tls.Certificate{}, err
+	}
+	if err := os.WriteFile(certPath, certPEM, 0644); err != nil {
+		return tls.Certificate{}, err
+	}
+
+	return tls.X509KeyPair(certPEM, keyPEM)
+}
+
+// certFingerprint formats the SHA-256 of a DER certificate the way
+// `openssl x509 -fingerprint -sha256` does.
+func certFingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	parts := make([]string, len(sum))
+	for i, b := range sum {
+		parts[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(parts, ":")
+}
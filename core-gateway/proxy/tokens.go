@@ -0,0 +1,305 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tokenPrefix marks gateway API tokens so they are easy to recognise in
+// config files and secret scanners.
+const tokenPrefix = "dgw_"
+
+// lastUsedResolution limits how often a token's last-used time is
+// written to disk.
+const lastUsedResolution = time.Minute
+
+// Token scopes. The rpc scopes grant the method groups of the matching
+// roles; a token without one cannot make RPC calls at all.
+const (
+	scopeRPCReadOnly  = "rpc:readonly"
+	scopeRPCBroadcast = "rpc:broadcast"
+	scopeRPCAdmin     = "rpc:admin"
+	scopeREST         = "rest"
+	scopeZMQ          = "zmq"
+)
+
+var allScopes = []string{scopeRPCReadOnly, scopeRPCBroadcast, scopeRPCAdmin, scopeREST, scopeZMQ}
+
+type apiToken struct {
+	Name     string     `json:"name"`
+	Hash     string     `json:"hash"`
+	Scopes   []string   `json:"scopes"`
+	Created  time.Time  `json:"created"`
+	Expires  *time.Time `json:"expires,omitempty"`
+	LastUsed *time.Time `json:"last_used,omitempty"`
+}
+
+// tokenInfo is what the admin endpoint reveals about a token.
+type tokenInfo struct {
+	Name     string     `json:"name"`
+	Scopes   []string   `json:"scopes"`
+	Created  time.Time  `json:"created"`
+	Expires  *time.Time `json:"expires,omitempty"`
+	LastUsed *time.Time `json:"last_used,omitempty"`
+	Expired  bool       `json:"expired"`
+}
+
+// tokenStore holds the gateway's API tokens, persisted as JSON under
+// /storage. Only a SHA-256 hash of each token is kept; tokens are long
+// random strings, so a slow password hash would add nothing.
+type tokenStore struct {
+	mu     sync.Mutex
+	path   string
+	tokens map[string]*apiToken
+}
+
+var tokens = &tokenStore{tokens: map[string]*apiToken{}}
+
+func loadTokenStore(path string) (*tokenStore, error) {
+	s := &tokenStore{path: path, tokens: map[string]*apiToken{}}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var list []*apiToken
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("parsing %s: %v", path, err)
+	}
+	for _, t := range list {
+		s.tokens[t.Name] = t
+	}
+	return s, nil
+}
+
+// save writes the store atomically; callers must hold s.mu.
+func (s *tokenStore) save() error {
+	list := make([]*apiToken, 0, len(s.tokens))
+	for _, t := range s.tokens {
+		list = append(list, t)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0700); err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+func (s *tokenStore) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.tokens)
+}
+
+// authenticate looks up the token presented as secret and records its
+// use. Expired tokens are refused but kept until revoked, so the admin
+// can see what stopped working.
+func (s *tokenStore) authenticate(secret string) (principal, bool) {
+	sum := sha256.Sum256([]byte(secret))
+	hash := hex.EncodeToString(sum[:])
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var found *apiToken
+	for _, t := range s.tokens {
+		if hmac.Equal([]byte(t.Hash), []byte(hash)) {
+			found = t
+		}
+	}
+	now := time.Now().UTC()
+	if found == nil || (found.Expires != nil && !now.Before(*found.Expires)) {
+		return principal{}, false
+	}
+
+	if found.LastUsed == nil || now.Sub(*found.LastUsed) >= lastUsedResolution {
+		found.LastUsed = &now
+		if err := s.save(); err != nil {
+			log.Printf("Failed to record use of token %q: %v", found.Name, err)
+		}
+	}
+	return tokenPrincipal(found), true
+}
+
+// tokenPrincipal maps a token's scopes onto a principal. Its role is the
+// widest RPC scope it holds.
+func tokenPrincipal(t *apiToken) principal {
+	p := principal{name: "token:" + t.Name, scopes: map[string]bool{}}
+	for _, scope := range t.Scopes {
+		p.scopes[scope] = true
+	}
+	switch {
+	case p.scopes[scopeRPCAdmin]:
+		p.role = roleAdmin
+	case p.scopes[scopeRPCBroadcast]:
+		p.role = roleBroadcast
+	case p.scopes[scopeRPCReadOnly]:
+		p.role = roleReadOnly
+	}
+	return p
+}
+
+func (s *tokenStore) list() []tokenInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	out := make([]tokenInfo, 0, len(s.tokens))
+	for _, t := range s.tokens {
+		out = append(out, tokenInfo{
+			Name:     t.Name,
+			Scopes:   t.Scopes,
+			Created:  t.Created,
+			Expires:  t.Expires,
+			LastUsed: t.LastUsed,
+			Expired:  t.Expires != nil && !now.Before(*t.Expires),
+		})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+// create adds a token and returns its secret, which is not stored and
+// cannot be shown again.
+func (s *tokenStore) create(name string, scopes []string, expires *time.Time) (string, error) {
+	if name == "" || strings.ContainsAny(name, ":/") {
+		return "", errors.New("invalid token name")
+	}
+	if len(scopes) == 0 {
+		return "", errors.New("a token needs at least one scope")
+	}
+	for _, scope := range scopes {
+		if !validScope(scope) {
+			return "", fmt.Errorf("unknown scope %q (available: %s)", scope, strings.Join(allScopes, ", "))
+		}
+	}
+	if expires != nil && !expires.After(time.Now()) {
+		return "", errors.New("expiry is in the past")
+	}
+
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	secret := tokenPrefix + base64.RawURLEncoding.EncodeToString(buf)
+	sum := sha256.Sum256([]byte(secret))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.tokens[name]; exists {
+		return "", fmt.Errorf("token %q already exists", name)
+	}
+	s.tokens[name] = &apiToken{
+		Name:    name,
+		Hash:    hex.EncodeToString(sum[:]),
+		Scopes:  scopes,
+		Created: time.Now().UTC(),
+		Expires: expires,
+	}
+	return secret, s.save()
+}
+
+func (s *tokenStore) revoke(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.tokens[name]; !ok {
+		return errUnknownToken
+	}
+	delete(s.tokens, name)
+	return s.save()
+}
+
+var errUnknownToken = errors.New("unknown token")
+
+func validScope(scope string) bool {
+	for _, s := range allScopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// tokensAdminHandler manages API tokens at runtime:
+//
+//	GET    /admin/tokens         list tokens
+//	POST   /admin/tokens         create {"name","scopes","expires"}
+//	DELETE /admin/tokens/<name>  revoke
+//
+// expires is an optional RFC 3339 timestamp. The token itself is only
+// returned in the response to POST.
+func tokensAdminHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+
+	name := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/tokens"), "/")
+
+	switch {
+	case name == "" && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, tokens.list())
+
+	case name == "" && r.Method == http.MethodPost:
+		var req struct {
+			Name    string     `json:"name"`
+			Scopes  []string   `json:"scopes"`
+			Expires *time.Time `json:"expires"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid request body")
+			return
+		}
+		secret, err := tokens.create(req.Name, req.Scopes, req.Expires)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		log.Printf("Token %q created with scopes %s", req.Name, strings.Join(req.Scopes, ","))
+		writeJSON(w, http.StatusCreated, map[string]interface{}{
+			"name": req.Name, "scopes": req.Scopes, "expires": req.Expires, "token": secret,
+		})
+
+	case name != "" && !strings.Contains(name, "/") && r.Method == http.MethodDelete:
+		if err := tokens.revoke(name); err == errUnknownToken {
+			writeJSONError(w, http.StatusNotFound, err.Error())
+			return
+		} else if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		log.Printf("Token %q revoked", name)
+		writeJSON(w, http.StatusOK, map[string]string{"name": name, "status": "revoked"})
+
+	default:
+		writeJSONError(w, http.StatusNotFound, "not found")
+	}
+}
@@ -0,0 +1,434 @@
+// Recording and replay of the proxy's conversation with its upstream
+// node: Core for core-gateway, the remote node for core-remote.
+//
+// core-gateway/proxy/traffic.go is the original of this file and
+// core-remote/proxy/traffic.go a byte-identical copy, which a test in
+// core-remote checks. Make changes in the original and copy it over, so
+// the redaction lists cannot drift apart. It relies only on what both
+// proxies define alike: upstreamReply, errorReply, rpcErrInternal,
+// envFloat and zmqRelay.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Traffic modes, set with TRAFFIC_MODE in the pup config.
+const (
+	trafficModeOff    = "off"
+	trafficModeRecord = "record"
+	trafficModeReplay = "replay"
+)
+
+// maxReplayGap caps the pause between replayed ZMQ messages, so a
+// recording that spans hours still plays back in reasonable time.
+const maxReplayGap = 10 * time.Second
+
+// maxTrafficLine bounds one line of a recording being replayed.
+const maxTrafficLine = 512 << 20
+
+// redacted replaces params and results that carry keys or passphrases.
+const redacted = `"[redacted]"`
+
+// secretParams are the methods whose params are never written to a
+// recording; secretResults are those whose results are not either.
+var (
+	secretParams = map[string]bool{
+		"walletpassphrase":       true,
+		"walletpassphrasechange": true,
+		"encryptwallet":          true,
+		"importprivkey":          true,
+		"importwallet":           true,
+		"dumpwallet":             true,
+		"signrawtransaction":     true,
+		"signmessagewithprivkey": true,
+	}
+	secretResults = map[string]bool{
+		"dumpprivkey": true,
+		"dumpwallet":  true,
+	}
+)
+
+// openTraffic starts recording to, or replaying from, the file named by
+// TRAFFIC_FILE in dir, according to TRAFFIC_MODE.
+func openTraffic(dir string) error {
+	name := os.Getenv("TRAFFIC_FILE")
+	if name == "" {
+		name = "traffic.jsonl"
+	}
+	path := filepath.Join(dir, filepath.Base(name))
+
+	var err error
+	switch mode := strings.ToLower(strings.TrimSpace(os.Getenv("TRAFFIC_MODE"))); mode {
+	case "", trafficModeOff:
+	case trafficModeRecord:
+		if recorder, err = openTrafficRecorder(path, int64(envFloat("TRAFFIC_MAX_SIZE_MB", 100)*1024*1024)); err != nil {
+			return err
+		}
+		log.Printf("  Traffic: recording to %s", path)
+	case trafficModeReplay:
+		if replayer, err = loadTrafficReplay(path); err != nil {
+			return err
+		}
+		log.Printf("  Traffic: replaying %s instead of contacting the upstream node", path)
+	default:
+		return fmt.Errorf("unknown TRAFFIC_MODE %q (expected off, record or replay)", mode)
+	}
+	return nil
+}
+
+// trafficEntry is one line of a recording: an RPC call with the reply
+// the upstream node gave it, or a ZMQ message. Credentials are never
+// recorded, since only the JSON-RPC body is kept.
+type trafficEntry struct {
+	Time     time.Time       `json:"ts"`
+	Type     string          `json:"type"`
+	Method   string          `json:"method,omitempty"`
+	Params   json.RawMessage `json:"params,omitempty"`
+	Status   int             `json:"status,omitempty"`
+	Response json.RawMessage `json:"response,omitempty"`
+	Frames   []string        `json:"frames,omitempty"`
+}
+
+// trafficRecorder appends the conversation with the upstream node to a
+// JSON lines file, stopping once it reaches maxSize.
+type trafficRecorder struct {
+	mu      sync.Mutex
+	path    string
+	file    *os.File
+	size    int64
+	maxSize int64
+}
+
+var recorder *trafficRecorder
+
+func openTrafficRecorder(path string, maxSize int64) (*trafficRecorder, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &trafficRecorder{path: path, file: f, size: info.Size(), maxSize: maxSize}, nil
+}
+
+func (t *trafficRecorder) write(entries ...trafficEntry) {
+	if t == nil {
+		return
+	}
+	var buf bytes.Buffer
+	for _, entry := range entries {
+		line, err := json.Marshal(entry)
+		if err != nil {
+			log.Printf("Traffic: failed to encode %s entry: %v", entry.Type, err)
+			continue
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.file == nil {
+		return
+	}
+	if t.maxSize > 0 && t.size+int64(buf.Len()) > t.maxSize {
+		log.Printf("Traffic: %s reached its size limit, recording stopped", t.path)
+		t.file.Close()
+		t.file = nil
+		return
+	}
+	n, err := t.file.Write(buf.Bytes())
+	t.size += int64(n)
+	if err != nil {
+		log.Printf("Traffic: failed to write %s: %v", t.path, err)
+	}
+}
+
+// recordRPC records each call in body along with its reply. Batches are
+// split so replay can answer the calls in any combination.
+func (t *trafficRecorder) recordRPC(body []byte, reply *upstreamReply) {
+	if t == nil {
+		return
+	}
+	now := time.Now().UTC()
+	calls, batch := splitCalls(body)
+	responses := make([]json.RawMessage, len(calls))
+	var split []json.RawMessage
+	if batch && json.Unmarshal(reply.body, &split) == nil && len(split) == len(calls) {
+		copy(responses, split)
+	} else {
+		// A single call, or a batch the node refused as a whole
+		for i := range responses {
+			responses[i] = reply.body
+		}
+	}
+
+	entries := make([]trafficEntry, 0, len(calls))
+	for i, call := range calls {
+		entry := trafficEntry{
+			Time:     now,
+			Type:     "rpc",
+			Method:   call.Method,
+			Params:   call.Params,
+			Status:   reply.status,
+			Response: responses[i],
+		}
+		if !json.Valid(entry.Response) {
+			entry.Response, _ = json.Marshal(string(entry.Response))
+		}
+		method := strings.ToLower(call.Method)
+		if secretParams[method] {
+			entry.Params = json.RawMessage(redacted)
+		}
+		if secretResults[method] {
+			entry.Response = json.RawMessage(redacted)
+		}
+		entries = append(entries, entry)
+	}
+	t.write(entries...)
+}
+
+// trafficCall is the part of a JSON-RPC call that recordings keep.
+type trafficCall struct {
+	ID     json.RawMessage `json:"id"`
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params"`
+}
+
+// splitCalls decodes a single call or a batch. Bodies that do not parse
+// give no calls.
+func splitCalls(body []byte) ([]trafficCall, bool) {
+	if trimmed := bytes.TrimSpace(body); len(trimmed) > 0 && trimmed[0] == '[' {
+		var calls []trafficCall
+		json.Unmarshal(body, &calls)
+		return calls, true
+	}
+	var call trafficCall
+	if json.Unmarshal(body, &call) != nil {
+		return nil, false
+	}
+	return []trafficCall{call}, false
+}
+
+func (t *trafficRecorder) recordZMQ(parts [][]byte) {
+	if t == nil {
+		return
+	}
+	frames := make([]string, len(parts))
+	for i, part := range parts {
+		frames[i] = hex.EncodeToString(part)
+	}
+	t.write(trafficEntry{Time: time.Now().UTC(), Type: "zmq", Frames: frames})
+}
+
+func (t *trafficRecorder) close() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.file != nil {
+		t.file.Close()
+		t.file = nil
+	}
+}
+
+// trafficReplay answers calls from a recording in place of the upstream
+// node. Calls recorded more than once are answered in recorded order,
+// repeating the last answer once they run out.
+type trafficReplay struct {
+	mu      sync.Mutex
+	path    string
+	replies map[string][]trafficEntry
+	zmq     []trafficEntry
+}
+
+var replayer *trafficReplay
+
+func loadTrafficReplay(path string) (*trafficReplay, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	t := &trafficReplay{path: path, replies: map[string][]trafficEntry{}}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64<<10), maxTrafficLine)
+	for line := 1; scanner.Scan(); line++ {
+		var entry trafficEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("%s line %d: %v", path, line, err)
+		}
+		switch entry.Type {
+		case "rpc":
+			key := replayKey(entry.Method, entry.Params)
+			t.replies[key] = append(t.replies[key], entry)
+		case "zmq":
+			t.zmq = append(t.zmq, entry)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// replayKey identifies a call by method and params. Calls whose params
+// were redacted match on the method alone.
+func replayKey(method string, params json.RawMessage) string {
+	method = strings.ToLower(method)
+	if string(params) == redacted {
+		return method + " *"
+	}
+	var compact bytes.Buffer
+	if len(params) == 0 || string(params) == "null" || json.Compact(&compact, params) != nil {
+		compact.Reset()
+		compact.WriteString("[]")
+	}
+	return method + " " + compact.String()
+}
+
+// next pops the recorded answer to method with params.
+func (t *trafficReplay) next(method string, params json.RawMessage) (trafficEntry, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, key := range []string{replayKey(method, params), strings.ToLower(method) + " *"} {
+		queue := t.replies[key]
+		if len(queue) == 0 {
+			continue
+		}
+		entry := queue[0]
+		if len(queue) > 1 {
+			t.replies[key] = queue[1:]
+		}
+		return entry, true
+	}
+	return trafficEntry{}, false
+}
+
+// reply answers body, a single call or a batch, as the upstream node did
+// when it was recorded, with the ids of the calls in body.
+func (t *trafficReplay) reply(body []byte) *upstreamReply {
+	calls, batch := splitCalls(body)
+	header := http.Header{"Content-Type": {"application/json"}}
+
+	if !batch {
+		if len(calls) == 0 {
+			return &upstreamReply{status: http.StatusInternalServerError, header: header,
+				body: errorReply(nil, rpcErrInternal, "No recorded reply for this call")}
+		}
+		entry, ok := t.next(calls[0].Method, calls[0].Params)
+		if !ok {
+			log.Printf("Replay: no recording of %s %s", calls[0].Method, calls[0].Params)
+			return &upstreamReply{status: http.StatusInternalServerError, header: header,
+				body: errorReply(calls[0].ID, rpcErrInternal, "No recorded reply for this call")}
+		}
+		return &upstreamReply{status: entry.Status, header: header, body: withID(entry.Response, calls[0].ID)}
+	}
+
+	replies := make([]json.RawMessage, len(calls))
+	for i, call := range calls {
+		entry, ok := t.next(call.Method, call.Params)
+		if !ok {
+			log.Printf("Replay: no recording of %s %s", call.Method, call.Params)
+			replies[i] = errorReply(call.ID, rpcErrInternal, "No recorded reply for this call")
+			continue
+		}
+		replies[i] = withID(entry.Response, call.ID)
+	}
+	out, _ := json.Marshal(replies)
+	return &upstreamReply{status: http.StatusOK, header: header, body: out}
+}
+
+// withID swaps the id in a recorded JSON-RPC reply for the caller's.
+// Replies that are not JSON objects are returned as recorded.
+func withID(response json.RawMessage, id json.RawMessage) []byte {
+	var s string
+	if json.Unmarshal(response, &s) == nil {
+		return []byte(s)
+	}
+	var fields map[string]json.RawMessage
+	if json.Unmarshal(response, &fields) != nil {
+		return response
+	}
+	if len(id) == 0 {
+		id = json.RawMessage("null")
+	}
+	fields["id"] = id
+	out, err := json.Marshal(fields)
+	if err != nil {
+		return response
+	}
+	return out
+}
+
+// playZMQ stands in for the upstream subscription: once a subscriber
+// connects it publishes the recorded ZMQ messages through the relay,
+// keeping their original spacing up to maxReplayGap.
+func (t *trafficReplay) playZMQ(z *zmqRelay) {
+	for {
+		z.mu.Lock()
+		n := len(z.subscribers)
+		z.mu.Unlock()
+		if n > 0 {
+			break
+		}
+		select {
+		case <-z.done:
+			return
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	z.connected.Store(true)
+	log.Printf("Replay: publishing %d recorded ZMQ messages", len(t.zmq))
+
+	for i, entry := range t.zmq {
+		if i > 0 {
+			gap := entry.Time.Sub(t.zmq[i-1].Time)
+			if gap > maxReplayGap {
+				gap = maxReplayGap
+			}
+			select {
+			case <-z.done:
+				return
+			case <-time.After(gap):
+			}
+		}
+		parts := make([][]byte, 0, len(entry.Frames))
+		for _, frame := range entry.Frames {
+			part, err := hex.DecodeString(frame)
+			if err != nil {
+				parts = nil
+				break
+			}
+			parts = append(parts, part)
+		}
+		if len(parts) == 0 {
+			continue
+		}
+		z.received.Add(1)
+		z.publish(parts)
+	}
+	log.Printf("Replay: all recorded ZMQ messages published")
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// upstreamClient is shared by every call to Core so connections are kept
+// alive and reused. Deadlines are set per call rather than on the client,
+// since some methods legitimately take much longer than others.
+var upstreamClient = &http.Client{
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout:   10 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:        64,
+		MaxIdleConnsPerHost: 64,
+		IdleConnTimeout:     90 * time.Second,
+	},
+}
+
+var (
+	errUpstreamTimeout  = errors.New("upstream timed out")
+	errResponseTooLarge = errors.New("upstream response too large")
+)
+
+// slowMethods are the calls that scan the chainstate or wallet and can
+// run for minutes on a large node.
+var slowMethods = parseMethodList(`
+	gettxoutsetinfo,verifychain,importwallet,importprivkey,importaddress,
+	importpubkey,dumpwallet,backupwallet,pruneblockchain
+`)
+
+// callTimeout picks the deadline for a call to Core. Fully decoded blocks
+// (getblock with verbosity 2) are much larger than the default verbose
+// output, so they get the slow timeout as well.
+func callTimeout(method string, params json.RawMessage) time.Duration {
+	method = strings.ToLower(method)
+	if slowMethods[method] {
+		return config().rpcSlowTimeout
+	}
+	if method == "getblock" {
+		var args []json.RawMessage
+		if json.Unmarshal(params, &args) == nil && len(args) > 1 && string(args[1]) == "2" {
+			return config().rpcSlowTimeout
+		}
+	}
+	return config().rpcTimeout
+}
+
+// upstreamReply is Core's answer to a forwarded request, read in full.
+type upstreamReply struct {
+	status int
+	header http.Header
+	body   []byte
+}
+
+// forwardRPC sends body to Core on behalf of the client request r,
+// swapping the client's credentials for Core's, and reads the reply
+// within timeout.
+func forwardRPC(r *http.Request, body []byte, timeout time.Duration) (*upstreamReply, error) {
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+
+	proxyReq, err := http.NewRequestWithContext(ctx, r.Method, rpcUpstream+r.URL.Path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	// Copy headers, replace auth with Core's credentials
+	for key, values := range r.Header {
+		for _, value := range values {
+			proxyReq.Header.Add(key, value)
+		}
+	}
+	proxyReq.Header.Set("Authorization", coreAuth())
+
+	return sendUpstream(ctx, proxyReq, body)
+}
+
+// sendUpstream sends req, whose body is body, to Core and reads the
+// reply. In replay mode the recording answers instead; in record mode
+// the exchange is written to it.
+func sendUpstream(ctx context.Context, req *http.Request, body []byte) (*upstreamReply, error) {
+	if replayer != nil {
+		return replayer.reply(body), nil
+	}
+
+	resp, err := upstreamClient.Do(req)
+	if err != nil {
+		return nil, upstreamError(ctx, err)
+	}
+	defer resp.Body.Close()
+
+	data, err := readLimited(resp.Body, config().maxResponseBytes)
+	if err != nil {
+		return nil, upstreamError(ctx, err)
+	}
+	reply := &upstreamReply{status: resp.StatusCode, header: resp.Header, body: data}
+	if reply.status == http.StatusUnauthorized {
+		go coreRejected()
+	}
+	recorder.recordRPC(body, reply)
+	return reply, nil
+}
+
+// upstreamError reports a deadline hit while talking to Core as
+// errUpstreamTimeout.
+func upstreamError(ctx context.Context, err error) error {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return errUpstreamTimeout
+	}
+	return err
+}
+
+// readLimited reads r to the end, failing with errResponseTooLarge
+// rather than buffering more than max bytes.
+func readLimited(r io.Reader, max int64) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, max+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > max {
+		return nil, errResponseTooLarge
+	}
+	return data, nil
+}
+
+// writeUpstreamError answers a call whose forwarding failed with a
+// JSON-RPC error, returning the audit outcome, HTTP status and bytes
+// written.
+func writeUpstreamError(w http.ResponseWriter, id json.RawMessage, err error) (string, int, int) {
+	code, status, message := upstreamErrorCode(err)
+	return upstreamOutcome(err), status, writeRPCError(w, status, id, code, message)
+}
+
+func upstreamOutcome(err error) string {
+	if err == errUpstreamTimeout {
+		return "upstream_timeout"
+	}
+	return "upstream_error"
+}
+
+func upstreamErrorCode(err error) (code, status int, message string) {
+	switch err {
+	case errUpstreamTimeout:
+		return rpcErrTimeout, http.StatusGatewayTimeout, "Dogecoin Core did not respond in time"
+	case errResponseTooLarge:
+		return rpcErrInternal, http.StatusBadGateway, "Response exceeds the gateway's size limit"
+	}
+	return rpcErrInternal, http.StatusBadGateway, "Upstream error"
+}
+
+// coreCall makes an RPC call to Core on the gateway's own behalf, for
+// example to learn the current tip. Errors reported by Core come back as
+// *rpcError.
+func coreCall(method string, params ...interface{}) (json.RawMessage, error) {
+	if params == nil {
+		params = []interface{}{}
+	}
+	rawParams, err := json.Marshal(params)
+	if err != nil {
+		return nil, err
+	}
+	reqBody, err := json.Marshal(rpcRequest{
+		JSONRPC: "1.0",
+		ID:      json.RawMessage(`"gateway"`),
+		Method:  method,
+		Params:  rawParams,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), callTimeout(method, rawParams))
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "POST", rpcUpstream, bytes.NewBuffer(reqBody))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", coreAuth())
+
+	reply, err := sendUpstream(ctx, req, reqBody)
+	if err != nil {
+		return nil, err
+	}
+
+	var rpcResp rpcResponse
+	if err := json.Unmarshal(reply.body, &rpcResp); err != nil {
+		return nil, err
+	}
+	if rpcResp.Error != nil {
+		return nil, rpcResp.Error
+	}
+	return rpcResp.Result, nil
+}
+
+// coreBatch calls method once for each set of params in a single batched
+// request to Core, returning the results in the same order. The first
+// error Core reports for any entry fails the whole batch.
+func coreBatch(method string, params [][]interface{}) ([]json.RawMessage, error) {
+	calls := make([]rpcRequest, len(params))
+	for i, p := range params {
+		rawParams, err := json.Marshal(p)
+		if err != nil {
+			return nil, err
+		}
+		calls[i] = rpcRequest{JSONRPC: "1.0", ID: json.RawMessage(strconv.Itoa(i)), Method: method, Params: rawParams}
+	}
+	reqBody, err := json.Marshal(calls)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), config().rpcTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "POST", rpcUpstream, bytes.NewBuffer(reqBody))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", coreAuth())
+
+	reply, err := sendUpstream(ctx, req, reqBody)
+	if err != nil {
+		return nil, err
+	}
+
+	var resps []rpcResponse
+	if err := json.Unmarshal(reply.body, &resps); err != nil {
+		return nil, err
+	}
+	results := make([]json.RawMessage, len(params))
+	for _, resp := range resps {
+		i, err := strconv.Atoi(string(resp.ID))
+		if err != nil || i < 0 || i >= len(results) {
+			return nil, errors.New("unexpected id in Core's batch reply: " + string(resp.ID))
+		}
+		if resp.Error != nil {
+			return nil, resp.Error
+		}
+		results[i] = resp.Result
+	}
+	for _, result := range results {
+		if result == nil {
+			return nil, errors.New("Core's batch reply is missing entries")
+		}
+	}
+	return results, nil
+}
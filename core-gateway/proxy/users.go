@@ -0,0 +1,481 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const passwordIterations = 100000
+
+// maxVerifiedLogins bounds the cache of passwords already checked; it is
+// emptied when full.
+const maxVerifiedLogins = 1024
+
+// dummySalt is used to hash passwords given for unknown users.
+var dummySalt = make([]byte, 16)
+
+// loginCacheKey keys the HMAC that verified logins are cached under, so
+// the cache never holds passwords or anything that can be checked
+// offline against one.
+var loginCacheKey = func() []byte {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic(err)
+	}
+	return key
+}()
+
+type gatewayUser struct {
+	Name       string    `json:"name"`
+	Role       string    `json:"role"`
+	Salt       string    `json:"salt"`
+	Hash       string    `json:"hash"`
+	Iterations int       `json:"iterations"`
+	Disabled   bool      `json:"disabled"`
+	Created    time.Time `json:"created"`
+	Updated    time.Time `json:"updated"`
+}
+
+// userInfo is what the admin endpoint reveals about a user.
+type userInfo struct {
+	Name     string    `json:"name"`
+	Role     string    `json:"role"`
+	Disabled bool      `json:"disabled"`
+	Created  time.Time `json:"created"`
+	Updated  time.Time `json:"updated"`
+}
+
+// userStore holds the gateway's named users, persisted as JSON under
+// /storage so changes made through the admin endpoint survive restarts.
+// Logins that passed the password check are remembered in verified, by
+// the user's hash at the time, so clients sending Basic credentials with
+// every call do not pay for PBKDF2 each time. Any change to the users
+// empties it.
+type userStore struct {
+	mu       sync.RWMutex
+	path     string
+	users    map[string]*gatewayUser
+	verified map[[sha256.Size]byte]string
+}
+
+var users = &userStore{users: map[string]*gatewayUser{}, verified: map[[sha256.Size]byte]string{}}
+
+func loadUserStore(path string) (*userStore, error) {
+	s := &userStore{path: path, users: map[string]*gatewayUser{}, verified: map[[sha256.Size]byte]string{}}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var list []*gatewayUser
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("parsing %s: %v", path, err)
+	}
+	for _, u := range list {
+		s.users[u.Name] = u
+	}
+	return s, nil
+}
+
+// save writes the store atomically; callers must hold s.mu. Errors are
+// wrapped in errSaveFailed.
+func (s *userStore) save() error {
+	if err := s.write(); err != nil {
+		return fmt.Errorf("%w: %v", errSaveFailed, err)
+	}
+	return nil
+}
+
+func (s *userStore) write() error {
+	list := make([]*gatewayUser, 0, len(s.users))
+	for _, u := range s.users {
+		list = append(list, u)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0700); err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+func (s *userStore) count() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.users)
+}
+
+// authenticate checks a user's password. The store is not locked while
+// the password is hashed, so one slow check does not hold up others.
+func (s *userStore) authenticate(name, password string) (gatewayUser, bool) {
+	key := loginKey(name, password)
+
+	s.mu.RLock()
+	var u gatewayUser
+	stored, ok := s.users[name]
+	if ok {
+		u = *stored
+	}
+	verifiedHash, verified := s.verified[key]
+	s.mu.RUnlock()
+
+	if !ok || u.Disabled {
+		// Spend as long as a real check would, so response times do not
+		// reveal which usernames exist
+		pbkdf2SHA256([]byte(password), dummySalt, passwordIterations, sha256.Size)
+		return gatewayUser{}, false
+	}
+	if verified && verifiedHash == u.Hash {
+		return u, true
+	}
+	salt, err := hex.DecodeString(u.Salt)
+	if err != nil {
+		return gatewayUser{}, false
+	}
+	want, err := hex.DecodeString(u.Hash)
+	if err != nil {
+		return gatewayUser{}, false
+	}
+	got := pbkdf2SHA256([]byte(password), salt, u.Iterations, len(want))
+	if !hmac.Equal(got, want) {
+		return gatewayUser{}, false
+	}
+
+	s.mu.Lock()
+	// The user may have changed while the password was checked
+	if current, ok := s.users[name]; ok && current.Hash == u.Hash && !current.Disabled {
+		if len(s.verified) >= maxVerifiedLogins {
+			s.forgetLogins()
+		}
+		s.verified[key] = u.Hash
+	}
+	s.mu.Unlock()
+	return u, true
+}
+
+// forgetLogins empties the cache of verified logins; callers must hold
+// s.mu.
+func (s *userStore) forgetLogins() {
+	s.verified = map[[sha256.Size]byte]string{}
+}
+
+// loginKey is what a login is cached under.
+func loginKey(name, password string) [sha256.Size]byte {
+	mac := hmac.New(sha256.New, loginCacheKey)
+	mac.Write([]byte(name))
+	mac.Write([]byte{0})
+	mac.Write([]byte(password))
+	var key [sha256.Size]byte
+	mac.Sum(key[:0])
+	return key
+}
+
+func (s *userStore) list() []userInfo {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	out := make([]userInfo, 0, len(s.users))
+	for _, u := range s.users {
+		out = append(out, userInfo{u.Name, u.Role, u.Disabled, u.Created, u.Updated})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+func (s *userStore) add(name, password, role string) error {
+	if name == "" || strings.ContainsAny(name, ":/") {
+		return errors.New("invalid user name")
+	}
+	if !validRole(role) {
+		return fmt.Errorf("unknown role %q", role)
+	}
+	// Hash before locking, so logins are not held up behind PBKDF2
+	salt, hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.users[name]; exists || name == config().rpcUsername {
+		return fmt.Errorf("user %q already exists", name)
+	}
+	now := time.Now().UTC()
+	s.users[name] = &gatewayUser{Name: name, Role: role, Salt: salt, Hash: hash,
+		Iterations: passwordIterations, Created: now, Updated: now}
+	if err := s.save(); err != nil {
+		delete(s.users, name)
+		return err
+	}
+	return nil
+}
+
+func (s *userStore) remove(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, ok := s.users[name]
+	if !ok {
+		return errUnknownUser
+	}
+	delete(s.users, name)
+	s.forgetLogins()
+	if err := s.save(); err != nil {
+		s.users[name] = u
+		return err
+	}
+	return nil
+}
+
+func (s *userStore) setDisabled(name string, disabled bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, ok := s.users[name]
+	if !ok {
+		return errUnknownUser
+	}
+	old := *u
+	u.Disabled = disabled
+	u.Updated = time.Now().UTC()
+	s.forgetLogins()
+	if err := s.save(); err != nil {
+		*u = old
+		return err
+	}
+	return nil
+}
+
+func (s *userStore) rotate(name, password string) error {
+	salt, hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, ok := s.users[name]
+	if !ok {
+		return errUnknownUser
+	}
+	old := *u
+	u.Salt, u.Hash, u.Iterations = salt, hash, passwordIterations
+	u.Updated = time.Now().UTC()
+	s.forgetLogins()
+	if err := s.save(); err != nil {
+		*u = old
+		return err
+	}
+	return nil
+}
+
+var errUnknownUser = errors.New("unknown user")
+
+// errSaveFailed wraps errors writing the store to disk. The change they
+// belong to has been undone, but it is the gateway's fault rather than
+// the request's.
+var errSaveFailed = errors.New("could not save users")
+
+// hashPassword returns a fresh hex salt and the password's PBKDF2 hash
+// under it, using passwordIterations.
+func hashPassword(password string) (salt, hash string, err error) {
+	raw := make([]byte, 16)
+	if _, err := rand.Read(raw); err != nil {
+		return "", "", err
+	}
+	key := pbkdf2SHA256([]byte(password), raw, passwordIterations, sha256.Size)
+	return hex.EncodeToString(raw), hex.EncodeToString(key), nil
+}
+
+// pbkdf2SHA256 derives a key as described in RFC 8018 using HMAC-SHA256.
+func pbkdf2SHA256(password, salt []byte, iterations, keyLen int) []byte {
+	prf := hmac.New(sha256.New, password)
+	var key []byte
+	for block := uint32(1); len(key) < keyLen; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		binary.Write(prf, binary.BigEndian, block)
+		u := prf.Sum(nil)
+		t := append([]byte(nil), u...)
+		for i := 1; i < iterations; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		key = append(key, t...)
+	}
+	return key[:keyLen]
+}
+
+// randomSecret returns a URL safe random string for generated passwords.
+func randomSecret() (string, error) {
+	buf := make([]byte, 24)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// usersAdminHandler manages gateway users at runtime:
+//
+//	GET    /admin/users               list users
+//	POST   /admin/users               add {"name","role","password"}
+//	POST   /admin/users/<name>/disable
+//	POST   /admin/users/<name>/enable
+//	POST   /admin/users/<name>/rotate {"password"}
+//	DELETE /admin/users/<name>
+//
+// A password left blank is generated and returned once in the response.
+func usersAdminHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/users"), "/")
+	parts := strings.Split(rest, "/")
+
+	switch {
+	case rest == "" && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, users.list())
+
+	case rest == "" && r.Method == http.MethodPost:
+		var req struct {
+			Name     string `json:"name"`
+			Role     string `json:"role"`
+			Password string `json:"password"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid request body")
+			return
+		}
+		password, err := passwordOrGenerated(req.Password)
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if err := users.add(req.Name, password, req.Role); err != nil {
+			status := http.StatusBadRequest
+			if errors.Is(err, errSaveFailed) {
+				status = http.StatusInternalServerError
+			}
+			writeJSONError(w, status, err.Error())
+			return
+		}
+		log.Printf("User %q added with role %s", req.Name, req.Role)
+		writeJSON(w, http.StatusCreated, map[string]string{"name": req.Name, "role": req.Role, "password": password})
+
+	case len(parts) == 1 && r.Method == http.MethodDelete:
+		respondUserUpdate(w, parts[0], "removed", users.remove(parts[0]), nil)
+
+	case len(parts) == 2 && r.Method == http.MethodPost && parts[1] == "disable":
+		respondUserUpdate(w, parts[0], "disabled", users.setDisabled(parts[0], true), nil)
+
+	case len(parts) == 2 && r.Method == http.MethodPost && parts[1] == "enable":
+		respondUserUpdate(w, parts[0], "enabled", users.setDisabled(parts[0], false), nil)
+
+	case len(parts) == 2 && r.Method == http.MethodPost && parts[1] == "rotate":
+		var req struct {
+			Password string `json:"password"`
+		}
+		// An empty body simply means "generate one for me"
+		json.NewDecoder(r.Body).Decode(&req)
+		password, err := passwordOrGenerated(req.Password)
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		respondUserUpdate(w, parts[0], "rotated", users.rotate(parts[0], password),
+			map[string]string{"password": password})
+
+	default:
+		writeJSONError(w, http.StatusNotFound, "not found")
+	}
+}
+
+// requireAdmin authenticates r and checks it belongs to an admin. Admin
+// endpoints are never available anonymously, nor to API tokens.
+func requireAdmin(w http.ResponseWriter, r *http.Request) bool {
+	if !authEnabled() {
+		writeJSONError(w, http.StatusForbidden, "admin endpoints require RPC credentials to be configured")
+		return false
+	}
+	p, ok := requireAuth(w, r)
+	if !ok {
+		return false
+	}
+	if p.scopes != nil {
+		writeJSONError(w, http.StatusForbidden, "admin endpoints require a username and password")
+		return false
+	}
+	if p.role != roleAdmin {
+		writeJSONError(w, http.StatusForbidden, "admin role required")
+		return false
+	}
+	return true
+}
+
+func respondUserUpdate(w http.ResponseWriter, name, action string, err error, extra map[string]string) {
+	if err == errUnknownUser {
+		writeJSONError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	log.Printf("User %q %s", name, action)
+	resp := map[string]string{"name": name, "status": action}
+	for k, v := range extra {
+		resp[k] = v
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func passwordOrGenerated(password string) (string, error) {
+	if password != "" {
+		return password, nil
+	}
+	return randomSecret()
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeJSONError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Just enough ZMTP 3.0 (https://rfc.zeromq.org/spec/23/) to subscribe to
+// Core's PUB socket and to act as a PUB socket for downstream clients,
+// using the NULL security mechanism, or PLAIN
+// (https://rfc.zeromq.org/spec/24/) for downstream clients that log in.
+
+const (
+	zmtpFlagMore    = 0x01
+	zmtpFlagLong    = 0x02
+	zmtpFlagCommand = 0x04
+
+	zmtpMaxFrame = 16 << 20
+)
+
+type zmtpConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	wmu  sync.Mutex
+	// writeTimeout, when set, bounds how long each frame may take to
+	// write, so a peer that stops reading fails the write instead of
+	// blocking it forever.
+	writeTimeout time.Duration
+}
+
+// zmtpGreeting builds the 64 byte ZMTP 3.0 greeting for the NULL
+// mechanism.
+func zmtpGreeting(asServer bool) []byte {
+	g := make([]byte, 64)
+	g[0] = 0xFF
+	g[9] = 0x7F
+	g[10] = 3
+	g[11] = 0
+	copy(g[12:32], "NULL")
+	if asServer {
+		g[32] = 1
+	}
+	return g
+}
+
+// zmtpHandshake exchanges greetings and READY commands on conn,
+// announcing socketType, and returns the peer's READY properties.
+func zmtpHandshake(conn net.Conn, socketType string, asServer bool) (*zmtpConn, map[string]string, error) {
+	c := &zmtpConn{conn: conn, r: bufio.NewReader(conn)}
+
+	if _, err := conn.Write(zmtpGreeting(asServer)); err != nil {
+		return nil, nil, err
+	}
+	peer := make([]byte, 64)
+	if _, err := io.ReadFull(c.r, peer); err != nil {
+		return nil, nil, err
+	}
+	if peer[0] != 0xFF || peer[9] != 0x7F {
+		return nil, nil, errors.New("peer is not speaking ZMTP")
+	}
+	if peer[10] < 3 {
+		return nil, nil, fmt.Errorf("unsupported ZMTP version %d.%d", peer[10], peer[11])
+	}
+	if mech := string(trimZero(peer[12:32])); mech != "NULL" {
+		return nil, nil, fmt.Errorf("unsupported ZMTP mechanism %q", mech)
+	}
+
+	if err := c.writeCommand("READY", zmtpProperties(map[string]string{"Socket-Type": socketType})); err != nil {
+		return nil, nil, err
+	}
+	name, data, err := c.readCommand()
+	if err != nil {
+		return nil, nil, err
+	}
+	if name != "READY" {
+		return nil, nil, fmt.Errorf("expected READY, got %s", name)
+	}
+	props, err := parseZMTPProperties(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	return c, props, nil
+}
+
+// zmtpAccept runs the server side of the handshake on conn, announcing
+// socketType. Clients may use the NULL or the PLAIN mechanism; authorize
+// is asked whether to let them in, with the credentials PLAIN clients
+// sent, and its error is passed to the client in an ERROR command.
+func zmtpAccept(conn net.Conn, socketType string, authorize func(mechanism, username, password string) error) (*zmtpConn, map[string]string, error) {
+	c := &zmtpConn{conn: conn, r: bufio.NewReader(conn)}
+
+	// Send the signature and major version first and wait for the
+	// client's greeting, so ours can announce the mechanism it chose.
+	greeting := zmtpGreeting(true)
+	if _, err := conn.Write(greeting[:11]); err != nil {
+		return nil, nil, err
+	}
+	peer := make([]byte, 64)
+	if _, err := io.ReadFull(c.r, peer); err != nil {
+		return nil, nil, err
+	}
+	if peer[0] != 0xFF || peer[9] != 0x7F {
+		return nil, nil, errors.New("peer is not speaking ZMTP")
+	}
+	if peer[10] < 3 {
+		return nil, nil, fmt.Errorf("unsupported ZMTP version %d.%d", peer[10], peer[11])
+	}
+	mechanism := string(trimZero(peer[12:32]))
+	if mechanism != "NULL" && mechanism != "PLAIN" {
+		return nil, nil, fmt.Errorf("unsupported ZMTP mechanism %q", mechanism)
+	}
+	clear(greeting[12:32])
+	copy(greeting[12:32], mechanism)
+	if _, err := conn.Write(greeting[11:]); err != nil {
+		return nil, nil, err
+	}
+
+	var username, password string
+	readyCommand := "READY"
+	if mechanism == "PLAIN" {
+		name, data, err := c.readCommand()
+		if err != nil {
+			return nil, nil, err
+		}
+		if name != "HELLO" {
+			return nil, nil, fmt.Errorf("expected HELLO, got %s", name)
+		}
+		if username, password, err = parsePlainHello(data); err != nil {
+			return nil, nil, err
+		}
+		readyCommand = "INITIATE"
+	}
+	if err := authorize(mechanism, username, password); err != nil {
+		reason := err.Error()
+		if len(reason) > 255 {
+			reason = reason[:255]
+		}
+		c.writeCommand("ERROR", append([]byte{byte(len(reason))}, reason...))
+		return nil, nil, err
+	}
+	if mechanism == "PLAIN" {
+		if err := c.writeCommand("WELCOME", nil); err != nil {
+			return nil, nil, err
+		}
+	} else if err := c.writeCommand("READY", zmtpProperties(map[string]string{"Socket-Type": socketType})); err != nil {
+		return nil, nil, err
+	}
+
+	name, data, err := c.readCommand()
+	if err != nil {
+		return nil, nil, err
+	}
+	if name != readyCommand {
+		return nil, nil, fmt.Errorf("expected %s, got %s", readyCommand, name)
+	}
+	props, err := parseZMTPProperties(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	if mechanism == "PLAIN" {
+		if err := c.writeCommand("READY", zmtpProperties(map[string]string{"Socket-Type": socketType})); err != nil {
+			return nil, nil, err
+		}
+	}
+	return c, props, nil
+}
+
+// parsePlainHello splits the body of a PLAIN HELLO command into the
+// username and password.
+func parsePlainHello(data []byte) (string, string, error) {
+	var fields [2]string
+	for i := range fields {
+		if len(data) < 1 || len(data) < 1+int(data[0]) {
+			return "", "", errors.New("malformed HELLO command")
+		}
+		n := int(data[0])
+		fields[i] = string(data[1 : 1+n])
+		data = data[1+n:]
+	}
+	return fields[0], fields[1], nil
+}
+
+func trimZero(b []byte) []byte {
+	for i, c := range b {
+		if c == 0 {
+			return b[:i]
+		}
+	}
+	return b
+}
+
+func zmtpProperties(props map[string]string) []byte {
+	var out []byte
+	for name, value := range props {
+		out = append(out, byte(len(name)))
+		out = append(out, name...)
+		out = binary.BigEndian.AppendUint32(out, uint32(len(value)))
+		out = append(out, value...)
+	}
+	return out
+}
+
+func parseZMTPProperties(data []byte) (map[string]string, error) {
+	props := map[string]string{}
+	for len(data) > 0 {
+		n := int(data[0])
+		if len(data) < 1+n+4 {
+			return nil, errors.New("truncated ZMTP property")
+		}
+		name := string(data[1 : 1+n])
+		data = data[1+n:]
+		vlen := int(binary.BigEndian.Uint32(data))
+		data = data[4:]
+		if len(data) < vlen {
+			return nil, errors.New("truncated ZMTP property value")
+		}
+		props[name] = string(data[:vlen])
+		data = data[vlen:]
+	}
+	return props, nil
+}
+
+func (c *zmtpConn) writeFrame(flags byte, body []byte) error {
+	var header []byte
+	if len(body) > 255 {
+		header = append([]byte{flags | zmtpFlagLong}, make([]byte, 8)...)
+		binary.BigEndian.PutUint64(header[1:], uint64(len(body)))
+	} else {
+		header = []byte{flags, byte(len(body))}
+	}
+	if c.writeTimeout > 0 {
+		c.conn.SetWriteDeadline(time.Now().Add(c.writeTimeout))
+	}
+	if _, err := c.conn.Write(append(header, body...)); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (c *zmtpConn) readFrame() (byte, []byte, error) {
+	flags, err := c.r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	var size uint64
+	if flags&zmtpFlagLong != 0 {
+		var buf [8]byte
+		if _, err := io.ReadFull(c.r, buf[:]); err != nil {
+			return 0, nil, err
+		}
+		size = binary.BigEndian.Uint64(buf[:])
+	} else {
+		b, err := c.r.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		size = uint64(b)
+	}
+	if size > zmtpMaxFrame {
+		return 0, nil, fmt.Errorf("ZMTP frame too large (%d bytes)", size)
+	}
+	body := make([]byte, size)
+	if _, err := io.ReadFull(c.r, body); err != nil {
+		return 0, nil, err
+	}
+	return flags, body, nil
+}
+
+func (c *zmtpConn) writeCommand(name string, data []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	body := append([]byte{byte(len(name))}, name...)
+	return c.writeFrame(zmtpFlagCommand, append(body, data...))
+}
+
+func (c *zmtpConn) readCommand() (string, []byte, error) {
+	flags, body, err := c.readFrame()
+	if err != nil {
+		return "", nil, err
+	}
+	if flags&zmtpFlagCommand == 0 {
+		return "", nil, errors.New("expected a ZMTP command")
+	}
+	if len(body) < 1 || len(body) < 1+int(body[0]) {
+		return "", nil, errors.New("malformed ZMTP command")
+	}
+	n := int(body[0])
+	return string(body[1 : 1+n]), body[1+n:], nil
+}
+
+// readMessage returns the next multipart message, skipping any commands
+// (such as PING) in between.
+func (c *zmtpConn) readMessage() ([][]byte, error) {
+	var parts [][]byte
+	for {
+		flags, body, err := c.readFrame()
+		if err != nil {
+			return nil, err
+		}
+		if flags&zmtpFlagCommand != 0 {
+			continue
+		}
+		parts = append(parts, body)
+		if flags&zmtpFlagMore == 0 {
+			return parts, nil
+		}
+	}
+}
+
+func (c *zmtpConn) writeMessage(parts [][]byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	for i, part := range parts {
+		var flags byte
+		if i < len(parts)-1 {
+			flags = zmtpFlagMore
+		}
+		if err := c.writeFrame(flags, part); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// subscribe sends a ZMTP 3.0 style subscription for topic.
+func (c *zmtpConn) subscribe(topic string) error {
+	return c.writeMessage([][]byte{append([]byte{1}, topic...)})
+}
@@ -1,6 +1,8 @@
 { pkgs ? import <nixpkgs> {} }:
 
 let
+  storageDirectory = "/storage";
+
   proxy = pkgs.buildGoModule {
     pname = "rpc-proxy";
     version = "0.0.1";
@@ -10,7 +12,7 @@ let
     buildPhase = ''
       export GO111MODULE=off
       export GOCACHE=$(pwd)/.gocache
-      go build -o rpc-proxy proxy.go
+      go build -ldflags "-X main.storageDirectory=${storageDirectory}" -o rpc-proxy .
     '';
 
     installPhase = ''
@@ -18,7 +20,26 @@ let
       cp rpc-proxy $out/bin/
     '';
   };
+
+  electrum = pkgs.buildGoModule {
+    pname = "electrum-server";
+    version = "0.0.1";
+    src = ./electrum;
+    vendorHash = null;
+
+    buildPhase = ''
+      export GO111MODULE=off
+      export GOCACHE=$(pwd)/.gocache
+      go build -ldflags "-X main.storageDirectory=${storageDirectory}" -o electrum-server .
+    '';
+
+    installPhase = ''
+      mkdir -p $out/bin
+      cp electrum-server $out/bin/
+    '';
+  };
 in
 {
   rpc-proxy = proxy;
+  electrum-server = electrum;
 }
@@ -2,24 +2,21 @@ package main
 
 import (
 	"bytes"
-	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 )
 
-var (
-	remoteHost    string
-	remoteRPCPort string
-	rpcUsername   string
-	rpcPassword   string
-	rpcUpstream   string
-	remoteAuth    string
-)
+// remoteHost is the remote node the proxy is using, as of its last
+// status report: host:port of the active node.
+var remoteHost string
 
 type BlockchainInfo struct {
 	Chain                string  `json:"chain"`
@@ -31,40 +28,91 @@ type BlockchainInfo struct {
 	SizeOnDisk           int64   `json:"size_on_disk"`
 }
 
+// ProxyStatus is what remote-proxy reports about itself on its
+// pup-local status endpoint.
+type ProxyStatus struct {
+	Config struct {
+		RemoteHost string `json:"remote_host"`
+		Version    int64  `json:"version"`
+		Hash       string `json:"hash"`
+	} `json:"config"`
+	ActiveNode string `json:"active_node"`
+	TLS        struct {
+		Encrypted string `json:"encrypted"`
+	} `json:"tls"`
+	Nodes []struct {
+		Name     string `json:"name"`
+		State    string `json:"state"`
+		Active   bool   `json:"active"`
+		Height   int64  `json:"height"`
+		Lagging  bool   `json:"lagging"`
+		Answered int64  `json:"answered"`
+		Rejected int64  `json:"rejected"`
+		Failed   int64  `json:"failed"`
+	} `json:"nodes"`
+	Credentials struct {
+		Required  bool `json:"required"`
+		Consumers []struct {
+			Username string `json:"username"`
+			Name     string `json:"name"`
+			Requests int64  `json:"requests"`
+		} `json:"consumers"`
+		StaticRequests int64 `json:"static_requests"`
+	} `json:"credentials"`
+	RPC struct {
+		Requests       int64 `json:"requests"`
+		UpstreamErrors int64 `json:"upstream_errors"`
+		AuthFailures   int64 `json:"auth_failures"`
+	} `json:"rpc"`
+	ZMQ struct {
+		Connected   bool `json:"connected"`
+		Subscribers []struct {
+			Remote  string `json:"remote"`
+			Sent    int64  `json:"sent"`
+			Dropped int64  `json:"dropped"`
+		} `json:"subscribers"`
+	} `json:"zmq"`
+}
+
+// The proxy's pup-local status endpoints. Blockchain info is fetched
+// through the proxy so it always comes from the node the proxy is
+// configured for, even after a config reload.
+const (
+	proxyStatusURL         = "http://127.0.0.1:22599/status"
+	proxyBlockchainInfoURL = "http://127.0.0.1:22599/blockchaininfo"
+)
+
 func main() {
 	log.Println("Dogecoin Core Remote Monitor starting...")
 	log.Println("Sleeping to give proxy time to start...")
 	time.Sleep(10 * time.Second)
 
 	remoteHost = os.Getenv("REMOTE_HOST")
-	remoteRPCPort = os.Getenv("REMOTE_RPC_PORT")
-	rpcUsername = os.Getenv("RPC_USERNAME")
-	rpcPassword = os.Getenv("RPC_PASSWORD")
-
-	if remoteRPCPort == "" {
-		remoteRPCPort = "22555"
-	}
-
-	rpcUpstream = "http://" + remoteHost + ":" + remoteRPCPort
-
-	// Pre-compute auth header for remote Core
-	if rpcUsername != "" && rpcPassword != "" {
-		remoteAuth = "Basic " + base64.StdEncoding.EncodeToString(
-			[]byte(rpcUsername+":"+rpcPassword),
-		)
-	}
-
 	log.Printf("Remote Host: %s", remoteHost)
-	log.Printf("RPC Upstream: %s", rpcUpstream)
 
-	if remoteHost == "" {
-		log.Fatal("ERROR: REMOTE_HOST must be configured")
-	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
 
 	ticker := time.NewTicker(10 * time.Second)
 	defer ticker.Stop()
 
-	for range ticker.C {
+	for {
+		select {
+		case sig := <-signals:
+			log.Printf("Received %s, stopping", sig)
+			submitStatus("Stopping")
+			return
+		case <-ticker.C:
+		}
+
+		status, err := getProxyStatus()
+		if err != nil {
+			log.Printf("Error getting proxy status: %v", err)
+		} else if status.ActiveNode != remoteHost {
+			remoteHost = status.ActiveNode
+			log.Printf("Remote Host: %s (config version %d)", remoteHost, status.Config.Version)
+		}
+
 		info, err := getBlockchainInfo()
 		if err != nil {
 			log.Printf("Error getting blockchain info from %s: %v", remoteHost, err)
@@ -81,35 +129,15 @@ func main() {
 		log.Printf("Initial Block Download: %t", info.InitialBlockDownload)
 		log.Printf("Size on Disk: %d", info.SizeOnDisk)
 
-		submitMetrics(info)
+		submitMetrics(info, status)
 
 		log.Printf("----------------------------------------")
 	}
 }
 
 func getBlockchainInfo() (BlockchainInfo, error) {
-	rpcReq := map[string]interface{}{
-		"jsonrpc": "1.0",
-		"id":      "monitor",
-		"method":  "getblockchaininfo",
-		"params":  []interface{}{},
-	}
-	reqBody, err := json.Marshal(rpcReq)
-	if err != nil {
-		return BlockchainInfo{}, err
-	}
-
-	req, err := http.NewRequest("POST", rpcUpstream, bytes.NewBuffer(reqBody))
-	if err != nil {
-		return BlockchainInfo{}, err
-	}
-	req.Header.Set("Content-Type", "application/json")
-	if remoteAuth != "" {
-		req.Header.Set("Authorization", remoteAuth)
-	}
-
-	client := &http.Client{Timeout: 10 * time.Second}
-	resp, err := client.Do(req)
+	client := &http.Client{Timeout: 15 * time.Second}
+	resp, err := client.Get(proxyBlockchainInfoURL)
 	if err != nil {
 		return BlockchainInfo{}, err
 	}
@@ -131,7 +159,22 @@ func getBlockchainInfo() (BlockchainInfo, error) {
 	return rpcResp.Result, nil
 }
 
-func submitMetrics(info BlockchainInfo) {
+func getProxyStatus() (*ProxyStatus, error) {
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Get(proxyStatusURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var status ProxyStatus
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+func submitMetrics(info BlockchainInfo, status *ProxyStatus) {
 	client := &http.Client{}
 
 	// Verification progress is 0..1, so we make it pretty text
@@ -156,6 +199,51 @@ func submitMetrics(info BlockchainInfo) {
 		"chain_size_human":       map[string]interface{}{"value": chainSize},
 	}
 
+	if status != nil {
+		var dropped int64
+		for _, sub := range status.ZMQ.Subscribers {
+			log.Printf("ZMQ subscriber %s: sent=%d dropped=%d", sub.Remote, sub.Sent, sub.Dropped)
+			dropped += sub.Dropped
+		}
+		jsonData["zmq_subscribers"] = map[string]interface{}{"value": len(status.ZMQ.Subscribers)}
+		jsonData["zmq_dropped"] = map[string]interface{}{"value": dropped}
+		jsonData["rpc_requests"] = map[string]interface{}{"value": status.RPC.Requests}
+		jsonData["upstream_errors"] = map[string]interface{}{"value": status.RPC.UpstreamErrors}
+		jsonData["auth_failures"] = map[string]interface{}{"value": status.RPC.AuthFailures}
+		jsonData["config_version"] = map[string]interface{}{"value": status.Config.Version}
+		jsonData["config_hash"] = map[string]interface{}{"value": status.Config.Hash}
+		jsonData["link_encrypted"] = map[string]interface{}{"value": status.TLS.Encrypted}
+
+		healthy := 0
+		var states []string
+		for _, node := range status.Nodes {
+			state := node.State
+			if node.Lagging {
+				state = "lagging"
+			}
+			if state == "up" {
+				healthy++
+			}
+			if node.Active {
+				state += ", active"
+			}
+			states = append(states, fmt.Sprintf("%s (%s, %d; calls %d ok, %d rejected, %d failed)",
+				node.Name, state, node.Height, node.Answered, node.Rejected, node.Failed))
+		}
+		log.Printf("Remote nodes: %s", strings.Join(states, "; "))
+		jsonData["healthy_nodes"] = map[string]interface{}{"value": healthy}
+		jsonData["node_states"] = map[string]interface{}{"value": strings.Join(states, "; ")}
+
+		var consumers []string
+		for _, c := range status.Credentials.Consumers {
+			consumers = append(consumers, fmt.Sprintf("%s (%s): %d", c.Name, c.Username, c.Requests))
+		}
+		if status.Credentials.StaticRequests > 0 {
+			consumers = append(consumers, fmt.Sprintf("static login: %d", status.Credentials.StaticRequests))
+		}
+		jsonData["consumers"] = map[string]interface{}{"value": strings.Join(consumers, "; ")}
+	}
+
 	marshalledData, err := json.Marshal(jsonData)
 	if err != nil {
 		log.Printf("Error marshalling blockchain info: %v", err)
@@ -192,20 +280,26 @@ func submitMetrics(info BlockchainInfo) {
 }
 
 func submitDisconnectedStatus() {
-	client := &http.Client{}
+	submitStatus("Disconnected")
+}
+
+// submitStatus reports a status that has no blockchain info to go with
+// it, such as the remote node being unreachable or the pup stopping.
+func submitStatus(status string) {
+	client := &http.Client{Timeout: 10 * time.Second}
 
 	jsonData := map[string]interface{}{
-		"status":      map[string]interface{}{"value": "Disconnected"},
+		"status":      map[string]interface{}{"value": status},
 		"remote_host": map[string]interface{}{"value": remoteHost},
 	}
 
 	marshalledData, err := json.Marshal(jsonData)
 	if err != nil {
-		log.Printf("Error marshalling disconnected status: %v", err)
+		log.Printf("Error marshalling %s status: %v", status, err)
 		return
 	}
 
-	log.Printf("Submitting disconnected status: %v", jsonData)
+	log.Printf("Submitting %s status: %v", status, jsonData)
 
 	url := fmt.Sprintf("http://%s:%s/dbx/metrics", os.Getenv("DBX_HOST"), os.Getenv("DBX_PORT"))
 
@@ -219,19 +313,19 @@ func submitDisconnectedStatus() {
 
 	resp, err := client.Do(req)
 	if err != nil {
-		log.Printf("Error sending disconnected status: %v", err)
+		log.Printf("Error sending %s status: %v", status, err)
 		return
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		log.Printf("Unexpected status code when submitting disconnected status: %d", resp.StatusCode)
+		log.Printf("Unexpected status code when submitting %s status: %d", status, resp.StatusCode)
 		body, _ := io.ReadAll(resp.Body)
 		log.Printf("Response body: %s", string(body))
 		return
 	}
 
-	log.Println("Disconnected status submitted successfully.")
+	log.Printf("%s status submitted successfully.", status)
 }
 
 func bytesToHuman(bytes int64) string {
@@ -0,0 +1,411 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// configFileName is the file in /storage whose values override the pup
+// config, keyed by the same names, e.g. {"REMOTE_HOST": "10.0.0.5",
+// "RPC_PASSWORD": "..."}. It is re-read when it changes and on SIGHUP.
+const configFileName = "config.json"
+
+// configPollInterval is how often the config file is checked for changes.
+const configPollInterval = 5 * time.Second
+
+// reloadableSettings are the pup config values that take effect without
+// a restart. Anything else in the config file is ignored.
+var reloadableSettings = []string{
+	"REMOTE_HOST", "REMOTE_RPC_PORT", "REMOTE_ZMQ_PORT", "RPC_USERNAME", "RPC_PASSWORD",
+	"REMOTE_NODES", "HEALTH_CHECK_INTERVAL", "MAX_BLOCK_LAG", "LOAD_BALANCING",
+	"RPC_TLS", "ZMQ_TLS", "TLS_CA_BUNDLE", "TLS_PIN_SHA256", "TLS_SERVER_NAME",
+	"SOCKS_PROXY", "SOCKS_USERNAME", "SOCKS_PASSWORD",
+	"REQUIRE_PUP_CREDENTIALS", "REVOKE_CREDENTIALS",
+	"RPC_TIMEOUT", "RPC_SLOW_TIMEOUT", "MAX_REQUEST_SIZE_MB", "MAX_RESPONSE_SIZE_MB",
+}
+
+// secretSettings are left out of the reported config hash, so the hash
+// cannot be used to guess them. REMOTE_NODES is hashed by node name
+// only, since it carries passwords too.
+var secretSettings = map[string]bool{"RPC_PASSWORD": true, "REMOTE_NODES": true, "SOCKS_PASSWORD": true}
+
+// proxyConfig is the part of the proxy's configuration that can change
+// while it runs. A reload builds a new one and swaps it in whole, so
+// calls already in flight finish with the settings they started with.
+type proxyConfig struct {
+	// nodes are the remote nodes in order of preference: REMOTE_HOST
+	// first, then REMOTE_NODES.
+	nodes          []remoteNode
+	healthInterval time.Duration
+	maxBlockLag    int64
+	// balancing is how read-only calls are spread across the nodes that
+	// are in sync.
+	balancing string
+
+	// rpcTLS and zmqTLS say whether the nodes are reached over TLS, with
+	// the CA bundle, pins and server name in tlsConfig. client carries
+	// every RPC call to the nodes.
+	rpcTLS    bool
+	zmqTLS    bool
+	tlsConfig *tls.Config
+	client    *http.Client
+
+	// dialer opens every connection to the nodes, through socksProxy
+	// when one is set.
+	dialer     contextDialer
+	socksProxy string
+
+	// requireCredentials refuses the shared static login, which pups
+	// that cannot enroll use otherwise. revoked lists issued
+	// credentials, by username, to delete.
+	requireCredentials bool
+	revoked            []string
+
+	rpcTimeout       time.Duration
+	rpcSlowTimeout   time.Duration
+	maxRequestBytes  int64
+	maxResponseBytes int64
+
+	// values are the settings the config was built from, and hash a
+	// digest of those that are not secret. version counts the changes
+	// applied since the proxy started.
+	values  map[string]string
+	hash    string
+	version int64
+}
+
+var (
+	currentConfig atomic.Pointer[proxyConfig]
+	configPath    string
+	reloadMu      sync.Mutex
+
+	configReloadErrors = newCounter("remote_config_reload_errors_total",
+		"Config reloads rejected because the config file could not be read or was invalid.")
+	_ = newGauge("remote_config_version",
+		"Number of config changes applied since the proxy started.",
+		func() float64 { return float64(config().version) })
+)
+
+// config returns the configuration in effect. Callers should not keep it
+// beyond the request they are handling.
+func config() *proxyConfig {
+	return currentConfig.Load()
+}
+
+// staticLoginAllowed reports whether pups may still use the static login.
+func staticLoginAllowed() bool { return !config().requireCredentials }
+
+// loadConfig reads the pup config and the config file in dir and applies
+// them. It is called once at startup; later changes go through
+// reloadConfig.
+func loadConfig(dir string) error {
+	configPath = filepath.Join(dir, configFileName)
+	overrides, err := readConfigFile(configPath)
+	if err != nil {
+		return err
+	}
+	c, err := buildConfig(overrides)
+	if err != nil {
+		return err
+	}
+	currentConfig.Store(c)
+	pool.setNodes(c.nodes, c.maxBlockLag)
+	return nil
+}
+
+// reloadConfig re-reads the config file and applies it if anything
+// changed. An unreadable or invalid file leaves the running config as it
+// is.
+func reloadConfig(reason string) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	overrides, err := readConfigFile(configPath)
+	if err == nil {
+		var c *proxyConfig
+		if c, err = buildConfig(overrides); err == nil {
+			prev := config()
+			changed := changedSettings(prev.values, c.values)
+			if len(changed) == 0 {
+				log.Printf("Config: %s, nothing changed", reason)
+				return
+			}
+			c.version = prev.version + 1
+			currentConfig.Store(c)
+			log.Printf("Config: %s, applied version %d (changed: %s)", reason, c.version, strings.Join(changed, ", "))
+			pool.setNodes(c.nodes, c.maxBlockLag)
+			credentials.revoke(c.revoked)
+			prev.client.CloseIdleConnections()
+			if !transportSettingsEqual(prev.values, c.values) {
+				relay.reconnect()
+			}
+			return
+		}
+	}
+	configReloadErrors.inc()
+	log.Printf("Config: %s, keeping the current config: %v", reason, err)
+}
+
+// readConfigFile returns the settings in path as strings. A missing file
+// overrides nothing.
+func readConfigFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var raw map[string]interface{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("parsing %s: %v", path, err)
+	}
+	overrides := map[string]string{}
+	for name, value := range raw {
+		if !isReloadable(name) {
+			log.Printf("Config: ignoring %s in %s, it needs a restart to change", name, path)
+			continue
+		}
+		switch v := value.(type) {
+		case string:
+			overrides[name] = v
+		case float64:
+			overrides[name] = strconv.FormatFloat(v, 'f', -1, 64)
+		case bool:
+			overrides[name] = strconv.FormatBool(v)
+		case nil:
+		default:
+			return nil, fmt.Errorf("%s in %s must be a string, number or boolean", name, path)
+		}
+	}
+	return overrides, nil
+}
+
+func isReloadable(name string) bool {
+	for _, s := range reloadableSettings {
+		if s == name {
+			return true
+		}
+	}
+	return false
+}
+
+// buildConfig reads each reloadable setting from overrides, falling back
+// to the pup config.
+func buildConfig(overrides map[string]string) (*proxyConfig, error) {
+	values := map[string]string{}
+	for _, name := range reloadableSettings {
+		if value, ok := overrides[name]; ok {
+			values[name] = value
+		} else {
+			values[name] = os.Getenv(name)
+		}
+	}
+	get := func(name, def string) string {
+		if values[name] == "" {
+			return def
+		}
+		return values[name]
+	}
+	number := func(name string, def float64) float64 { return parseFloatSetting(name, values[name], def) }
+	seconds := func(name string, def float64) time.Duration {
+		return time.Duration(number(name, def) * float64(time.Second))
+	}
+	flag := func(name string) bool {
+		b, _ := strconv.ParseBool(values[name])
+		return b
+	}
+
+	rpcTLS, zmqTLS := flag("RPC_TLS"), flag("ZMQ_TLS")
+	tlsConfig, err := newTLSConfig(get("TLS_CA_BUNDLE", ""), get("TLS_PIN_SHA256", ""), get("TLS_SERVER_NAME", ""))
+	if err != nil {
+		return nil, err
+	}
+	dialer := directDialer
+	socksProxy := get("SOCKS_PROXY", "")
+	if socksProxy != "" {
+		if _, _, err := net.SplitHostPort(socksProxy); err != nil {
+			return nil, fmt.Errorf("SOCKS_PROXY must be host:port: %v", err)
+		}
+		dialer = newSOCKS5Dialer(socksProxy, get("SOCKS_USERNAME", ""), get("SOCKS_PASSWORD", ""))
+	}
+	scheme := "http"
+	if rpcTLS {
+		scheme = "https"
+	}
+
+	var nodes []remoteNode
+	if host := get("REMOTE_HOST", ""); host != "" {
+		nodes = append(nodes, newRemoteNode(scheme, host, get("REMOTE_RPC_PORT", "22555"), get("REMOTE_ZMQ_PORT", "28332"),
+			get("RPC_USERNAME", ""), get("RPC_PASSWORD", "")))
+	}
+	backups, err := parseNodeList(get("REMOTE_NODES", ""), scheme)
+	if err != nil {
+		return nil, fmt.Errorf("REMOTE_NODES: %v", err)
+	}
+	seen := map[string]bool{}
+	for _, n := range append(nodes, backups...) {
+		if seen[n.name] {
+			return nil, fmt.Errorf("node %s is listed more than once", n.name)
+		}
+		seen[n.name] = true
+	}
+	nodes = append(nodes, backups...)
+	if len(nodes) == 0 {
+		return nil, errors.New("REMOTE_HOST must be configured")
+	}
+
+	balancing := strings.ToLower(strings.TrimSpace(get("LOAD_BALANCING", balanceOff)))
+	switch balancing {
+	case balanceOff, balanceRoundRobin, balanceLeastLatency:
+	default:
+		return nil, fmt.Errorf("unknown LOAD_BALANCING %q (expected off, round-robin or least-latency)", balancing)
+	}
+
+	names := make([]string, len(nodes))
+	for i, n := range nodes {
+		names[i] = n.name
+	}
+	c := &proxyConfig{
+		nodes:          nodes,
+		healthInterval: seconds("HEALTH_CHECK_INTERVAL", 10),
+		maxBlockLag:    int64(number("MAX_BLOCK_LAG", 3)),
+		balancing:      balancing,
+
+		rpcTLS:    rpcTLS,
+		zmqTLS:    zmqTLS,
+		tlsConfig: tlsConfig,
+		client:    newUpstreamClient(tlsConfig, dialer),
+
+		dialer:     dialer,
+		socksProxy: socksProxy,
+
+		requireCredentials: flag("REQUIRE_PUP_CREDENTIALS"),
+		revoked:            strings.Fields(strings.ReplaceAll(get("REVOKE_CREDENTIALS", ""), ",", " ")),
+
+		rpcTimeout:       seconds("RPC_TIMEOUT", 30),
+		rpcSlowTimeout:   seconds("RPC_SLOW_TIMEOUT", 300),
+		maxRequestBytes:  int64(number("MAX_REQUEST_SIZE_MB", 2) * 1024 * 1024),
+		maxResponseBytes: int64(number("MAX_RESPONSE_SIZE_MB", 64) * 1024 * 1024),
+
+		values: values,
+		hash:   configHash(values, "NODES="+strings.Join(names, ",")),
+	}
+	if c.healthInterval < time.Second {
+		c.healthInterval = time.Second
+	}
+	return c, nil
+}
+
+// configHash digests the settings that are not secret, plus any extra
+// lines, so the config in effect can be compared at a glance, before and
+// after a reload.
+func configHash(values map[string]string, extra ...string) string {
+	names := make([]string, 0, len(values))
+	for name := range values {
+		if !secretSettings[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	h := sha256.New()
+	for _, name := range names {
+		fmt.Fprintf(h, "%s=%s\n", name, values[name])
+	}
+	for _, line := range extra {
+		fmt.Fprintln(h, line)
+	}
+	return hex.EncodeToString(h.Sum(nil))[:12]
+}
+
+// transportSettingsEqual reports whether two sets of settings reach the
+// nodes' ZMQ publishers the same way: through the same SOCKS proxy and
+// with the same TLS settings.
+func transportSettingsEqual(prev, next map[string]string) bool {
+	for _, name := range []string{"ZMQ_TLS", "TLS_CA_BUNDLE", "TLS_PIN_SHA256", "TLS_SERVER_NAME",
+		"SOCKS_PROXY", "SOCKS_USERNAME", "SOCKS_PASSWORD"} {
+		if prev[name] != next[name] {
+			return false
+		}
+	}
+	return true
+}
+
+func changedSettings(prev, next map[string]string) []string {
+	var changed []string
+	for _, name := range reloadableSettings {
+		if prev[name] != next[name] {
+			changed = append(changed, name)
+		}
+	}
+	return changed
+}
+
+// watchConfig reloads the config on SIGHUP and whenever the config file
+// changes, until the proxy stops.
+func watchConfig() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	last := configFileState()
+	ticker := time.NewTicker(configPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopping:
+			return
+		case <-hup:
+			last = configFileState()
+			reloadConfig("SIGHUP received")
+		case <-ticker.C:
+			if state := configFileState(); state != last {
+				last = state
+				reloadConfig(configFileName + " changed")
+			}
+		}
+	}
+}
+
+// configFileState is a digest of the config file's contents, or empty if
+// it cannot be read.
+func configFileState() string {
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// parseFloatSetting parses a numeric setting, falling back to def when it
+// is unset or malformed.
+func parseFloatSetting(name, value string, def float64) float64 {
+	if value == "" {
+		return def
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		log.Printf("Ignoring invalid %s=%q: %v", name, value, err)
+		return def
+	}
+	return f
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/base64"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestEnrollAgainAfterCredentialGoesUnused(t *testing.T) {
+	s, err := openCredentialStore(filepath.Join(t.TempDir(), credentialsFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	const ip = "10.69.0.12"
+	first, _, err := s.enroll(ip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := s.enroll(ip); err != errAlreadyEnrolled {
+		t.Fatalf("enrolling again at once: got %v, want errAlreadyEnrolled", err)
+	}
+
+	// Issued long ago and the proxy restarted since, but used recently
+	old := time.Now().Add(-2 * reenrollAfter)
+	s.opened, first.Created, first.Rotated = old, old, old
+	first.lastSeen = time.Now().Add(-reenrollAfter / 2)
+	if _, _, err := s.enroll(ip); err != errAlreadyEnrolled {
+		t.Fatalf("enrolling while the credential is in use: got %v, want errAlreadyEnrolled", err)
+	}
+
+	first.lastSeen = old
+	second, secret, err := s.enroll(ip)
+	if err != nil {
+		t.Fatalf("enrolling after the credential went unused: %v", err)
+	}
+	if second.Username == first.Username {
+		t.Fatalf("got the old username %s back", first.Username)
+	}
+	if _, ok := s.consumers[first.Username]; ok || len(s.consumers) != 1 {
+		t.Fatalf("the old credential %s was kept", first.Username)
+	}
+	auth := "Basic " + base64.StdEncoding.EncodeToString([]byte(second.Username+":"+secret))
+	if _, ok := s.authenticate(auth, ip); !ok {
+		t.Fatal("the new credential does not authenticate")
+	}
+
+	// The replacement is stored, so it survives a restart
+	reopened, err := openCredentialStore(s.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := reopened.authenticate(auth, ip); !ok || len(reopened.consumers) != 1 {
+		t.Fatalf("after reopening: %d credentials, new one authenticates: %v", len(reopened.consumers), ok)
+	}
+	if _, _, err := reopened.enroll(ip); err != errAlreadyEnrolled {
+		t.Fatalf("enrolling right after a restart: got %v, want errAlreadyEnrolled", err)
+	}
+}
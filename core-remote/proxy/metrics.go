@@ -0,0 +1,87 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// metricsPort is where the Prometheus endpoint listens, apart from RPC
+// so it can be scraped without the internal credentials.
+const metricsPort = "22590"
+
+// Prometheus metrics served on /metrics.
+var (
+	rpcRequests = newCounter("remote_rpc_requests_total",
+		"RPC calls forwarded to the remote node, by method and HTTP status.", "method", "status")
+	rpcLatency = newHistogram("remote_rpc_request_duration_seconds",
+		"Time taken to answer RPC calls, by method.",
+		[]float64{0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}, "method")
+	rpcResponseBytes = newCounter("remote_rpc_response_bytes_total",
+		"Bytes of RPC responses relayed to local pups.")
+	upstreamErrors = newCounter("remote_upstream_errors_total",
+		"RPC calls that failed because the remote node could not be reached.")
+	authFailures = newCounter("remote_auth_failures_total",
+		"Requests rejected for missing or invalid internal credentials.")
+	consumerRequests = newCounter("remote_consumer_requests_total",
+		"RPC requests from local pups, by the credential they used.", "consumer", "name")
+	zmqRelayedBytes = newCounter("remote_zmq_relayed_bytes_total",
+		"Bytes of ZMQ messages sent to local subscribers.")
+	_ = newGauge("remote_zmq_connections",
+		"Connected ZMQ subscribers.",
+		func() float64 { return float64(len(relay.stats())) })
+	_ = newGauge("remote_zmq_upstream_connected",
+		"Whether the relay is subscribed to the remote node (1) or not (0).",
+		func() float64 { return boolFloat(relay.connected.Load()) })
+)
+
+func startMetricsServer() {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", promHandler)
+	metricsServer = &http.Server{Addr: pupIP + ":" + metricsPort, Handler: mux}
+
+	log.Printf("Metrics listening on %s", metricsServer.Addr)
+	go func() {
+		if err := metricsServer.ListenAndServe(); err != http.ErrServerClosed {
+			log.Printf("Metrics endpoint failed: %v", err)
+		}
+	}()
+}
+
+func observeCall(method string, status int, started time.Time, size int64) {
+	rpcRequests.inc(method, strconv.Itoa(status))
+	rpcLatency.observe(time.Since(started).Seconds(), method)
+	rpcResponseBytes.add(float64(size))
+}
+
+// methodLabel names the method of a request for use as a metric label.
+// Batches are counted as a single "batch" call, and anything that does
+// not look like a method name is "other" so that the label's
+// cardinality stays bounded.
+func methodLabel(calls []rpcCall, batch bool) string {
+	if batch {
+		return "batch"
+	}
+	if len(calls) != 1 {
+		return "other"
+	}
+	method := strings.ToLower(calls[0].Method)
+	if method == "" || len(method) > 40 {
+		return "other"
+	}
+	for _, c := range method {
+		if c < 'a' || c > 'z' {
+			return "other"
+		}
+	}
+	return method
+}
+
+func boolFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,552 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Node states as reported on the status endpoint.
+const (
+	nodeUnknown = "unknown"
+	nodeUp      = "up"
+	nodeDown    = "down"
+)
+
+const (
+	// nodeDownAfter is how many health checks in a row must fail before
+	// a node is taken out of rotation. A refused connection from live
+	// traffic takes it out straight away.
+	nodeDownAfter = 2
+
+	healthCheckTimeout = 5 * time.Second
+)
+
+// remoteNode is one remote Core node the proxy can forward to.
+type remoteNode struct {
+	// name is host:rpcport, as shown in logs and metrics.
+	name        string
+	host        string
+	rpcUpstream string
+	zmqUpstream string
+	// auth is the Authorization header for the node, or empty when it
+	// has no credentials configured.
+	auth string
+}
+
+// newRemoteNode describes a node reached at host. scheme is http, or
+// https when RPC goes over TLS.
+func newRemoteNode(scheme, host, rpcPort, zmqPort, username, password string) remoteNode {
+	n := remoteNode{
+		name:        net.JoinHostPort(host, rpcPort),
+		host:        host,
+		rpcUpstream: scheme + "://" + net.JoinHostPort(host, rpcPort),
+		zmqUpstream: net.JoinHostPort(host, zmqPort),
+	}
+	if username != "" && password != "" {
+		n.auth = "Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password))
+	}
+	return n
+}
+
+// parseNodeList reads REMOTE_NODES: one node per line (or separated by
+// commas) as [username:password@]host[:rpcport[:zmqport]]. IPv6 hosts
+// go in brackets.
+func parseNodeList(list, scheme string) ([]remoteNode, error) {
+	var nodes []remoteNode
+	for _, line := range strings.FieldsFunc(list, func(r rune) bool {
+		return r == '\n' || r == ',' || r == '\r'
+	}) {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		n, err := parseNode(line, scheme)
+		if err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, n)
+	}
+	return nodes, nil
+}
+
+func parseNode(entry, scheme string) (remoteNode, error) {
+	var username, password string
+	address := entry
+	if at := strings.LastIndex(entry, "@"); at >= 0 {
+		credentials := entry[:at]
+		address = entry[at+1:]
+		colon := strings.Index(credentials, ":")
+		if colon < 0 {
+			return remoteNode{}, fmt.Errorf("node %q: credentials must be username:password", address)
+		}
+		username, password = credentials[:colon], credentials[colon+1:]
+	}
+
+	host := address
+	var ports []string
+	if strings.HasPrefix(address, "[") {
+		end := strings.Index(address, "]")
+		if end < 0 {
+			return remoteNode{}, fmt.Errorf("node %q: missing ]", address)
+		}
+		host = address[1:end]
+		if rest := address[end+1:]; rest != "" {
+			if rest[0] != ':' {
+				return remoteNode{}, fmt.Errorf("node %q: expected : after ]", address)
+			}
+			ports = strings.Split(rest[1:], ":")
+		}
+	} else {
+		parts := strings.Split(address, ":")
+		host, ports = parts[0], parts[1:]
+	}
+	if host == "" || len(ports) > 2 {
+		return remoteNode{}, fmt.Errorf("node %q: expected host[:rpcport[:zmqport]]", address)
+	}
+
+	rpcPort, zmqPort := "22555", "28332"
+	for i, port := range ports {
+		if port == "" {
+			continue
+		}
+		if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+			return remoteNode{}, fmt.Errorf("node %q: invalid port %q", address, port)
+		}
+		if i == 0 {
+			rpcPort = port
+		} else {
+			zmqPort = port
+		}
+	}
+	return newRemoteNode(scheme, host, rpcPort, zmqPort, username, password), nil
+}
+
+type nodeHealth struct {
+	state     string
+	height    int64
+	latency   time.Duration
+	failures  int
+	lastCheck time.Time
+	lastError string
+
+	// Outcomes of the RPC calls forwarded to the node: answered,
+	// answered with a JSON-RPC error, or not answered at all.
+	answered, rejected, failed int64
+}
+
+// nodeState is what the status endpoint reports about a node.
+type nodeState struct {
+	Name      string     `json:"name"`
+	State     string     `json:"state"`
+	Active    bool       `json:"active"`
+	Height    int64      `json:"height"`
+	LatencyMs float64    `json:"latency_ms"`
+	Lagging   bool       `json:"lagging"`
+	LastCheck *time.Time `json:"last_check,omitempty"`
+	LastError string     `json:"last_error,omitempty"`
+	Answered  int64      `json:"answered"`
+	Rejected  int64      `json:"rejected"`
+	Failed    int64      `json:"failed"`
+}
+
+// nodePool tracks the health of the configured nodes and picks the one
+// RPC and ZMQ traffic goes to. The active node is kept while it is up
+// and within maxLag blocks of the best height seen; otherwise traffic
+// fails over to the in-sync node with the lowest latency.
+type nodePool struct {
+	mu     sync.Mutex
+	nodes  []remoteNode
+	health map[string]*nodeHealth
+	active int
+	maxLag int64
+	// next is the round-robin position for balanced reads.
+	next int
+}
+
+var pool = &nodePool{health: map[string]*nodeHealth{}}
+
+var (
+	failovers = newCounter("remote_failovers_total",
+		"Times traffic moved to a different remote node.")
+	nodeRequests = newCounter("remote_node_requests_total",
+		"RPC calls forwarded to each remote node, by result (ok, rejected or failed).", "node", "result")
+	_ = newGaugeVec("remote_node_up", "Whether the remote node passed its last health checks.", "node",
+		func() map[string]float64 {
+			return pool.nodeValues(func(s nodeState) float64 { return boolFloat(s.State == nodeUp) })
+		})
+	_ = newGaugeVec("remote_node_active", "Whether traffic currently goes to the remote node.", "node",
+		func() map[string]float64 {
+			return pool.nodeValues(func(s nodeState) float64 { return boolFloat(s.Active) })
+		})
+	_ = newGaugeVec("remote_node_height", "Block height the remote node last reported.", "node",
+		func() map[string]float64 {
+			return pool.nodeValues(func(s nodeState) float64 { return float64(s.Height) })
+		})
+	_ = newGaugeVec("remote_node_latency_seconds", "Round trip of the last successful health check.", "node",
+		func() map[string]float64 {
+			return pool.nodeValues(func(s nodeState) float64 { return s.LatencyMs / 1000 })
+		})
+)
+
+// setNodes replaces the node list, keeping what is known about nodes
+// that are still in it. Moving off a node that was removed is not counted
+// as a failover.
+func (p *nodePool) setNodes(nodes []remoteNode, maxLag int64) {
+	p.mu.Lock()
+	var prev remoteNode
+	if p.active < len(p.nodes) {
+		prev = p.nodes[p.active]
+	}
+	health := map[string]*nodeHealth{}
+	p.active = 0
+	for i, n := range nodes {
+		if h, ok := p.health[n.name]; ok {
+			health[n.name] = h
+		} else {
+			health[n.name] = &nodeHealth{state: nodeUnknown}
+		}
+		if n.name == prev.name {
+			p.active = i
+		}
+	}
+	p.nodes, p.health, p.maxLag = nodes, health, maxLag
+	p.selectLocked()
+	next := p.nodes[p.active]
+	p.mu.Unlock()
+
+	if _, kept := health[prev.name]; kept {
+		p.switched(prev, next)
+	} else if prev.name != "" {
+		log.Printf("Active remote node is now %s", next.name)
+		if prev.zmqUpstream != next.zmqUpstream {
+			relay.reconnect()
+		}
+	}
+}
+
+// activeNode returns the node traffic should go to.
+func (p *nodePool) activeNode() remoteNode {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.nodes[p.active]
+}
+
+// record stores the outcome of a health check of the named node.
+func (p *nodePool) record(name string, height int64, latency time.Duration, err error) {
+	p.mu.Lock()
+	h, ok := p.health[name]
+	if !ok {
+		p.mu.Unlock()
+		return
+	}
+	h.lastCheck = time.Now()
+	if err != nil {
+		h.failures++
+		h.lastError = err.Error()
+		if h.failures >= nodeDownAfter && h.state != nodeDown {
+			log.Printf("Remote node %s is down: %v", name, err)
+			h.state = nodeDown
+		}
+	} else {
+		if h.state != nodeUp {
+			log.Printf("Remote node %s is up at height %d", name, height)
+		}
+		h.state = nodeUp
+		h.failures = 0
+		h.lastError = ""
+		h.height = height
+		h.latency = latency
+	}
+	prev := p.nodes[p.active]
+	p.selectLocked()
+	next := p.nodes[p.active]
+	p.mu.Unlock()
+
+	p.switched(prev, next)
+}
+
+// markDown takes a node out of rotation after live traffic could not
+// reach it, without waiting for the next health check.
+func (p *nodePool) markDown(name string, err error) {
+	p.mu.Lock()
+	h, ok := p.health[name]
+	if !ok {
+		p.mu.Unlock()
+		return
+	}
+	if h.state != nodeDown {
+		log.Printf("Remote node %s is down: %v", name, err)
+	}
+	h.state = nodeDown
+	h.failures = nodeDownAfter
+	h.lastError = err.Error()
+	prev := p.nodes[p.active]
+	p.selectLocked()
+	next := p.nodes[p.active]
+	p.mu.Unlock()
+
+	p.switched(prev, next)
+}
+
+// selectLocked picks the active node; callers must hold p.mu.
+func (p *nodePool) selectLocked() {
+	best := p.bestHeightLocked()
+	inSync := func(i int) bool { return p.inSyncLocked(i, best) }
+	if inSync(p.active) || p.health[p.nodes[p.active].name].state == nodeUnknown {
+		// Stay put, or wait for the active node's first check rather than
+		// moving off it because another node answered sooner
+		return
+	}
+
+	choice := -1
+	for i := range p.nodes {
+		if !inSync(i) {
+			continue
+		}
+		if choice < 0 || p.health[p.nodes[i].name].latency < p.health[p.nodes[choice].name].latency {
+			choice = i
+		}
+	}
+	if choice < 0 && p.health[p.nodes[p.active].name].state == nodeDown {
+		// Nothing is known to be in sync; try the first node that has
+		// not failed yet rather than one that has
+		for i := range p.nodes {
+			if p.health[p.nodes[i].name].state != nodeDown {
+				choice = i
+				break
+			}
+		}
+	}
+	if choice >= 0 {
+		p.active = choice
+	}
+}
+
+// inSyncLocked reports whether node i is up and within maxLag blocks of
+// best; callers must hold p.mu.
+func (p *nodePool) inSyncLocked(i int, best int64) bool {
+	h := p.health[p.nodes[i].name]
+	return h.state == nodeUp && h.height >= best-p.maxLag
+}
+
+// readNode picks the node for a read-only call according to the
+// LOAD_BALANCING mode, among the nodes that are in sync. With balancing
+// off, or nothing in sync, it is the active node.
+func (p *nodePool) readNode(mode string) remoteNode {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	best := p.bestHeightLocked()
+	var candidates []int
+	for i := range p.nodes {
+		if p.inSyncLocked(i, best) {
+			candidates = append(candidates, i)
+		}
+	}
+	if len(candidates) == 0 {
+		return p.nodes[p.active]
+	}
+	switch mode {
+	case balanceRoundRobin:
+		p.next++
+		return p.nodes[candidates[p.next%len(candidates)]]
+	case balanceLeastLatency:
+		choice := candidates[0]
+		for _, i := range candidates[1:] {
+			if p.health[p.nodes[i].name].latency < p.health[p.nodes[choice].name].latency {
+				choice = i
+			}
+		}
+		return p.nodes[choice]
+	}
+	return p.nodes[p.active]
+}
+
+// broadcastNodes returns the nodes a transaction should be sent to:
+// every node not known to be down, or the active node if they all are.
+func (p *nodePool) broadcastNodes() []remoteNode {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var nodes []remoteNode
+	for _, n := range p.nodes {
+		if p.health[n.name].state != nodeDown {
+			nodes = append(nodes, n)
+		}
+	}
+	if len(nodes) == 0 {
+		nodes = append(nodes, p.nodes[p.active])
+	}
+	return nodes
+}
+
+// countCall records the outcome of an RPC call forwarded to the named
+// node.
+func (p *nodePool) countCall(name, result string) {
+	nodeRequests.inc(name, result)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	h, ok := p.health[name]
+	if !ok {
+		return
+	}
+	switch result {
+	case callAnswered:
+		h.answered++
+	case callRejected:
+		h.rejected++
+	default:
+		h.failed++
+	}
+}
+
+func (p *nodePool) bestHeightLocked() int64 {
+	var best int64
+	for _, n := range p.nodes {
+		if h := p.health[n.name]; h.state == nodeUp && h.height > best {
+			best = h.height
+		}
+	}
+	return best
+}
+
+// switched logs a change of active node and moves the ZMQ subscription
+// over to it.
+func (p *nodePool) switched(prev, next remoteNode) {
+	if prev.name == "" || prev.name == next.name {
+		return
+	}
+	log.Printf("Failing over from %s to %s", prev.name, next.name)
+	failovers.inc()
+	if prev.zmqUpstream != next.zmqUpstream {
+		relay.reconnect()
+	}
+}
+
+func (p *nodePool) states() []nodeState {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	best := p.bestHeightLocked()
+	states := make([]nodeState, len(p.nodes))
+	for i, n := range p.nodes {
+		h := p.health[n.name]
+		states[i] = nodeState{
+			Name:      n.name,
+			State:     h.state,
+			Active:    i == p.active,
+			Height:    h.height,
+			LatencyMs: float64(h.latency.Microseconds()) / 1000,
+			Lagging:   h.state == nodeUp && h.height < best-p.maxLag,
+			LastError: h.lastError,
+			Answered:  h.answered,
+			Rejected:  h.rejected,
+			Failed:    h.failed,
+		}
+		if !h.lastCheck.IsZero() {
+			t := h.lastCheck
+			states[i].LastCheck = &t
+		}
+	}
+	return states
+}
+
+// nodeValues maps each node's name to value(its state), for the
+// per-node gauges.
+func (p *nodePool) nodeValues(value func(nodeState) float64) map[string]float64 {
+	values := map[string]float64{}
+	for _, s := range p.states() {
+		values[s.Name] = value(s)
+	}
+	return values
+}
+
+// runHealthChecks checks every node at the configured interval until
+// the proxy stops.
+func (p *nodePool) runHealthChecks() {
+	for {
+		p.mu.Lock()
+		nodes := p.nodes
+		p.mu.Unlock()
+
+		var wg sync.WaitGroup
+		for _, n := range nodes {
+			wg.Add(1)
+			go func(n remoteNode) {
+				defer wg.Done()
+				height, latency, err := checkNode(n)
+				p.record(n.name, height, latency, err)
+			}(n)
+		}
+		wg.Wait()
+
+		select {
+		case <-stopping:
+			return
+		case <-time.After(config().healthInterval):
+		}
+	}
+}
+
+// checkNode asks a node for its block count, timing the round trip.
+func checkNode(n remoteNode) (int64, time.Duration, error) {
+	cfg := config()
+	timeout := healthCheckTimeout
+	if cfg.socksProxy != "" {
+		timeout = socksDialTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	body := []byte(`{"jsonrpc":"1.0","id":"health","method":"getblockcount","params":[]}`)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.rpcUpstream, bytes.NewReader(body))
+	if err != nil {
+		return 0, 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if n.auth != "" {
+		req.Header.Set("Authorization", n.auth)
+	}
+
+	started := time.Now()
+	resp, err := cfg.client.Do(req)
+	if err != nil {
+		return 0, 0, upstreamError(ctx, err)
+	}
+	defer resp.Body.Close()
+	latency := time.Since(started)
+
+	if resp.StatusCode == http.StatusUnauthorized {
+		return 0, 0, errors.New("credentials rejected")
+	}
+	var reply struct {
+		Result int64     `json:"result"`
+		Error  *rpcError `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&reply); err != nil {
+		return 0, 0, fmt.Errorf("unexpected response (status %d): %v", resp.StatusCode, err)
+	}
+	if reply.Error != nil {
+		return 0, 0, fmt.Errorf("RPC error %d: %s", reply.Error.Code, reply.Error.Message)
+	}
+	return reply.Result, latency, nil
+}
+
+// isDialError reports whether err means the node could not be reached at
+// all, so the request never got to it and can safely go elsewhere.
+func isDialError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
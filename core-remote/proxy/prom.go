@@ -0,0 +1,206 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// A minimal Prometheus text exposition (version 0.0.4) registry, enough
+// for counters, gauges and histograms with labels.
+
+type promMetric interface {
+	write(w io.Writer)
+}
+
+var promRegistry []promMetric
+
+type promCounter struct {
+	mu     sync.Mutex
+	name   string
+	help   string
+	labels []string
+	values map[string]float64
+}
+
+func newCounter(name, help string, labels ...string) *promCounter {
+	c := &promCounter{name: name, help: help, labels: labels, values: map[string]float64{}}
+	promRegistry = append(promRegistry, c)
+	return c
+}
+
+func (c *promCounter) add(v float64, labelValues ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.values[strings.Join(labelValues, "\xff")] += v
+}
+
+func (c *promCounter) inc(labelValues ...string) {
+	c.add(1, labelValues...)
+}
+
+// total sums the counter across all label values.
+func (c *promCounter) total() float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var sum float64
+	for _, v := range c.values {
+		sum += v
+	}
+	return sum
+}
+
+func (c *promCounter) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	if len(c.labels) == 0 {
+		fmt.Fprintf(w, "%s %s\n", c.name, formatFloat(c.values[""]))
+		return
+	}
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, formatLabels(c.labels, key, "", ""), formatFloat(c.values[key]))
+	}
+}
+
+type promGauge struct {
+	name  string
+	help  string
+	value func() float64
+}
+
+func newGauge(name, help string, value func() float64) *promGauge {
+	g := &promGauge{name: name, help: help, value: value}
+	promRegistry = append(promRegistry, g)
+	return g
+}
+
+func (g *promGauge) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %s\n", g.name, g.help, g.name, g.name, formatFloat(g.value()))
+}
+
+// promGaugeVec is a gauge with one label whose series are read at scrape
+// time, keyed by label value.
+type promGaugeVec struct {
+	name   string
+	help   string
+	label  string
+	values func() map[string]float64
+}
+
+func newGaugeVec(name, help, label string, values func() map[string]float64) *promGaugeVec {
+	g := &promGaugeVec{name: name, help: help, label: label, values: values}
+	promRegistry = append(promRegistry, g)
+	return g
+}
+
+func (g *promGaugeVec) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", g.name, g.help, g.name)
+	values := g.values()
+	for _, key := range sortedKeys(values) {
+		fmt.Fprintf(w, "%s%s %s\n", g.name, formatLabels([]string{g.label}, key, "", ""), formatFloat(values[key]))
+	}
+}
+
+type histogramSeries struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+type promHistogram struct {
+	mu      sync.Mutex
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+	series  map[string]*histogramSeries
+}
+
+func newHistogram(name, help string, buckets []float64, labels ...string) *promHistogram {
+	h := &promHistogram{name: name, help: help, labels: labels, buckets: buckets, series: map[string]*histogramSeries{}}
+	promRegistry = append(promRegistry, h)
+	return h
+}
+
+func (h *promHistogram) observe(v float64, labelValues ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	key := strings.Join(labelValues, "\xff")
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogramSeries{counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+	for i, upper := range h.buckets {
+		if v <= upper {
+			s.counts[i]++
+		}
+	}
+	s.sum += v
+	s.count++
+}
+
+func (h *promHistogram) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	keys := make([]string, 0, len(h.series))
+	for key := range h.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := h.series[key]
+		for i, upper := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, key, "le", formatFloat(upper)), s.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, key, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(h.labels, key, "", ""), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, key, "", ""), s.count)
+	}
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// formatLabels renders {name="value",...} for a joined label key, with
+// an optional extra label such as a histogram's le.
+func formatLabels(names []string, key, extraName, extraValue string) string {
+	var pairs []string
+	if len(names) > 0 {
+		for i, value := range strings.Split(key, "\xff") {
+			if i < len(names) {
+				pairs = append(pairs, names[i]+"="+strconv.Quote(value))
+			}
+		}
+	}
+	if extraName != "" {
+		pairs = append(pairs, extraName+"="+strconv.Quote(extraValue))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func promHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	for _, m := range promRegistry {
+		m.write(w)
+	}
+}
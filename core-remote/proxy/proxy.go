@@ -1,111 +1,126 @@
 package main
 
 import (
-	"encoding/base64"
+	"errors"
 	"io"
 	"log"
 	"net"
 	"net/http"
 	"os"
-	"strings"
-	"sync"
+	"path/filepath"
+	"time"
 )
 
-var (
-	pupIP         string
-	remoteHost    string
-	remoteRPCPort string
-	remoteZMQPort string
-	rpcUsername   string
-	rpcPassword   string
-	rpcUpstream   string
-	zmqUpstream   string
-	remoteAuth    string
-	internalAuth  string
-)
+var storageDirectory string
+
+var pupIP string
 
 func main() {
 	pupIP = os.Getenv("DBX_PUP_IP")
 
-	remoteHost = os.Getenv("REMOTE_HOST")
-	remoteRPCPort = os.Getenv("REMOTE_RPC_PORT")
-	remoteZMQPort = os.Getenv("REMOTE_ZMQ_PORT")
-	rpcUsername = os.Getenv("RPC_USERNAME")
-	rpcPassword = os.Getenv("RPC_PASSWORD")
+	log.Printf("Dogecoin Core Remote Proxy starting...")
 
-	// Default ports if not specified
-	if remoteRPCPort == "" {
-		remoteRPCPort = "22555"
+	if err := loadConfig(storageDirectory); err != nil {
+		log.Fatalf("ERROR: %v", err)
 	}
-	if remoteZMQPort == "" {
-		remoteZMQPort = "28332"
+	cfg := config()
+	for i, node := range cfg.nodes {
+		role := "backup"
+		if i == 0 {
+			role = "primary"
+		}
+		log.Printf("  Remote node (%s): RPC %s, ZMQ %s", role, node.rpcUpstream, node.zmqUpstream)
 	}
-
-	rpcUpstream = "http://" + remoteHost + ":" + remoteRPCPort
-	zmqUpstream = remoteHost + ":" + remoteZMQPort
-
-	// Pre-compute auth header for remote Core
-	if rpcUsername != "" && rpcPassword != "" {
-		remoteAuth = "Basic " + base64.StdEncoding.EncodeToString(
-			[]byte(rpcUsername+":"+rpcPassword),
-		)
+	log.Printf("  Config: %s (hash %s)", configPath, cfg.hash)
+	log.Printf("  Link encrypted: %s", linkEncryption(cfg.rpcTLS, cfg.zmqTLS))
+	if cfg.socksProxy != "" {
+		log.Printf("  SOCKS5 proxy: %s", cfg.socksProxy)
 	}
-
-	// Internal auth that local pups will use (same as Core pup uses)
-	internalAuth = "Basic " + base64.StdEncoding.EncodeToString(
-		[]byte("dogebox_core_pup_temporary_static_username:dogebox_core_pup_temporary_static_password"),
-	)
-
-	log.Printf("Dogecoin Core Remote Proxy starting...")
-	log.Printf("  Remote Host: %s", remoteHost)
-	log.Printf("  RPC upstream: %s", rpcUpstream)
-	log.Printf("  ZMQ upstream: %s", zmqUpstream)
-
-	if remoteHost == "" {
-		log.Fatal("ERROR: REMOTE_HOST must be configured")
+	if !cfg.rpcTLS {
+		log.Printf("  WARNING: RPC credentials and chain data go to the remote node in cleartext; set RPC_TLS if the node is behind a TLS proxy")
 	}
 
-	var wg sync.WaitGroup
-	wg.Add(2)
+	store, err := openCredentialStore(filepath.Join(storageDirectory, credentialsFileName))
+	if err != nil {
+		log.Fatalf("Failed to read the issued credentials: %v", err)
+	}
+	credentials = store
+	credentials.revoke(cfg.revoked)
+	if cfg.requireCredentials {
+		log.Printf("  Pup credentials: required, the static login is refused")
+	} else {
+		log.Printf("  Pup credentials: optional, the static login is allowed")
+	}
 
-	go func() {
-		defer wg.Done()
-		startRPCProxy()
-	}()
+	shutdownTimeout := envSeconds("SHUTDOWN_TIMEOUT", 20)
 
-	go func() {
-		defer wg.Done()
-		startZMQProxy()
-	}()
+	if err := openTraffic(filepath.Join(storageDirectory, "recordings")); err != nil {
+		log.Fatalf("Failed to set up traffic recording: %v", err)
+	}
 
-	wg.Wait()
+	relay = newZMQRelay()
+	if replayer != nil {
+		go replayer.playZMQ(relay)
+	} else {
+		go relay.run()
+		go pool.runHealthChecks()
+	}
+	go watchConfig()
+	go startStatusServer()
+	startMetricsServer()
+	startRPCProxy()
+	startZMQProxy()
+
+	sig := waitForSignal()
+	log.Printf("Received %s, shutting down (waiting up to %s for open requests)", sig, shutdownTimeout)
+	shutdown(shutdownTimeout)
+	log.Printf("Shutdown complete")
 }
 
 func startRPCProxy() {
 	listenAddr := pupIP + ":22555"
-	log.Printf("RPC Proxy listening on %s -> %s", listenAddr, rpcUpstream)
+	log.Printf("RPC Proxy listening on %s -> %s", listenAddr, pool.activeNode().rpcUpstream)
 
 	http.HandleFunc("/", rpcProxyHandler)
-	log.Fatal(http.ListenAndServe(listenAddr, nil))
+	http.HandleFunc("/dogebox/credentials", enrollHandler)
+	http.HandleFunc("/dogebox/credentials/rotate", rotateHandler)
+	rpcServer = &http.Server{Addr: listenAddr}
+	go func() {
+		if err := rpcServer.ListenAndServe(); err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
 }
 
 func startZMQProxy() {
 	listenAddr := pupIP + ":28332"
-	log.Printf("ZMQ Proxy listening on %s -> %s", listenAddr, zmqUpstream)
+	log.Printf("ZMQ Proxy listening on %s -> %s", listenAddr, pool.activeNode().zmqUpstream)
 
 	listener, err := net.Listen("tcp", listenAddr)
 	if err != nil {
 		log.Fatalf("Failed to start ZMQ listener: %v", err)
 	}
-	defer listener.Close()
+	zmqListener = listener
+	go acceptZMQ(listener)
+}
 
+func acceptZMQ(listener net.Listener) {
 	for {
 		clientConn, err := listener.Accept()
 		if err != nil {
+			select {
+			case <-stopping:
+				return
+			default:
+			}
 			log.Printf("ZMQ accept error: %v", err)
 			continue
 		}
-		go handleZMQConnection(clientConn)
+		zmqConns.Add(1)
+		go func() {
+			defer zmqConns.Done()
+			handleZMQConnection(clientConn)
+		}()
 	}
 }
 
@@ -113,100 +128,68 @@ func handleZMQConnection(clientConn net.Conn) {
 	defer clientConn.Close()
 
 	log.Printf("ZMQ connection from %s", clientConn.RemoteAddr())
-
-	upstreamConn, err := net.Dial("tcp", zmqUpstream)
-	if err != nil {
-		log.Printf("Failed to connect to ZMQ upstream: %v", err)
-		return
-	}
-	defer upstreamConn.Close()
-
-	// Bidirectional copy
-	var wg sync.WaitGroup
-	wg.Add(2)
-
-	go func() {
-		defer wg.Done()
-		io.Copy(upstreamConn, clientConn)
-		upstreamConn.(*net.TCPConn).CloseWrite()
-	}()
-
-	go func() {
-		defer wg.Done()
-		io.Copy(clientConn, upstreamConn)
-		clientConn.(*net.TCPConn).CloseWrite()
-	}()
-
-	wg.Wait()
-	log.Printf("ZMQ connection from %s closed", clientConn.RemoteAddr())
+	relay.serve(clientConn)
 }
 
 func rpcProxyHandler(w http.ResponseWriter, r *http.Request) {
-	log.Printf("RPC Request: %s %s from %s", r.Method, r.URL.Path, r.RemoteAddr)
+	started := time.Now()
 
-	// Validate incoming auth from local pups
-	auth := r.Header.Get("Authorization")
-	if !validateInternalAuth(auth) {
+	// Identify the local pup by the credential it was issued
+	username, name, ok := authenticateConsumer(r)
+	if !ok {
+		log.Printf("RPC Request: %s %s from %s rejected", r.Method, r.URL.Path, r.RemoteAddr)
+		authFailures.inc()
 		w.Header().Set("WWW-Authenticate", `Basic realm="Dogecoin RPC"`)
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
+	log.Printf("RPC Request: %s %s from %s (%s)", r.Method, r.URL.Path, r.RemoteAddr, name)
+	consumerRequests.inc(username, name)
 
-	// Create upstream request to remote Core
-	proxyReq, err := http.NewRequest(r.Method, rpcUpstream+r.URL.Path, r.Body)
+	// Read the body up front so the call can be counted by method and
+	// given the right timeout
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, config().maxRequestBytes))
 	if err != nil {
-		http.Error(w, "Failed to create request", http.StatusInternalServerError)
-		return
-	}
-
-	// Copy headers
-	for key, values := range r.Header {
-		for _, value := range values {
-			proxyReq.Header.Add(key, value)
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeRPCError(w, http.StatusRequestEntityTooLarge, nil, false, rpcErrInvalidRequest, "Request exceeds the proxy's size limit")
+			return
 		}
+		http.Error(w, "Failed to read request", http.StatusBadRequest)
+		return
 	}
-
-	// Replace auth with remote Core's credentials
-	if remoteAuth != "" {
-		proxyReq.Header.Set("Authorization", remoteAuth)
-	} else {
-		// No remote auth configured, remove the header
-		proxyReq.Header.Del("Authorization")
-	}
+	calls, batch := parseCalls(body)
+	method := methodLabel(calls, batch)
 
 	// Forward request to remote Core
-	client := &http.Client{}
-	resp, err := client.Do(proxyReq)
+	resp, err := routeRPC(r, body, calls, batch, requestTimeout(calls))
 	if err != nil {
 		log.Printf("Upstream request failed: %v", err)
-		http.Error(w, "Upstream error", http.StatusBadGateway)
+		code, status, message := upstreamErrorCode(err)
+		n := writeRPCError(w, status, calls, batch, code, message)
+		upstreamErrors.inc()
+		observeCall(method, status, started, int64(n))
 		return
 	}
-	defer resp.Body.Close()
 
 	// Copy response headers
-	for key, values := range resp.Header {
+	for key, values := range resp.header {
 		for _, value := range values {
 			w.Header().Add(key, value)
 		}
 	}
-	w.WriteHeader(resp.StatusCode)
-	io.Copy(w, resp.Body)
+	w.WriteHeader(resp.status)
+	n, _ := w.Write(resp.body)
+	observeCall(method, resp.status, started, int64(n))
 }
 
-func validateInternalAuth(auth string) bool {
-	if !strings.HasPrefix(auth, "Basic ") {
-		return false
-	}
-	decoded, err := base64.StdEncoding.DecodeString(auth[6:])
-	if err != nil {
-		return false
-	}
-	parts := strings.SplitN(string(decoded), ":", 2)
-	if len(parts) != 2 {
-		return false
-	}
-	// Validate against the internal static credentials
-	return parts[0] == "dogebox_core_pup_temporary_static_username" &&
-		parts[1] == "dogebox_core_pup_temporary_static_password"
+// envFloat reads a numeric pup config value, falling back to def when it
+// is unset or malformed.
+func envFloat(name string, def float64) float64 {
+	return parseFloatSetting(name, os.Getenv(name), def)
+}
+
+// envSeconds reads a duration given in seconds in the pup config.
+func envSeconds(name string, def float64) time.Duration {
+	return time.Duration(envFloat(name, def) * float64(time.Second))
 }
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Load balancing modes for read-only calls, set with LOAD_BALANCING.
+const (
+	balanceOff          = "off"
+	balanceRoundRobin   = "round-robin"
+	balanceLeastLatency = "least-latency"
+)
+
+// Outcomes of a call forwarded to a remote node, as counted per node.
+const (
+	callAnswered = "ok"
+	callRejected = "rejected"
+	callFailed   = "failed"
+)
+
+// readMethods only read chain or mempool data, so any node that is in
+// sync gives the same answer and they can be spread across nodes. Wallet
+// calls are left out, since each node has its own wallet.
+var readMethods = map[string]bool{
+	"getbestblockhash":      true,
+	"getblock":              true,
+	"getblockchaininfo":     true,
+	"getblockcount":         true,
+	"getblockhash":          true,
+	"getblockheader":        true,
+	"getchaintips":          true,
+	"getdifficulty":         true,
+	"getmempoolancestors":   true,
+	"getmempooldescendants": true,
+	"getmempoolentry":       true,
+	"getmempoolinfo":        true,
+	"getrawmempool":         true,
+	"getrawtransaction":     true,
+	"gettxout":              true,
+	"gettxoutproof":         true,
+	"verifytxoutproof":      true,
+	"decoderawtransaction":  true,
+	"decodescript":          true,
+	"estimatefee":           true,
+	"estimatesmartfee":      true,
+}
+
+// broadcastMethods are sent to every node that is not down, so a
+// transaction propagates from several places and one node's mempool
+// policy cannot hold it back.
+var broadcastMethods = map[string]bool{
+	"sendrawtransaction": true,
+}
+
+// routeRPC forwards body to the node or nodes its calls should go to:
+// transactions to every node, read-only calls to the node picked by the
+// load balancing mode, and everything else to the active node.
+func routeRPC(r *http.Request, body []byte, calls []rpcCall, batch bool, timeout time.Duration) (*upstreamReply, error) {
+	if replayer != nil {
+		return forwardRPC(r, body, timeout)
+	}
+	if !batch && len(calls) == 1 && broadcastMethods[strings.ToLower(calls[0].Method)] {
+		return broadcastRPC(r, body, calls[0].Method, timeout)
+	}
+	if mode := config().balancing; mode != balanceOff && readOnly(calls) {
+		return forwardVia(r, body, timeout, func() remoteNode { return pool.readNode(mode) })
+	}
+	return forwardRPC(r, body, timeout)
+}
+
+func readOnly(calls []rpcCall) bool {
+	if len(calls) == 0 {
+		return false
+	}
+	for _, call := range calls {
+		if !readMethods[strings.ToLower(call.Method)] {
+			return false
+		}
+	}
+	return true
+}
+
+// broadcastRPC sends body to every node that is not down and answers
+// with the first reply that accepted it. If no node accepted it, the
+// active node's rejection is passed on, or any other if the active node
+// did not answer.
+func broadcastRPC(r *http.Request, body []byte, method string, timeout time.Duration) (*upstreamReply, error) {
+	nodes := pool.broadcastNodes()
+	if len(nodes) == 1 {
+		return forwardRPC(r, body, timeout)
+	}
+
+	// The broadcast outlives the local request, so a pup that stops
+	// waiting does not keep the transaction from the slower nodes
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	req := r.Clone(ctx)
+
+	type result struct {
+		node  remoteNode
+		reply *upstreamReply
+		err   error
+	}
+	results := make(chan result, len(nodes))
+	var wg sync.WaitGroup
+	for _, n := range nodes {
+		wg.Add(1)
+		go func(n remoteNode) {
+			defer wg.Done()
+			reply, err := forwardTo(ctx, n, req, body)
+			switch callResult(reply, err) {
+			case callFailed:
+				if err == nil {
+					log.Printf("Broadcast of %s to %s failed: HTTP %d", method, n.name, reply.status)
+					break
+				}
+				if isDialError(err) {
+					pool.markDown(n.name, err)
+				}
+				log.Printf("Broadcast of %s to %s failed: %v", method, n.name, err)
+			case callRejected:
+				log.Printf("Broadcast of %s to %s rejected: %s", method, n.name, reply.body)
+			}
+			results <- result{n, reply, err}
+		}(n)
+	}
+	go func() {
+		wg.Wait()
+		cancel()
+	}()
+
+	active := pool.activeNode().name
+	var best *result
+	for range nodes {
+		res := <-results
+		if callResult(res.reply, res.err) == callAnswered {
+			recorder.recordRPC(body, res.reply)
+			return res.reply, nil
+		}
+		if best == nil || (res.reply != nil && (best.reply == nil || res.node.name == active)) {
+			best = &res
+		}
+	}
+	if best.reply == nil {
+		return nil, best.err
+	}
+	recorder.recordRPC(body, best.reply)
+	return best.reply, nil
+}
+
+// callResult classifies the outcome of a call to a node: answered,
+// answered with a JSON-RPC error, or not answered at all. Batches count
+// as answered whenever the node replied to them with a 200.
+func callResult(reply *upstreamReply, err error) string {
+	if err != nil || reply.status == http.StatusUnauthorized || reply.status == http.StatusForbidden {
+		return callFailed
+	}
+	var single struct {
+		Error json.RawMessage `json:"error"`
+	}
+	if json.Unmarshal(reply.body, &single) != nil {
+		if reply.status < http.StatusInternalServerError {
+			return callAnswered
+		}
+		return callFailed
+	}
+	if len(single.Error) > 0 && string(single.Error) != "null" {
+		return callRejected
+	}
+	return callAnswered
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// sharedFiles are kept byte-identical to their originals in other pups'
+// proxies, since the pups are built separately and cannot share a
+// package. The originals are only found in a full checkout.
+var sharedFiles = map[string]string{
+	"traffic.go":     "../../core-gateway/proxy/traffic.go",
+	"credentials.go": "../../core/proxy/credentials.go",
+}
+
+func TestSharedFilesMatchOriginals(t *testing.T) {
+	for name, original := range sharedFiles {
+		want, err := os.ReadFile(filepath.FromSlash(original))
+		if os.IsNotExist(err) {
+			t.Logf("%s: original %s not found, skipping", name, original)
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s differs from %s; copy the original over it", name, original)
+		}
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// contextDialer opens the connections to the remote nodes: directly, or
+// through a SOCKS5 proxy such as Tor or an SSH dynamic forward.
+type contextDialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// directDialer connects straight to the remote nodes.
+var directDialer contextDialer = &net.Dialer{
+	Timeout:   10 * time.Second,
+	KeepAlive: 30 * time.Second,
+}
+
+// socksDialTimeout replaces the health check and ZMQ connect timeouts
+// when dialing through SOCKS, since building a Tor circuit can take
+// several seconds.
+const socksDialTimeout = 20 * time.Second
+
+// socks5Dialer connects through a SOCKS5 proxy (RFC 1928), logging in
+// with a username and password (RFC 1929) when they are set. Host names
+// are passed to the proxy unresolved, so onion addresses work and DNS
+// lookups do not leak around the proxy.
+type socks5Dialer struct {
+	proxyAddr string
+	username  string
+	password  string
+	// forward opens the connection to the proxy itself.
+	forward contextDialer
+}
+
+func newSOCKS5Dialer(proxyAddr, username, password string) *socks5Dialer {
+	return &socks5Dialer{proxyAddr: proxyAddr, username: username, password: password, forward: directDialer}
+}
+
+// SOCKS5 protocol values used by the dialer.
+const (
+	socksVersion         = 5
+	socksLoginVersion    = 1 // of the RFC 1929 subnegotiation
+	socksAuthNone        = 0
+	socksAuthPassword    = 2
+	socksAuthUnavailable = 0xff
+	socksCmdConnect      = 1
+	socksAddrIPv4        = 1
+	socksAddrDomain      = 3
+	socksAddrIPv6        = 4
+)
+
+var socksReplies = map[byte]string{
+	1: "general SOCKS server failure",
+	2: "connection not allowed by ruleset",
+	3: "network unreachable",
+	4: "host unreachable",
+	5: "connection refused",
+	6: "TTL expired",
+	7: "command not supported",
+	8: "address type not supported",
+}
+
+// DialContext connects to address through the proxy. Failures are
+// reported as dial errors, so the node is failed over like one that
+// refused the connection directly.
+func (d *socks5Dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if network != "tcp" && network != "tcp4" && network != "tcp6" {
+		return nil, fmt.Errorf("SOCKS5: network %s not supported", network)
+	}
+	conn, err := d.forward.DialContext(ctx, "tcp", d.proxyAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	// Give up on the handshake when ctx is cancelled without a deadline
+	stop, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Unix(1, 0))
+		case <-stop:
+		}
+	}()
+	err = d.connect(conn, address)
+	close(stop)
+	<-stopped
+
+	if err == nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		conn.Close()
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		return nil, &net.OpError{Op: "dial", Net: network, Err: fmt.Errorf("SOCKS5 proxy %s: %v", d.proxyAddr, err)}
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// connect runs the SOCKS5 handshake on conn, asking the proxy to
+// connect to address.
+func (d *socks5Dialer) connect(conn net.Conn, address string) error {
+	host, portText, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.Atoi(portText)
+	if err != nil || port < 1 || port > 65535 {
+		return fmt.Errorf("invalid port %q", portText)
+	}
+
+	method := byte(socksAuthNone)
+	if d.username != "" {
+		method = socksAuthPassword
+	}
+	if _, err := conn.Write([]byte{socksVersion, 1, method}); err != nil {
+		return err
+	}
+	var choice [2]byte
+	if _, err := io.ReadFull(conn, choice[:]); err != nil {
+		return err
+	}
+	if choice[0] != socksVersion {
+		return fmt.Errorf("not a SOCKS5 server (version %d)", choice[0])
+	}
+	switch choice[1] {
+	case method:
+	case socksAuthUnavailable:
+		if method == socksAuthPassword {
+			return errors.New("proxy does not accept username and password login")
+		}
+		return errors.New("proxy requires a login")
+	default:
+		return fmt.Errorf("proxy chose unexpected auth method %d", choice[1])
+	}
+	if method == socksAuthPassword {
+		if err := d.login(conn); err != nil {
+			return err
+		}
+	}
+
+	req := []byte{socksVersion, socksCmdConnect, 0}
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			req = append(append(req, socksAddrIPv4), ip4...)
+		} else {
+			req = append(append(req, socksAddrIPv6), ip...)
+		}
+	} else {
+		if len(host) > 255 {
+			return errors.New("host name too long")
+		}
+		req = append(append(req, socksAddrDomain, byte(len(host))), host...)
+	}
+	req = binary.BigEndian.AppendUint16(req, uint16(port))
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	var reply [4]byte
+	if _, err := io.ReadFull(conn, reply[:]); err != nil {
+		return err
+	}
+	if reply[0] != socksVersion {
+		return fmt.Errorf("not a SOCKS5 reply (version %d)", reply[0])
+	}
+	if reply[1] != 0 {
+		if reason, ok := socksReplies[reply[1]]; ok {
+			return fmt.Errorf("connecting to %s: %s", address, reason)
+		}
+		return fmt.Errorf("connecting to %s: reply code %d", address, reply[1])
+	}
+
+	// Skip the bound address the proxy reports
+	var skip int
+	switch reply[3] {
+	case socksAddrIPv4:
+		skip = net.IPv4len
+	case socksAddrIPv6:
+		skip = net.IPv6len
+	case socksAddrDomain:
+		var n [1]byte
+		if _, err := io.ReadFull(conn, n[:]); err != nil {
+			return err
+		}
+		skip = int(n[0])
+	default:
+		return fmt.Errorf("unknown bound address type %d", reply[3])
+	}
+	_, err = io.ReadFull(conn, make([]byte, skip+2))
+	return err
+}
+
+// login sends the username and password (RFC 1929).
+func (d *socks5Dialer) login(conn net.Conn) error {
+	if len(d.username) > 255 || len(d.password) > 255 {
+		return errors.New("username or password too long")
+	}
+	req := []byte{socksLoginVersion, byte(len(d.username))}
+	req = append(req, d.username...)
+	req = append(req, byte(len(d.password)))
+	req = append(req, d.password...)
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+	var reply [2]byte
+	if _, err := io.ReadFull(conn, reply[:]); err != nil {
+		return err
+	}
+	if reply[0] != socksLoginVersion {
+		return fmt.Errorf("not a SOCKS5 login reply (version %d)", reply[0])
+	}
+	if reply[1] != 0 {
+		return errors.New("proxy rejected the username and password")
+	}
+	return nil
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// socksRequest is what the test server saw of one SOCKS5 handshake.
+type socksRequest struct {
+	methods  []byte
+	username string
+	password string
+	addrType byte
+	host     string
+	port     uint16
+}
+
+// socksServer is a minimal SOCKS5 server on 127.0.0.1. It answers the
+// CONNECT with reply, whose bound address is of type boundType, and then
+// writes "hello" so the test can tell the dialer read exactly the
+// handshake and no more.
+type socksServer struct {
+	listener  net.Listener
+	login     bool
+	loginOK   bool
+	loginVer  byte
+	version   byte
+	reply     byte
+	boundType byte
+	requests  chan socksRequest
+}
+
+func startSOCKSServer(t *testing.T) *socksServer {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &socksServer{
+		listener:  l,
+		loginOK:   true,
+		loginVer:  socksLoginVersion,
+		version:   socksVersion,
+		boundType: socksAddrIPv4,
+		requests:  make(chan socksRequest, 1),
+	}
+	t.Cleanup(func() { l.Close() })
+	return s
+}
+
+func (s *socksServer) serve(t *testing.T) {
+	go func() {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		if err := s.handle(conn); err != nil {
+			t.Errorf("SOCKS server: %v", err)
+		}
+	}()
+}
+
+func (s *socksServer) handle(conn net.Conn) error {
+	var req socksRequest
+	head := make([]byte, 2)
+	if _, err := io.ReadFull(conn, head); err != nil {
+		return err
+	}
+	req.methods = make([]byte, head[1])
+	if _, err := io.ReadFull(conn, req.methods); err != nil {
+		return err
+	}
+	method := byte(socksAuthNone)
+	if s.login {
+		method = socksAuthPassword
+	}
+	if !bytes.Contains(req.methods, []byte{method}) {
+		conn.Write([]byte{socksVersion, socksAuthUnavailable})
+		s.requests <- req
+		return nil
+	}
+	conn.Write([]byte{socksVersion, method})
+
+	if s.login {
+		var err error
+		if req.username, req.password, err = readSOCKSLogin(conn); err != nil {
+			return err
+		}
+		if !s.loginOK || s.loginVer != socksLoginVersion {
+			status := byte(0)
+			if !s.loginOK {
+				status = 1
+			}
+			conn.Write([]byte{s.loginVer, status})
+			s.requests <- req
+			return nil
+		}
+		conn.Write([]byte{s.loginVer, 0})
+	}
+
+	connect := make([]byte, 4)
+	if _, err := io.ReadFull(conn, connect); err != nil {
+		return err
+	}
+	req.addrType = connect[3]
+	switch req.addrType {
+	case socksAddrDomain:
+		n := make([]byte, 1)
+		if _, err := io.ReadFull(conn, n); err != nil {
+			return err
+		}
+		host := make([]byte, n[0])
+		if _, err := io.ReadFull(conn, host); err != nil {
+			return err
+		}
+		req.host = string(host)
+	case socksAddrIPv4, socksAddrIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if req.addrType == socksAddrIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return err
+		}
+		req.host = ip.String()
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(conn, port); err != nil {
+		return err
+	}
+	req.port = binary.BigEndian.Uint16(port)
+	s.requests <- req
+
+	reply := []byte{s.version, s.reply, 0, s.boundType}
+	switch s.boundType {
+	case socksAddrIPv4:
+		reply = append(reply, 10, 0, 0, 1)
+	case socksAddrIPv6:
+		reply = append(reply, net.ParseIP("fd00::1")...)
+	case socksAddrDomain:
+		reply = append(append(reply, 11), "proxy.local"...)
+	}
+	reply = append(reply, 0x1f, 0x90)
+	_, err := conn.Write(append(reply, "hello"...))
+	return err
+}
+
+func readSOCKSLogin(conn net.Conn) (string, string, error) {
+	field := func() (string, error) {
+		n := make([]byte, 1)
+		if _, err := io.ReadFull(conn, n); err != nil {
+			return "", err
+		}
+		b := make([]byte, n[0])
+		_, err := io.ReadFull(conn, b)
+		return string(b), err
+	}
+	version := make([]byte, 1)
+	if _, err := io.ReadFull(conn, version); err != nil {
+		return "", "", err
+	}
+	username, err := field()
+	if err != nil {
+		return "", "", err
+	}
+	password, err := field()
+	return username, password, err
+}
+
+func dialSOCKS(t *testing.T, s *socksServer, username, password, address string) (net.Conn, error) {
+	t.Helper()
+	s.serve(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return newSOCKS5Dialer(s.listener.Addr().String(), username, password).DialContext(ctx, "tcp", address)
+}
+
+// expectHello checks that the dialer left the connection right after the
+// handshake, with the bound address skipped.
+func expectHello(t *testing.T, conn net.Conn) {
+	t.Helper()
+	defer conn.Close()
+	got := make([]byte, 5)
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "hello" {
+		t.Fatalf("read %q after the handshake, want %q", got, "hello")
+	}
+}
+
+func TestSOCKS5SendsHostNameUnresolved(t *testing.T) {
+	s := startSOCKSServer(t)
+	const onion = "dogecoinnodeexampleaddressxxxxxxxxxxxxxxxxxxxxxxxxxxxxxx.onion"
+	conn, err := dialSOCKS(t, s, "", "", onion+":22555")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectHello(t, conn)
+
+	req := <-s.requests
+	if !bytes.Equal(req.methods, []byte{socksAuthNone}) {
+		t.Errorf("offered auth methods %v, want [%d]", req.methods, socksAuthNone)
+	}
+	if req.addrType != socksAddrDomain {
+		t.Errorf("CONNECT address type %d, want %d", req.addrType, socksAddrDomain)
+	}
+	if req.host != onion || req.port != 22555 {
+		t.Errorf("CONNECT to %s:%d, want %s:22555", req.host, req.port, onion)
+	}
+}
+
+func TestSOCKS5SendsIPAddresses(t *testing.T) {
+	for _, tc := range []struct {
+		address  string
+		addrType byte
+		host     string
+	}{
+		{"192.0.2.7:22555", socksAddrIPv4, "192.0.2.7"},
+		{"[2001:db8::7]:22555", socksAddrIPv6, "2001:db8::7"},
+	} {
+		s := startSOCKSServer(t)
+		conn, err := dialSOCKS(t, s, "", "", tc.address)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.address, err)
+		}
+		expectHello(t, conn)
+		req := <-s.requests
+		if req.addrType != tc.addrType || req.host != tc.host {
+			t.Errorf("%s: CONNECT with type %d to %s, want type %d to %s",
+				tc.address, req.addrType, req.host, tc.addrType, tc.host)
+		}
+	}
+}
+
+func TestSOCKS5Login(t *testing.T) {
+	s := startSOCKSServer(t)
+	s.login = true
+	conn, err := dialSOCKS(t, s, "shibe", "such-secret", "node.example:22555")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectHello(t, conn)
+
+	req := <-s.requests
+	if !bytes.Equal(req.methods, []byte{socksAuthPassword}) {
+		t.Errorf("offered auth methods %v, want [%d]", req.methods, socksAuthPassword)
+	}
+	if req.username != "shibe" || req.password != "such-secret" {
+		t.Errorf("logged in as %q/%q, want shibe/such-secret", req.username, req.password)
+	}
+}
+
+func TestSOCKS5SkipsBoundAddress(t *testing.T) {
+	for _, boundType := range []byte{socksAddrIPv4, socksAddrIPv6, socksAddrDomain} {
+		s := startSOCKSServer(t)
+		s.boundType = boundType
+		conn, err := dialSOCKS(t, s, "", "", "node.example:22555")
+		if err != nil {
+			t.Fatalf("bound address type %d: %v", boundType, err)
+		}
+		expectHello(t, conn)
+		<-s.requests
+	}
+}
+
+func TestSOCKS5Failures(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		setup  func(*socksServer)
+		user   string
+		expect string
+	}{
+		{"login rejected", func(s *socksServer) { s.login = true; s.loginOK = false }, "shibe", "rejected the username and password"},
+		{"login required", func(s *socksServer) { s.login = true }, "", "requires a login"},
+		{"connect refused", func(s *socksServer) { s.reply = 5 }, "", "connection refused"},
+		{"reply version", func(s *socksServer) { s.version = 4 }, "", "not a SOCKS5 reply"},
+		{"login reply version", func(s *socksServer) { s.login = true; s.loginVer = 5 }, "shibe", "not a SOCKS5 login reply"},
+	} {
+		s := startSOCKSServer(t)
+		tc.setup(s)
+		conn, err := dialSOCKS(t, s, tc.user, "pw", "node.example:22555")
+		if err == nil {
+			conn.Close()
+			t.Errorf("%s: dial succeeded", tc.name)
+			continue
+		}
+		if !strings.Contains(err.Error(), tc.expect) {
+			t.Errorf("%s: got %v, want an error mentioning %q", tc.name, err, tc.expect)
+		}
+		<-s.requests
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+)
+
+// statusListenAddr is only reachable from inside the pup; the monitor
+// reads it to include the proxy's own state in the pup's metrics.
+const statusListenAddr = "127.0.0.1:22599"
+
+func startStatusServer() {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", statusHandler)
+	mux.HandleFunc("/blockchaininfo", blockchainInfoHandler)
+
+	log.Printf("Status endpoint listening on %s", statusListenAddr)
+	if err := http.ListenAndServe(statusListenAddr, mux); err != nil {
+		log.Printf("Status endpoint failed: %v", err)
+	}
+}
+
+func statusHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	cfg := config()
+	active := pool.activeNode()
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"config": map[string]interface{}{
+			"remote_host": active.host,
+			"version":     cfg.version,
+			"hash":        cfg.hash,
+		},
+		"active_node": active.name,
+		"nodes":       pool.states(),
+		"tls": map[string]interface{}{
+			"rpc":       cfg.rpcTLS,
+			"zmq":       cfg.zmqTLS,
+			"encrypted": linkEncryption(cfg.rpcTLS, cfg.zmqTLS),
+		},
+		"socks_proxy": cfg.socksProxy,
+		"credentials": map[string]interface{}{
+			"required":        cfg.requireCredentials,
+			"consumers":       credentials.states(),
+			"static_requests": credentials.staticRequests.Load(),
+		},
+		"rpc": map[string]interface{}{
+			"requests":        int64(rpcRequests.total()),
+			"upstream_errors": int64(upstreamErrors.total()),
+			"auth_failures":   int64(authFailures.total()),
+		},
+		"zmq": map[string]interface{}{
+			"upstream":    active.zmqUpstream,
+			"connected":   relay.connected.Load(),
+			"received":    relay.received.Load(),
+			"subscribers": relay.stats(),
+		},
+	})
+}
+
+// blockchainInfoHandler asks the remote node for getblockchaininfo with
+// the current upstream settings, so the monitor follows config reloads
+// without credentials of its own. The call is not counted in the RPC
+// metrics.
+func blockchainInfoHandler(w http.ResponseWriter, r *http.Request) {
+	body := []byte(`{"jsonrpc":"1.0","id":"monitor","method":"getblockchaininfo","params":[]}`)
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodPost, "/", bytes.NewReader(body))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	reply, err := forwardRPC(req, body, 10*time.Second)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(reply.status)
+	w.Write(reply.body)
+}
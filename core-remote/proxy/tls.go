@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+var _ = newGaugeVec("remote_link_encrypted",
+	"Whether traffic to the active remote node is sent over TLS, by channel (rpc or zmq).", "channel",
+	func() map[string]float64 {
+		cfg := config()
+		return map[string]float64{"rpc": boolFloat(cfg.rpcTLS), "zmq": boolFloat(cfg.zmqTLS)}
+	})
+
+// newTLSConfig builds the client TLS settings for the remote nodes.
+// Certificates are checked against caBundle (PEM), or the system roots
+// when it is empty. With pins set, a certificate chain is accepted only
+// if its leaf, or a certificate the leaf chains up to, matches a pin, and
+// the CA check is skipped, so a node can use a self-signed certificate.
+func newTLSConfig(caBundle, pins, serverName string) (*tls.Config, error) {
+	c := &tls.Config{MinVersion: tls.VersionTLS12, ServerName: serverName}
+
+	if strings.TrimSpace(caBundle) != "" {
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM([]byte(caBundle)) {
+			return nil, errors.New("TLS_CA_BUNDLE holds no PEM certificates")
+		}
+		c.RootCAs = roots
+	}
+
+	pinned, err := parsePins(pins)
+	if err != nil {
+		return nil, err
+	}
+	if len(pinned) > 0 {
+		c.InsecureSkipVerify = true
+		c.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			return verifyPinned(rawCerts, pinned)
+		}
+	}
+	return c, nil
+}
+
+// verifyPinned accepts a chain whose leaf matches a pin, or which the
+// leaf chains up to through a pinned certificate. The chain is checked
+// with the pinned certificate as the only root, so a certificate merely
+// appended to the chain cannot vouch for a leaf it did not sign.
+func verifyPinned(rawCerts [][]byte, pinned [][]byte) error {
+	certs := make([]*x509.Certificate, 0, len(rawCerts))
+	for _, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return fmt.Errorf("parsing certificate: %v", err)
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return errors.New("no certificate presented")
+	}
+	for i, cert := range certs {
+		if !matchesPin(cert, pinned) {
+			continue
+		}
+		if i == 0 {
+			return nil
+		}
+		roots := x509.NewCertPool()
+		roots.AddCert(cert)
+		intermediates := x509.NewCertPool()
+		for _, c := range certs[1:i] {
+			intermediates.AddCert(c)
+		}
+		_, err := certs[0].Verify(x509.VerifyOptions{
+			Roots:         roots,
+			Intermediates: intermediates,
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		})
+		if err == nil {
+			return nil
+		}
+	}
+	return errors.New("certificate does not match any pinned key")
+}
+
+func matchesPin(cert *x509.Certificate, pinned [][]byte) bool {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	for _, pin := range pinned {
+		if bytes.Equal(sum[:], pin) {
+			return true
+		}
+	}
+	return false
+}
+
+// parsePins reads TLS_PIN_SHA256: SHA-256 digests of a certificate's
+// SubjectPublicKeyInfo, in base64 (optionally prefixed with sha256/) or
+// hex, separated by commas or whitespace.
+func parsePins(list string) ([][]byte, error) {
+	var pins [][]byte
+	for _, field := range strings.FieldsFunc(list, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\n' || r == '\r' || r == '\t'
+	}) {
+		field = strings.TrimPrefix(field, "sha256/")
+		pin, err := hex.DecodeString(field)
+		if err != nil || len(pin) != sha256.Size {
+			pin, err = base64.StdEncoding.DecodeString(field)
+		}
+		if err != nil || len(pin) != sha256.Size {
+			return nil, fmt.Errorf("TLS_PIN_SHA256: %q is not a SHA-256 digest in base64 or hex", field)
+		}
+		pins = append(pins, pin)
+	}
+	return pins, nil
+}
+
+// dialZMQ connects to a node's ZMQ publisher with the configured dialer,
+// and through TLS when ZMQ_TLS is set, for example to an stunnel in
+// front of Core on the remote host.
+func dialZMQ(node remoteNode) (net.Conn, error) {
+	cfg := config()
+	timeout := 10 * time.Second
+	if cfg.socksProxy != "" {
+		timeout = socksDialTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	conn, err := cfg.dialer.DialContext(ctx, "tcp", node.zmqUpstream)
+	if err != nil {
+		return nil, err
+	}
+	if !cfg.zmqTLS {
+		return conn, nil
+	}
+
+	tlsConfig := cfg.tlsConfig.Clone()
+	if tlsConfig.ServerName == "" {
+		tlsConfig.ServerName = node.host
+	}
+	tlsConn := tls.Client(conn, tlsConfig)
+	tlsConn.SetDeadline(time.Now().Add(10 * time.Second))
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("TLS handshake: %v", err)
+	}
+	tlsConn.SetDeadline(time.Time{})
+	return tlsConn, nil
+}
+
+// linkEncryption describes how much of the traffic to the remote nodes
+// is encrypted, for the logs and the pup's metrics.
+func linkEncryption(rpcTLS, zmqTLS bool) string {
+	switch {
+	case rpcTLS && zmqTLS:
+		return "Yes"
+	case rpcTLS:
+		return "RPC only"
+	case zmqTLS:
+		return "ZMQ only"
+	}
+	return "No"
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// newUpstreamClient returns the client for calls to the remote nodes,
+// one per config so connections are kept alive and reused until the TLS
+// or SOCKS settings change. Deadlines are set per call rather than on the client,
+// since some methods legitimately take much longer than others.
+func newUpstreamClient(tlsConfig *tls.Config, dialer contextDialer) *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			TLSClientConfig:     tlsConfig,
+			TLSHandshakeTimeout: 10 * time.Second,
+			MaxIdleConns:        64,
+			MaxIdleConnsPerHost: 64,
+			IdleConnTimeout:     90 * time.Second,
+		},
+	}
+}
+
+// JSON-RPC error codes for failures the proxy reports itself.
+const (
+	rpcErrInvalidRequest = -32600
+	rpcErrInternal       = -32603
+	rpcErrTimeout        = -32003
+)
+
+var (
+	errUpstreamTimeout  = errors.New("upstream timed out")
+	errResponseTooLarge = errors.New("upstream response too large")
+)
+
+// slowMethods are the calls that scan the chainstate or wallet and can
+// run for minutes on a large node.
+var slowMethods = map[string]bool{
+	"gettxoutsetinfo": true,
+	"verifychain":     true,
+	"importwallet":    true,
+	"importprivkey":   true,
+	"importaddress":   true,
+	"importpubkey":    true,
+	"dumpwallet":      true,
+	"backupwallet":    true,
+	"pruneblockchain": true,
+}
+
+// rpcCall is the part of a JSON-RPC call the proxy looks at.
+type rpcCall struct {
+	ID     json.RawMessage `json:"id"`
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params"`
+}
+
+// parseCalls decodes a single call or a batch. Bodies that are not
+// JSON-RPC at all yield no calls and are passed through untouched.
+func parseCalls(body []byte) (calls []rpcCall, batch bool) {
+	if strings.HasPrefix(strings.TrimSpace(string(body)), "[") {
+		json.Unmarshal(body, &calls)
+		return calls, true
+	}
+	var call rpcCall
+	if json.Unmarshal(body, &call) == nil {
+		calls = append(calls, call)
+	}
+	return calls, false
+}
+
+// callTimeout picks the deadline for a call. Fully decoded blocks
+// (getblock with verbosity 2) are much larger than the default verbose
+// output, so they get the slow timeout as well.
+func callTimeout(method string, params json.RawMessage) time.Duration {
+	method = strings.ToLower(method)
+	if slowMethods[method] {
+		return config().rpcSlowTimeout
+	}
+	if method == "getblock" {
+		var args []json.RawMessage
+		if json.Unmarshal(params, &args) == nil && len(args) > 1 && string(args[1]) == "2" {
+			return config().rpcSlowTimeout
+		}
+	}
+	return config().rpcTimeout
+}
+
+// requestTimeout gives a batch as long as its slowest entry would get on
+// its own.
+func requestTimeout(calls []rpcCall) time.Duration {
+	timeout := config().rpcTimeout
+	for _, call := range calls {
+		if t := callTimeout(call.Method, call.Params); t > timeout {
+			timeout = t
+		}
+	}
+	return timeout
+}
+
+// upstreamReply is the remote node's answer, read in full.
+type upstreamReply struct {
+	status int
+	header http.Header
+	body   []byte
+}
+
+// forwardRPC sends body to the active remote node on behalf of the local
+// request r and reads the reply within timeout.
+func forwardRPC(r *http.Request, body []byte, timeout time.Duration) (*upstreamReply, error) {
+	return forwardVia(r, body, timeout, pool.activeNode)
+}
+
+// forwardVia sends body to the node pick returns. If the node cannot be
+// reached at all it is marked down and the call goes to the node pick
+// returns next; a call that reached a node is never sent twice.
+func forwardVia(r *http.Request, body []byte, timeout time.Duration, pick func() remoteNode) (*upstreamReply, error) {
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+
+	tried := map[string]bool{}
+	node := pick()
+	for {
+		tried[node.name] = true
+		reply, err := forwardTo(ctx, node, r, body)
+		if err == nil {
+			recorder.recordRPC(body, reply)
+			return reply, nil
+		}
+		if replayer != nil || !isDialError(err) {
+			return nil, err
+		}
+		pool.markDown(node.name, err)
+		next := pick()
+		if tried[next.name] {
+			return nil, err
+		}
+		log.Printf("Remote node %s unreachable, retrying on %s: %v", node.name, next.name, err)
+		node = next
+	}
+}
+
+// forwardTo sends body to node, swapping the internal credentials for
+// the node's, and counts the outcome against the node.
+func forwardTo(ctx context.Context, node remoteNode, r *http.Request, body []byte) (*upstreamReply, error) {
+	proxyReq, err := http.NewRequestWithContext(ctx, r.Method, node.rpcUpstream+r.URL.Path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	// Copy headers
+	for key, values := range r.Header {
+		for _, value := range values {
+			proxyReq.Header.Add(key, value)
+		}
+	}
+
+	// Replace auth with the node's credentials
+	if node.auth != "" {
+		proxyReq.Header.Set("Authorization", node.auth)
+	} else {
+		// No remote auth configured, remove the header
+		proxyReq.Header.Del("Authorization")
+	}
+
+	reply, err := sendUpstream(ctx, proxyReq, body)
+	if replayer == nil {
+		pool.countCall(node.name, callResult(reply, err))
+	}
+	return reply, err
+}
+
+// sendUpstream sends req, whose body is body, to the remote node and
+// reads the reply. When replaying a recording the reply comes from the
+// recording instead.
+func sendUpstream(ctx context.Context, req *http.Request, body []byte) (*upstreamReply, error) {
+	if replayer != nil {
+		return replayer.reply(body), nil
+	}
+
+	resp, err := config().client.Do(req)
+	if err != nil {
+		return nil, upstreamError(ctx, err)
+	}
+	defer resp.Body.Close()
+
+	data, err := readLimited(resp.Body, config().maxResponseBytes)
+	if err != nil {
+		return nil, upstreamError(ctx, err)
+	}
+	return &upstreamReply{status: resp.StatusCode, header: resp.Header, body: data}, nil
+}
+
+// upstreamError reports a deadline hit while talking to the remote node
+// as errUpstreamTimeout.
+func upstreamError(ctx context.Context, err error) error {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return errUpstreamTimeout
+	}
+	return err
+}
+
+// readLimited reads r to the end, failing with errResponseTooLarge
+// rather than buffering more than max bytes.
+func readLimited(r io.Reader, max int64) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, max+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > max {
+		return nil, errResponseTooLarge
+	}
+	return data, nil
+}
+
+func upstreamErrorCode(err error) (code, status int, message string) {
+	switch err {
+	case errUpstreamTimeout:
+		return rpcErrTimeout, http.StatusGatewayTimeout, "Remote node did not respond in time"
+	case errResponseTooLarge:
+		return rpcErrInternal, http.StatusBadGateway, "Response exceeds the proxy's size limit"
+	}
+	return rpcErrInternal, http.StatusBadGateway, "Upstream error"
+}
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type rpcResponse struct {
+	Result json.RawMessage `json:"result"`
+	Error  *rpcError       `json:"error"`
+	ID     json.RawMessage `json:"id"`
+}
+
+// errorReply builds a JSON-RPC error object in the same shape Core uses.
+func errorReply(id json.RawMessage, code int, message string) json.RawMessage {
+	if len(id) == 0 {
+		id = json.RawMessage("null")
+	}
+	reply, _ := json.Marshal(rpcResponse{
+		Result: json.RawMessage("null"),
+		Error:  &rpcError{Code: code, Message: message},
+		ID:     id,
+	})
+	return reply
+}
+
+// writeRPCError answers with one error object per call, or a single
+// one when the request was not a batch, returning the bytes written.
+func writeRPCError(w http.ResponseWriter, status int, calls []rpcCall, batch bool, code int, message string) int {
+	var reply []byte
+	if batch {
+		replies := make([]json.RawMessage, len(calls))
+		for i, call := range calls {
+			replies[i] = errorReply(call.ID, code, message)
+		}
+		reply, _ = json.Marshal(replies)
+	} else {
+		var id json.RawMessage
+		if len(calls) == 1 {
+			id = calls[0].ID
+		}
+		reply = errorReply(id, code, message)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	n, _ := w.Write(reply)
+	return n
+}
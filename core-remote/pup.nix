@@ -1,6 +1,8 @@
 { pkgs ? import <nixpkgs> {} }:
 
 let
+  storageDirectory = "/storage";
+
   proxy = pkgs.buildGoModule {
     pname = "remote-proxy";
     version = "0.0.1";
@@ -10,7 +12,7 @@ let
     buildPhase = ''
       export GO111MODULE=off
       export GOCACHE=$(pwd)/.gocache
-      go build -o remote-proxy proxy.go
+      go build -ldflags "-X main.storageDirectory=${storageDirectory}" -o remote-proxy .
     '';
 
     installPhase = ''
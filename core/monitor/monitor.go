@@ -26,6 +26,22 @@ type BlockchainInfo struct {
 	SizeOnDisk           int64   `json:"size_on_disk"`
 }
 
+// ProxyStatus is what rpc-proxy reports about the pups using Core on its
+// pup-local status endpoint.
+type ProxyStatus struct {
+	Credentials struct {
+		Consumers []struct {
+			Username string `json:"username"`
+			Name     string `json:"name"`
+			Requests int64  `json:"requests"`
+		} `json:"consumers"`
+		StaticRequests int64 `json:"static_requests"`
+	} `json:"credentials"`
+	AuthFailures int64 `json:"auth_failures"`
+}
+
+const proxyStatusURL = "http://127.0.0.1:22599/status"
+
 func getCredentials() (string, string, error) {
 	rpcUser, err := os.ReadFile("/storage/rpcuser.txt")
 	if err != nil {
@@ -39,9 +55,6 @@ func getCredentials() (string, string, error) {
 		return "", "", err
 	}
 
-	fmt.Printf("RPC User: %s\n", string(rpcUser))
-	fmt.Printf("RPC Password: %s\n", string(rpcPassword))
-
 	return string(rpcUser), string(rpcPassword), nil
 }
 
@@ -50,7 +63,7 @@ func getRawBlockchainInfo(username, password string) (string, error) {
 		filepath.Join(pathToDogecoind, "bin", "dogecoin-cli"),
 		fmt.Sprintf("-rpcuser=%s", strings.TrimSpace(string(username))),
 		fmt.Sprintf("-rpcpassword=%s", strings.TrimSpace(string(password))),
-		fmt.Sprintf("-rpcconnect=%s", os.Getenv("DBX_PUP_IP")),
+		"-rpcconnect=127.0.0.1",
 		"getblockchaininfo",
 	}
 
@@ -66,6 +79,21 @@ func getRawBlockchainInfo(username, password string) (string, error) {
 	return string(output), nil
 }
 
+func getProxyStatus() (*ProxyStatus, error) {
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Get(proxyStatusURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var status ProxyStatus
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
 func parseRawBlockchainInfo(rawInfo string) (BlockchainInfo, error) {
 	var info BlockchainInfo
 	err := json.Unmarshal([]byte(rawInfo), &info)
@@ -99,6 +127,20 @@ func submitMetrics(info BlockchainInfo) {
 		"chain_size_human":       map[string]interface{}{"value": chainSize},
 	}
 
+	if status, err := getProxyStatus(); err != nil {
+		log.Printf("Error getting RPC proxy status: %v", err)
+	} else {
+		var consumers []string
+		for _, c := range status.Credentials.Consumers {
+			consumers = append(consumers, fmt.Sprintf("%s (%s): %d", c.Name, c.Username, c.Requests))
+		}
+		if status.Credentials.StaticRequests > 0 {
+			consumers = append(consumers, fmt.Sprintf("static login: %d", status.Credentials.StaticRequests))
+		}
+		jsonData["consumers"] = map[string]interface{}{"value": strings.Join(consumers, "; ")}
+		jsonData["auth_failures"] = map[string]interface{}{"value": status.AuthFailures}
+	}
+
 	marshalledData, err := json.Marshal(jsonData)
 	if err != nil {
 		log.Printf("Error marshalling blockchain info: %v", err)
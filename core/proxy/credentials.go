@@ -0,0 +1,483 @@
+// Per-pup RPC credentials, issued in place of the static login every pup
+// on the Dogebox shares.
+//
+// core/proxy/credentials.go is the original of this file and
+// core-remote/proxy/credentials.go a byte-identical copy, which a test in
+// core-remote checks. Make changes in the original and copy it over. It
+// relies only on what both proxies define alike: pupIP, authFailures and
+// staticLoginAllowed.
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// credentialsFileName is the file in /storage holding the logins issued
+// to the pups that use the proxy. Only digests of the secrets are kept;
+// each pup keeps its own secret in its own storage.
+const credentialsFileName = "credentials.json"
+
+// The login every pup shared before credentials were issued per pup.
+// Every pup knows it, so any pup using it can pass itself off as another.
+// It is accepted unless REQUIRE_PUP_CREDENTIALS is set, for pups that
+// cannot enroll yet.
+const (
+	staticUsername = "dogebox_core_pup_temporary_static_username"
+	staticPassword = "dogebox_core_pup_temporary_static_password"
+	staticConsumer = "static"
+)
+
+// rotationGrace is how long a secret keeps working after it was
+// rotated, so calls the pup already started with it still go through.
+const rotationGrace = 10 * time.Minute
+
+// reenrollAfter is how long a credential must go unused before the pup
+// at its IP may enroll again in its place. A pup that lost its secret
+// can then recover on its own, without its credential being revoked.
+const reenrollAfter = time.Hour
+
+var (
+	errAlreadyEnrolled = errors.New("this pup already has a credential; rotate it with the current one, enroll again once it has gone unused for an hour, or have it revoked")
+	errNotPup          = errors.New("credentials are only issued to pups on the Dogebox network")
+)
+
+// consumerCredential is the login issued to one pup. It is bound to the
+// IP Dogebox assigned the pup, so a pup cannot use a credential issued
+// to another, and Name is made from that IP rather than anything the pup
+// says about itself.
+type consumerCredential struct {
+	Username string    `json:"username"`
+	Name     string    `json:"name"`
+	IP       string    `json:"ip"`
+	Hash     string    `json:"hash"`
+	Created  time.Time `json:"created"`
+	Rotated  time.Time `json:"rotated"`
+	// PreviousHash is the secret before the last rotation, accepted
+	// until PreviousExpires.
+	PreviousHash    string    `json:"previous_hash,omitempty"`
+	PreviousExpires time.Time `json:"previous_expires,omitempty"`
+
+	requests int64
+	lastSeen time.Time
+}
+
+// credentialStore holds the issued credentials, keyed by username.
+type credentialStore struct {
+	mu        sync.Mutex
+	path      string
+	consumers map[string]*consumerCredential
+	// staticRequests counts the requests made with the static login, and
+	// staticIPs are the pups seen using it.
+	staticRequests atomic.Int64
+	staticIPs      map[string]bool
+	// opened is when the store was read. Use before that is not known,
+	// so credentials count as used then.
+	opened time.Time
+}
+
+var credentials *credentialStore
+
+func openCredentialStore(path string) (*credentialStore, error) {
+	s := &credentialStore{path: path, consumers: map[string]*consumerCredential{}, staticIPs: map[string]bool{}, opened: time.Now()}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var list []*consumerCredential
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, err
+	}
+	for _, c := range list {
+		// Credentials from before names were derived carry the name the
+		// pup chose
+		c.Name = consumerName(c.IP)
+		s.consumers[c.Username] = c
+	}
+	return s, nil
+}
+
+// saveLocked writes the store out; callers must hold s.mu. The file is
+// replaced in one step so a crash cannot leave it half written.
+func (s *credentialStore) saveLocked() error {
+	list := make([]*consumerCredential, 0, len(s.consumers))
+	for _, c := range s.consumers {
+		list = append(list, c)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Username < list[j].Username })
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0700); err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// enroll issues a credential to the pup at ip. A pup that already has
+// one is refused, unless it has gone unused for reenrollAfter; it is
+// then replaced.
+func (s *credentialStore) enroll(ip string) (*consumerCredential, string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var old *consumerCredential
+	for _, c := range s.consumers {
+		if c.IP == ip {
+			if time.Since(s.lastUsedLocked(c)) < reenrollAfter {
+				return nil, "", errAlreadyEnrolled
+			}
+			old = c
+		}
+	}
+	secret, hash := newSecret()
+	now := time.Now().UTC()
+	c := &consumerCredential{
+		Username: "pup-" + randomHex(6),
+		Name:     consumerName(ip),
+		IP:       ip,
+		Hash:     hash,
+		Created:  now,
+		Rotated:  now,
+	}
+	s.consumers[c.Username] = c
+	if old != nil {
+		delete(s.consumers, old.Username)
+	}
+	if err := s.saveLocked(); err != nil {
+		delete(s.consumers, c.Username)
+		if old != nil {
+			s.consumers[old.Username] = old
+		}
+		return nil, "", err
+	}
+	if old != nil {
+		log.Printf("Credentials: %s (%s) went unused for %s, replacing it", old.Username, old.Name, reenrollAfter)
+	}
+	return c, secret, nil
+}
+
+// lastUsedLocked is the last time c is known to have been used or
+// changed; callers must hold s.mu.
+func (s *credentialStore) lastUsedLocked(c *consumerCredential) time.Time {
+	last := s.opened
+	for _, t := range []time.Time{c.Rotated, c.lastSeen} {
+		if t.After(last) {
+			last = t
+		}
+	}
+	return last
+}
+
+// rotate gives c a new secret. The old one keeps working for
+// rotationGrace.
+func (s *credentialStore) rotate(c *consumerCredential) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	prev := *c
+	secret, hash := newSecret()
+	now := time.Now().UTC()
+	c.PreviousHash, c.PreviousExpires = c.Hash, now.Add(rotationGrace)
+	c.Hash, c.Rotated = hash, now
+	if err := s.saveLocked(); err != nil {
+		*c = prev
+		return "", err
+	}
+	return secret, nil
+}
+
+// revoke deletes the credentials with the given usernames, so they stop
+// working at once. The pups can enroll again for new ones.
+func (s *credentialStore) revoke(usernames []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var revoked []string
+	for _, username := range usernames {
+		if c, ok := s.consumers[username]; ok {
+			delete(s.consumers, username)
+			revoked = append(revoked, username+" ("+c.Name+")")
+		}
+	}
+	if len(revoked) == 0 {
+		return
+	}
+	if err := s.saveLocked(); err != nil {
+		log.Printf("Credentials: failed to save revocations: %v", err)
+	}
+	log.Printf("Credentials: revoked %s", strings.Join(revoked, ", "))
+}
+
+// authenticate checks the Basic credentials in auth, sent from ip, and
+// returns the credential they belong to. A secret only works from the
+// IP it was issued to.
+func (s *credentialStore) authenticate(auth, ip string) (*consumerCredential, bool) {
+	username, password, ok := parseBasicAuth(auth)
+	if !ok {
+		return nil, false
+	}
+	sum := sha256.Sum256([]byte(password))
+	hash := hex.EncodeToString(sum[:])
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, found := s.consumers[username]
+	if !found {
+		return nil, false
+	}
+	match := secretEqual(hash, c.Hash)
+	if !match && c.PreviousHash != "" && time.Now().Before(c.PreviousExpires) {
+		match = secretEqual(hash, c.PreviousHash)
+	}
+	if !match || c.IP != ip {
+		return nil, false
+	}
+	return c, true
+}
+
+// seen counts an RPC request made with c.
+func (s *credentialStore) seen(c *consumerCredential) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c.requests++
+	c.lastSeen = time.Now()
+}
+
+// usedStatic counts a request made with the static login, warning the
+// first time each pup is seen using it.
+func (s *credentialStore) usedStatic(ip string) {
+	s.staticRequests.Add(1)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.staticIPs[ip] {
+		s.staticIPs[ip] = true
+		log.Printf("Credentials: the pup at %s uses the shared static login; it should enroll for its own credential", ip)
+	}
+}
+
+// consumerStatus is what the status endpoint reports about an issued
+// credential. The secret digests are left out.
+type consumerStatus struct {
+	Username string     `json:"username"`
+	Name     string     `json:"name"`
+	IP       string     `json:"ip"`
+	Created  time.Time  `json:"created"`
+	Rotated  time.Time  `json:"rotated"`
+	Requests int64      `json:"requests"`
+	LastSeen *time.Time `json:"last_seen,omitempty"`
+}
+
+func (s *credentialStore) states() []consumerStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	states := make([]consumerStatus, 0, len(s.consumers))
+	for _, c := range s.consumers {
+		state := consumerStatus{
+			Username: c.Username,
+			Name:     c.Name,
+			IP:       c.IP,
+			Created:  c.Created,
+			Rotated:  c.Rotated,
+			Requests: c.requests,
+		}
+		if !c.lastSeen.IsZero() {
+			t := c.lastSeen
+			state.LastSeen = &t
+		}
+		states = append(states, state)
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].Username < states[j].Username })
+	return states
+}
+
+// authenticateConsumer identifies the pup behind a local request: by the
+// credential issued to it, or by the static login if that is allowed. It
+// returns the username and name to attribute the request to.
+func authenticateConsumer(r *http.Request) (username, name string, ok bool) {
+	auth := r.Header.Get("Authorization")
+	if c, ok := credentials.authenticate(auth, remoteIP(r)); ok {
+		credentials.seen(c)
+		return c.Username, c.Name, true
+	}
+	if !staticLoginAllowed() {
+		return "", "", false
+	}
+	// Check both parts so the timing does not reveal which one was wrong
+	user, pass, _ := parseBasicAuth(auth)
+	userOK := secretEqual(user, staticUsername)
+	passOK := secretEqual(pass, staticPassword)
+	if userOK && passOK {
+		credentials.usedStatic(remoteIP(r))
+		return staticConsumer, staticConsumer, true
+	}
+	return "", "", false
+}
+
+// credentialReply is the answer to an enrollment or rotation. It is the
+// only time the secret is ever sent.
+type credentialReply struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Name     string `json:"name"`
+}
+
+// enrollHandler serves POST /dogebox/credentials: it issues a credential
+// to the calling pup if it has none yet. Dogebox only routes pups granted
+// the core-rpc interface's RPC permission group to the proxy, and gives
+// each its own IP, so the caller's address is all that identifies it.
+// Callers from outside the pup network are refused.
+func enrollHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeJSONError(w, http.StatusMethodNotAllowed, "use POST")
+		return
+	}
+	ip := remoteIP(r)
+	if !onPupNetwork(ip) {
+		log.Printf("Credentials: refused to enroll %s, which is not on the pup network", ip)
+		writeJSONError(w, http.StatusForbidden, errNotPup.Error())
+		return
+	}
+	c, secret, err := credentials.enroll(ip)
+	if err == errAlreadyEnrolled {
+		log.Printf("Credentials: refused to enroll %s again", ip)
+		writeJSONError(w, http.StatusConflict, err.Error())
+		return
+	}
+	if err != nil {
+		log.Printf("Credentials: failed to enroll %s: %v", ip, err)
+		writeJSONError(w, http.StatusInternalServerError, "could not store the credential")
+		return
+	}
+	log.Printf("Credentials: issued %s to %s", c.Username, c.Name)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(credentialReply{Username: c.Username, Password: secret, Name: c.Name})
+}
+
+// rotateHandler serves POST /dogebox/credentials/rotate, authenticated
+// with the credential to rotate, and answers with a new secret.
+func rotateHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeJSONError(w, http.StatusMethodNotAllowed, "use POST")
+		return
+	}
+	c, ok := credentials.authenticate(r.Header.Get("Authorization"), remoteIP(r))
+	if !ok {
+		authFailures.inc()
+		w.Header().Set("WWW-Authenticate", `Basic realm="Dogecoin RPC"`)
+		writeJSONError(w, http.StatusUnauthorized, "authenticate with the credential to rotate")
+		return
+	}
+	secret, err := credentials.rotate(c)
+	if err != nil {
+		log.Printf("Credentials: failed to rotate %s: %v", c.Username, err)
+		writeJSONError(w, http.StatusInternalServerError, "could not store the credential")
+		return
+	}
+	log.Printf("Credentials: rotated %s (%s)", c.Username, c.Name)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(credentialReply{Username: c.Username, Password: secret, Name: c.Name})
+}
+
+func writeJSONError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": message})
+}
+
+// consumerName is the name a pup is known by in logs and metrics, made
+// from the IP Dogebox assigned it.
+func consumerName(ip string) string {
+	return "pup-" + strings.NewReplacer(".", "-", ":", "-").Replace(ip)
+}
+
+// onPupNetwork reports whether ip is on the network DBX_PUP_IP belongs
+// to, which Dogebox assigns pup addresses from.
+func onPupNetwork(ip string) bool {
+	addr := net.ParseIP(ip)
+	own := net.ParseIP(pupIP)
+	if addr == nil || own == nil {
+		return false
+	}
+	if addrs, err := net.InterfaceAddrs(); err == nil {
+		for _, a := range addrs {
+			if n, ok := a.(*net.IPNet); ok && n.IP.Equal(own) {
+				return n.Contains(addr)
+			}
+		}
+	}
+	return addr.Equal(own)
+}
+
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func parseBasicAuth(auth string) (username, password string, ok bool) {
+	if !strings.HasPrefix(auth, "Basic ") {
+		return "", "", false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(auth[6:])
+	if err != nil {
+		return "", "", false
+	}
+	username, password, ok = strings.Cut(string(decoded), ":")
+	return username, password, ok
+}
+
+// newSecret returns a random secret and the digest the store keeps of
+// it. The secrets are random, so a plain SHA-256 is enough to keep them
+// from being read back out of the store.
+func newSecret() (secret, hash string) {
+	secret = randomHex(32)
+	sum := sha256.Sum256([]byte(secret))
+	return secret, hex.EncodeToString(sum[:])
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		log.Fatalf("Failed to generate a random secret: %v", err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// secretEqual compares two secrets in constant time. Hashing first keeps
+// the comparison from revealing the expected length.
+func secretEqual(got, want string) bool {
+	g := sha256.Sum256([]byte(got))
+	w := sha256.Sum256([]byte(want))
+	return subtle.ConstantTimeCompare(g[:], w[:]) == 1
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var storageDirectory string
+
+// dogecoindRPC is where dogecoind serves RPC. It only listens inside the
+// pup; other pups reach it through this proxy on the same port.
+const dogecoindRPC = "127.0.0.1:22555"
+
+// statusListenAddr is only reachable from inside the pup; the monitor
+// reads it to include the RPC consumers in the pup's metrics.
+const statusListenAddr = "127.0.0.1:22599"
+
+var (
+	pupIP              string
+	requireCredentials bool
+	authFailures       failureCount
+)
+
+// failureCount counts the requests refused for want of a valid login.
+type failureCount struct{ atomic.Int64 }
+
+func (c *failureCount) inc() { c.Add(1) }
+
+// staticLoginAllowed reports whether pups may still use the static login.
+func staticLoginAllowed() bool { return !requireCredentials }
+
+func main() {
+	pupIP = os.Getenv("DBX_PUP_IP")
+	requireCredentials, _ = strconv.ParseBool(os.Getenv("REQUIRE_PUP_CREDENTIALS"))
+
+	log.Printf("Dogecoin Core RPC proxy starting...")
+
+	var err error
+	credentials, err = openCredentialStore(filepath.Join(storageDirectory, credentialsFileName))
+	if err != nil {
+		log.Fatalf("Failed to read the issued credentials: %v", err)
+	}
+	credentials.revoke(strings.Fields(strings.ReplaceAll(os.Getenv("REVOKE_CREDENTIALS"), ",", " ")))
+	if requireCredentials {
+		log.Printf("  Pup credentials: required, the static login is refused")
+	} else {
+		log.Printf("  Pup credentials: optional, the static login is allowed")
+	}
+
+	upstream := &httputil.ReverseProxy{
+		Director: func(r *http.Request) {
+			r.URL.Scheme = "http"
+			r.URL.Host = dogecoindRPC
+			r.Header.Set("Authorization", internalAuth())
+		},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/dogebox/credentials", enrollHandler)
+	mux.HandleFunc("/dogebox/credentials/rotate", rotateHandler)
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		// Requests are counted per pup in the status, not logged, since
+		// wallets and indexers can poll Core many times a second
+		if _, _, ok := authenticateConsumer(r); !ok {
+			log.Printf("RPC Request: %s %s from %s rejected", r.Method, r.URL.Path, r.RemoteAddr)
+			authFailures.inc()
+			w.Header().Set("WWW-Authenticate", `Basic realm="Dogecoin RPC"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		upstream.ServeHTTP(w, r)
+	})
+
+	go startStatusServer()
+
+	listenAddr := pupIP + ":22555"
+	log.Printf("RPC proxy listening on %s -> %s", listenAddr, dogecoindRPC)
+	log.Fatal(http.ListenAndServe(listenAddr, mux))
+}
+
+// internalAuth returns the login for dogecoind, which run.sh keeps in
+// /storage. The files are read again whenever they change.
+func internalAuth() string {
+	internal.mu.Lock()
+	defer internal.mu.Unlock()
+
+	path := filepath.Join(storageDirectory, "rpcpassword.txt")
+	info, err := os.Stat(path)
+	if err != nil {
+		return internal.auth
+	}
+	if info.ModTime().Equal(internal.modified) {
+		return internal.auth
+	}
+	user, err := os.ReadFile(filepath.Join(storageDirectory, "rpcuser.txt"))
+	if err != nil {
+		return internal.auth
+	}
+	pass, err := os.ReadFile(path)
+	if err != nil {
+		return internal.auth
+	}
+	internal.auth = "Basic " + base64.StdEncoding.EncodeToString(
+		[]byte(strings.TrimSpace(string(user))+":"+strings.TrimSpace(string(pass))))
+	internal.modified = info.ModTime()
+	return internal.auth
+}
+
+var internal struct {
+	mu       sync.Mutex
+	auth     string
+	modified time.Time
+}
+
+func startStatusServer() {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"credentials": map[string]interface{}{
+				"required":        requireCredentials,
+				"consumers":       credentials.states(),
+				"static_requests": credentials.staticRequests.Load(),
+			},
+			"auth_failures": authFailures.Load(),
+		})
+	})
+
+	log.Printf("Status endpoint listening on %s", statusListenAddr)
+	if err := http.ListenAndServe(statusListenAddr, mux); err != nil {
+		log.Printf("Status endpoint failed: %v", err)
+	}
+}
@@ -14,6 +14,9 @@ let
 
   dogecoind = pkgs.writeScriptBin "run.sh" ''
     #!${pkgs.stdenv.shell}
+    # dogecoind only listens inside this pup. Other pups reach it through
+    # rpc-proxy, which accepts the static login unless pup credentials are
+    # required, and logs in with the one kept here.
     if [ ! -f /storage/rpcuser.txt ] || [ ! -f /storage/rpcpassword.txt ]; then
         RPCUSER=dogebox_core_pup_temporary_static_username
         RPCPASS=dogebox_core_pup_temporary_static_password
@@ -31,9 +34,9 @@ let
       -rpc=1 \
       -rpcuser=$RPCUSER \
       -rpcpassword=$RPCPASS \
-      -rpcbind=$DBX_PUP_IP \
+      -rpcbind=127.0.0.1 \
       -rpcport=22555 \
-      -rpcallowip=0.0.0.0/0 \
+      -rpcallowip=127.0.0.1 \
       -zmqpubhashblock=tcp://0.0.0.0:28332
   '';
 
@@ -57,6 +60,24 @@ let
     '';
   };
 
+  proxy = pkgs.buildGoModule {
+    pname = "rpc-proxy";
+    version = "0.0.1";
+    src = ./proxy;
+    vendorHash = null;
+
+    buildPhase = ''
+      export GO111MODULE=off
+      export GOCACHE=$(pwd)/.gocache
+      go build -ldflags "-X main.storageDirectory=${storageDirectory}" -o rpc-proxy .
+    '';
+
+    installPhase = ''
+      mkdir -p $out/bin
+      cp rpc-proxy $out/bin/
+    '';
+  };
+
   logger = pkgs.buildGoModule {
     pname = "logger";
     version = "0.0.1";
@@ -77,4 +98,5 @@ let
 in
 {
   inherit dogecoind monitor logger;
+  rpc-proxy = proxy;
 }
\ No newline at end of file
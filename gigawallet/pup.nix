@@ -42,6 +42,28 @@ if [ ! -d "/storage/.gigawallet" ]; then
   mkdir /storage/.gigawallet
 fi
 
+# Core issues each pup an RPC login of its own. Enroll once and keep it;
+# providers from before that answer 401 or 404 and still take the static
+# login.
+CRED=/storage/core-credentials.json
+RPCUSER=dogebox_core_pup_temporary_static_username
+RPCPASS=dogebox_core_pup_temporary_static_password
+while [ ! -f "$CRED" ]; do
+  CODE=$(umask 077; ${pkgs.curl}/bin/curl -s -o "$CRED.tmp" -w '%{http_code}' -X POST \
+    "http://$DBX_IFACE_CORE_RPC_HOST:$DBX_IFACE_CORE_RPC_PORT/dogebox/credentials")
+  case "$CODE" in
+    200|201) mv "$CRED.tmp" "$CRED" ;;
+    401|404) echo "Core does not issue credentials, using the static login"; break ;;
+    409) echo "Core already issued this pup a credential; using the static login until it has gone unused for an hour or is revoked in the Core pup's config"; break ;;
+    *) echo "Enrolling with Core failed (HTTP $CODE), retrying"; sleep 10 ;;
+  esac
+done
+rm -f "$CRED.tmp"
+if [ -f "$CRED" ]; then
+  RPCUSER=$(${pkgs.jq}/bin/jq -r .username "$CRED")
+  RPCPASS=$(${pkgs.jq}/bin/jq -r .password "$CRED")
+fi
+
   cat <<EOF > /storage/.gigawallet/dogebox.toml
 [WebAPI]
   adminbind = "$DBX_PUP_IP"
@@ -61,9 +83,10 @@ DBFile = "/storage/gigawallet.db"
   zmqport = $DBX_IFACE_CORE_ZMQ_PORT
   rpchost = "$DBX_IFACE_CORE_RPC_HOST"
   rpcport = $DBX_IFACE_CORE_RPC_PORT
-  rpcpass = "dogebox_core_pup_temporary_static_password"
-  rpcuser = "dogebox_core_pup_temporary_static_username"
+  rpcpass = "$RPCPASS"
+  rpcuser = "$RPCUSER"
 EOF
+chmod 600 /storage/.gigawallet/dogebox.toml
 
 HOME=/storage GIGA_ENV=dogebox ${gigawallet_bin}/bin/gigawallet server
   '';